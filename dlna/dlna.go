@@ -1,7 +1,9 @@
 package dlna
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -53,19 +55,43 @@ func (cf ContentFeatures) String() (ret string) {
 	return strings.Join(params, ";")
 }
 
+// ParseNPTTime parses a normal play time, either in seconds ("75.5") or as
+// hours, minutes and seconds ("0:01:15.500").
 func ParseNPTTime(s string) (time.Duration, error) {
-	var h, m, sec, ms time.Duration
-	n, err := fmt.Sscanf(s, "%d:%2d:%2d.%3d", &h, &m, &sec, &ms)
-	if err != nil {
-		return -1, err
+	parts := strings.Split(s, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return -1, fmt.Errorf("invalid npt time: %s", s)
+	}
+	var ret time.Duration
+	for i, part := range parts[:len(parts)-1] {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil || part == "" || i == 1 && n > 59 {
+			return -1, fmt.Errorf("invalid npt time: %s", s)
+		}
+		ret = ret*60 + time.Duration(n)
 	}
-	if n < 3 {
+	ret *= time.Minute
+	sec := parts[len(parts)-1]
+	whole, frac, _ := strings.Cut(sec, ".")
+	n, err := strconv.ParseUint(whole, 10, 64)
+	if err != nil || len(parts) == 3 && n > 59 {
 		return -1, fmt.Errorf("invalid npt time: %s", s)
 	}
-	ret := time.Duration(h) * time.Hour
-	ret += time.Duration(m) * time.Minute
-	ret += sec * time.Second
-	ret += ms * time.Millisecond
+	ret += time.Duration(n) * time.Second
+	if frac != "" {
+		// Nanoseconds are as precise as a time.Duration gets.
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		f, err := strconv.ParseUint(frac, 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("invalid npt time: %s", s)
+		}
+		for i := len(frac); i < 9; i++ {
+			f *= 10
+		}
+		ret += time.Duration(f)
+	}
 	return ret, nil
 }
 
@@ -81,29 +107,101 @@ func FormatNPTTime(npt time.Duration) string {
 	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
 }
 
+// NPTRange is a range of normal play time. A negative End means the range
+// runs to the end of the media. A negative Start means the range is the last
+// End of the media.
 type NPTRange struct {
 	Start, End time.Duration
 }
 
+// ParseNPTRange parses the value of a TimeSeekRange.dlna.org request header,
+// without the "npt=" prefix. Either end of the range may be left out, and
+// any instance duration following a "/" is ignored.
 func ParseNPTRange(s string) (ret NPTRange, err error) {
-	ss := strings.SplitN(s, "-", 2)
-	if ss[0] != "" {
-		ret.Start, err = ParseNPTTime(ss[0])
+	s, _, _ = strings.Cut(s, "/")
+	start, end, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok || start == "" && end == "" {
+		err = fmt.Errorf("invalid npt range: %s", s)
+		return
+	}
+	ret.Start, ret.End = -1, -1
+	if start != "" {
+		ret.Start, err = ParseNPTTime(start)
 		if err != nil {
 			return
 		}
 	}
-	if ss[1] != "" {
-		ret.End, err = ParseNPTTime(ss[1])
+	if end != "" {
+		ret.End, err = ParseNPTTime(end)
 		if err != nil {
 			return
 		}
+		if ret.Start >= 0 && ret.End < ret.Start {
+			err = fmt.Errorf("npt range ends before it starts: %s", s)
+			return
+		}
 	}
 	return
 }
 
+// ErrNPTRangeNotSatisfiable is returned by NPTRange.Resolve for ranges that
+// start beyond the end of the media.
+var ErrNPTRangeNotSatisfiable = errors.New("npt range not satisfiable")
+
+// Resolve returns the range in media of the given duration, with Start set,
+// and End clamped to the duration. A duration of zero or less means it isn't
+// known, in which case End may still be negative.
+func (me NPTRange) Resolve(duration time.Duration) (ret NPTRange, err error) {
+	ret = me
+	if ret.Start < 0 {
+		if duration <= 0 {
+			err = errors.New("npt range relative to unknown duration")
+			return
+		}
+		ret.Start = max(duration-ret.End, 0)
+		ret.End = duration
+	}
+	if duration > 0 {
+		if ret.Start >= duration {
+			err = ErrNPTRangeNotSatisfiable
+			return
+		}
+		if ret.End < 0 || ret.End > duration {
+			ret.End = duration
+		}
+	}
+	return
+}
+
+// Length returns the length of the range, or zero if it's open-ended.
+func (me NPTRange) Length() time.Duration {
+	if me.End < 0 {
+		return 0
+	}
+	return me.End - me.Start
+}
+
+// ResponseHeader formats the range for the TimeSeekRange.dlna.org response
+// header, with the "npt=" prefix. A duration of zero or less is given as "*".
+func (me NPTRange) ResponseHeader(duration time.Duration) string {
+	ret := "npt=" + FormatNPTTime(me.Start) + "-"
+	if me.End >= 0 {
+		ret += FormatNPTTime(me.End)
+	}
+	ret += "/"
+	if duration > 0 {
+		ret += FormatNPTTime(duration)
+	} else {
+		ret += "*"
+	}
+	return ret
+}
+
 func (me NPTRange) String() (ret string) {
-	ret = me.Start.String() + "-"
+	if me.Start >= 0 {
+		ret = me.Start.String()
+	}
+	ret += "-"
 	if me.End >= 0 {
 		ret += me.End.String()
 	}
@@ -2,6 +2,7 @@ package dlna
 
 import (
 	"testing"
+	"time"
 )
 
 func TestContentFeaturesString(t *testing.T) {
@@ -14,3 +15,72 @@ func TestContentFeaturesString(t *testing.T) {
 		t.Fatal(a)
 	}
 }
+
+func TestParseNPTTime(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected time.Duration
+	}{
+		{"0", 0},
+		{"75.5", 75*time.Second + 500*time.Millisecond},
+		{"0:01:15", 75 * time.Second},
+		{"1:02:03.25", time.Hour + 2*time.Minute + 3*time.Second + 250*time.Millisecond},
+		{"00:00:10.000", 10 * time.Second},
+	} {
+		d, err := ParseNPTTime(tc.s)
+		if err != nil || d != tc.expected {
+			t.Errorf("%q: got %v, %v", tc.s, d, err)
+		}
+	}
+	for _, bad := range []string{"", "now", "1:2", "0:60:00", "0:00:60", "a", "1.b"} {
+		if _, err := ParseNPTTime(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestNPTRange(t *testing.T) {
+	const duration = 10 * time.Minute
+	for _, tc := range []struct {
+		header, expected string
+	}{
+		{"10-20", "npt=00:00:10.000-00:00:20.000/00:10:00.000"},
+		{"00:00:10.500-", "npt=00:00:10.500-00:10:00.000/00:10:00.000"},
+		{"0-/*", "npt=00:00:00.000-00:10:00.000/00:10:00.000"},
+		{"590-700", "npt=00:09:50.000-00:10:00.000/00:10:00.000"},
+		// The last minute.
+		{"-60", "npt=00:09:00.000-00:10:00.000/00:10:00.000"},
+	} {
+		r, err := ParseNPTRange(tc.header)
+		if err != nil {
+			t.Errorf("%q: %v", tc.header, err)
+			continue
+		}
+		r, err = r.Resolve(duration)
+		if err != nil {
+			t.Errorf("%q: %v", tc.header, err)
+			continue
+		}
+		if got := r.ResponseHeader(duration); got != tc.expected {
+			t.Errorf("%q: got %q", tc.header, got)
+		}
+	}
+	for _, bad := range []string{"", "-", "10", "20-10", "x-"} {
+		if _, err := ParseNPTRange(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+	r, _ := ParseNPTRange("600-")
+	if _, err := r.Resolve(duration); err != ErrNPTRangeNotSatisfiable {
+		t.Errorf("got %v resolving range past the end", err)
+	}
+	// Without a duration, open-ended ranges stay open.
+	r, _ = ParseNPTRange("30-")
+	r, err := r.Resolve(0)
+	if err != nil || r.Length() != 0 || r.ResponseHeader(0) != "npt=00:00:30.000-/*" {
+		t.Errorf("got %v, %v", r, err)
+	}
+	if _, err := (NPTRange{Start: -1, End: time.Minute}).Resolve(0); err == nil {
+		t.Error("expected error resolving suffix range without duration")
+	}
+}
@@ -0,0 +1,44 @@
+package dms
+
+import (
+	"io/fs"
+	"strings"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+// The names of images used as a directory's art, in order of preference.
+// They're matched regardless of case.
+var folderArtNames = []string{"cover.jpg", "folder.jpg", "AlbumArtSmall.jpg"}
+
+// Returns the name of the directory's art image, if it has one, given the
+// directory's contents.
+func folderArt(fis []fs.FileInfo) (string, bool) {
+	for _, name := range folderArtNames {
+		for _, fi := range fis {
+			if strings.EqualFold(fi.Name(), name) && fi.Mode().IsRegular() {
+				return fi.Name(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the index of the stream of embedded cover art, such as an ID3
+// APIC frame or FLAC picture block.
+func embeddedArtStream(info *ffprobe.Info) (int, bool) {
+	if info == nil {
+		return 0, false
+	}
+	for _, s := range info.Streams {
+		if s["codec_type"] != "video" || !isAttachedPicture(s) {
+			continue
+		}
+		index, err := ffprobe.AnyAsFloat64(s["index"])
+		if err != nil {
+			continue
+		}
+		return int(index), true
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package dms
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Transcodes from /res take audioStream=<index> to have only that audio
+// stream of a video. Otherwise videos with several use the first in the
+// most preferred of PreferredAudioLanguages, if there is one.
+
+// An audio stream of a video.
+type audioTrack struct {
+	// The index of the stream.
+	stream int
+	// From the stream's language tag, such as "eng". It's empty if the
+	// stream doesn't have one.
+	language string
+}
+
+// Returns the audio streams in info.
+func audioTracks(info *ffprobe.Info) (ret []audioTrack) {
+	if info == nil {
+		return
+	}
+	for _, strm := range info.Streams {
+		if strm["codec_type"] != "audio" {
+			continue
+		}
+		index, err := ffprobe.AnyAsFloat64(strm["index"])
+		if err != nil {
+			continue
+		}
+		t := audioTrack{stream: int(index)}
+		if tags, ok := strm["tags"].(map[string]interface{}); ok {
+			t.language, _ = tags["language"].(string)
+		}
+		ret = append(ret, t)
+	}
+	return
+}
+
+// Returns the first track in the most preferred language.
+func (srv *Server) preferredAudioTrack(tracks []audioTrack) (audioTrack, bool) {
+	for _, lang := range srv.PreferredAudioLanguages {
+		for _, t := range tracks {
+			if strings.EqualFold(t.language, lang) {
+				return t, true
+			}
+		}
+	}
+	return audioTrack{}, false
+}
+
+// Returns the audio stream a /res request's transcode should have: the one
+// its audioStream parameter gives, or else one in a preferred language if
+// the video has a choice. It's !ok if the profile's choice should stand.
+func (srv *Server) transcodeAudio(filePath string, q url.Values) (t audioTrack, ok bool, err error) {
+	if !q.Has("audioStream") && len(srv.PreferredAudioLanguages) == 0 {
+		return
+	}
+	var info *ffprobe.Info
+	if !srv.NoProbe {
+		info, _ = srv.ffmpegProbe(filePath)
+	}
+	tracks := audioTracks(info)
+	if q.Has("audioStream") {
+		for _, t := range tracks {
+			if strconv.Itoa(t.stream) == q.Get("audioStream") {
+				return t, true, nil
+			}
+		}
+		err = errors.New("no such audio stream")
+		return
+	}
+	if len(tracks) < 2 {
+		return
+	}
+	t, ok = srv.preferredAudioTrack(tracks)
+	return
+}
+
+// Sets the resource's audio properties from the first audio stream in info.
+func setAudioFormat(res *upnpav.Resource, info *ffprobe.Info) {
+	if info == nil {
+		return
+	}
+	for _, strm := range info.Streams {
+		if strm["codec_type"] != "audio" {
+			continue
+		}
+		res.NrAudioChannels = streamUint(strm, "channels")
+		res.SampleFrequency = streamUint(strm, "sample_rate")
+		// Lossless codecs give one or the other. Lossy ones have neither.
+		res.BitsPerSample = streamUint(strm, "bits_per_sample")
+		if res.BitsPerSample == 0 {
+			res.BitsPerSample = streamUint(strm, "bits_per_raw_sample")
+		}
+		return
+	}
+}
+
+// Returns a numeric field of an ffprobe stream, which might be given as a
+// string, or zero if it's missing.
+func streamUint(strm map[string]interface{}, key string) uint {
+	if s, ok := strm[key].(string); ok {
+		n, _ := strconv.ParseUint(s, 10, 0)
+		return uint(n)
+	}
+	f, err := ffprobe.AnyAsFloat64(strm[key])
+	if err != nil || f < 0 {
+		return 0
+	}
+	return uint(f)
+}
+
+// Adds the audio track to a /res query, to have only it in the transcode.
+func (t audioTrack) setQuery(q url.Values) {
+	q.Set("audioStream", strconv.Itoa(t.stream))
+}
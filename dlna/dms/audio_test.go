@@ -0,0 +1,60 @@
+package dms
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestTranscodeAudio(t *testing.T) {
+	info := &ffprobe.Info{Streams: []map[string]interface{}{
+		{"index": json.Number("0"), "codec_type": "video"},
+		{"index": json.Number("1"), "codec_type": "audio", "tags": map[string]interface{}{"language": "eng"}},
+		{"index": json.Number("2"), "codec_type": "audio", "tags": map[string]interface{}{"language": "ger"}},
+	}}
+	srv := &Server{NoProbe: true, FS: fstest.MapFS{"movie.mkv": {}}}
+	// The profile's choice stands without a preference, and streams can't be
+	// chosen without probing.
+	if _, ok, err := srv.transcodeAudio("movie.mkv", url.Values{}); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, _, err := srv.transcodeAudio("movie.mkv", url.Values{"audioStream": {"2"}}); err == nil {
+		t.Fatal("chose audio stream without probing")
+	}
+	srv.PreferredAudioLanguages = []string{"fre", "GER", "eng"}
+	if tr, ok := srv.preferredAudioTrack(audioTracks(info)); !ok || tr.stream != 2 {
+		t.Fatal(tr, ok)
+	}
+	if tr, _ := srv.preferredAudioTrack(audioTracks(info)[:1]); tr.language != "eng" {
+		t.Fatal(tr)
+	}
+
+	var tracks []string
+	c := client{host: "dms:1338", profile: &DeviceProfile{}}
+	for _, res := range srv.transcodeResources(c, "movie.mkv", "video/x-matroska", info, srv.subtitles("movie.mkv", nil, info), "", "") {
+		if strings.Contains(res.URL, "audioStream") {
+			tracks = append(tracks, res.URL)
+		}
+	}
+	if strings.Join(tracks, " ") != "http://dms:1338/res?audioStream=1&path=movie.mkv&transcode=t "+
+		"http://dms:1338/res?audioStream=2&path=movie.mkv&transcode=t" {
+		t.Fatal(tracks)
+	}
+}
+
+func TestSetAudioFormat(t *testing.T) {
+	var res upnpav.Resource
+	setAudioFormat(&res, &ffprobe.Info{Streams: []map[string]interface{}{
+		{"codec_type": "video", "bits_per_raw_sample": "8"},
+		{"codec_type": "audio", "channels": json.Number("6"), "sample_rate": "48000", "bits_per_sample": json.Number("0"), "bits_per_raw_sample": "24"},
+	}})
+	if res.NrAudioChannels != 6 || res.SampleFrequency != 48000 || res.BitsPerSample != 24 {
+		t.Fatalf("%+v", res)
+	}
+}
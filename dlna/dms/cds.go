@@ -9,9 +9,12 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/anacrolix/ffprobe"
 
@@ -26,10 +29,107 @@ const dmsMetadataSuffix = ".dms.json"
 type contentDirectoryService struct {
 	*Server
 	upnp.Eventing
+
+	updateIDsMu     sync.Mutex
+	systemUpdateID  uint32
+	initialUpdateID uint32
+	// Container object IDs to the SystemUpdateID when they last changed.
+	// Containers that haven't changed since startup aren't present.
+	containerUpdateIDs map[string]uint32
+	// The SystemUpdateID subscribers were last notified of, the containers
+	// changed since, in the order they changed, and whether a goroutine is
+	// notifying them.
+	notifiedUpdateID  uint32
+	pendingContainers []string
+	notifying         bool
+}
+
+func newContentDirectoryService(server *Server) *contentDirectoryService {
+	// The SystemUpdateID must not go backwards over restarts while clients
+	// may have cached content, so start from the current time rather than
+	// zero.
+	updateID := uint32(time.Now().Unix())
+	return &contentDirectoryService{
+		Server:             server,
+		systemUpdateID:     updateID,
+		initialUpdateID:    updateID,
+		notifiedUpdateID:   updateID,
+		containerUpdateIDs: make(map[string]uint32),
+	}
 }
 
 func (cds *contentDirectoryService) updateIDString() string {
-	return fmt.Sprintf("%d", uint32(os.Getpid()))
+	cds.updateIDsMu.Lock()
+	defer cds.updateIDsMu.Unlock()
+	return fmt.Sprint(cds.systemUpdateID)
+}
+
+// Returns the update ID for a container. Containers that haven't changed
+// report the SystemUpdateID from startup.
+func (cds *contentDirectoryService) containerUpdateIDString(id string) string {
+	cds.updateIDsMu.Lock()
+	defer cds.updateIDsMu.Unlock()
+	if updateID, ok := cds.containerUpdateIDs[id]; ok {
+		return fmt.Sprint(updateID)
+	}
+	return fmt.Sprint(cds.initialUpdateID)
+}
+
+// containersChanged bumps the SystemUpdateID and the update IDs of the given
+// containers, and notifies event subscribers of the change. Subscribers are
+// notified in the background, so slow ones don't hold up the caller. Changes
+// made while they're being notified are sent together afterwards.
+func (cds *contentDirectoryService) containersChanged(ids []string) {
+	cds.updateIDsMu.Lock()
+	defer cds.updateIDsMu.Unlock()
+	cds.systemUpdateID++
+	for _, id := range ids {
+		if !slices.Contains(cds.pendingContainers, id) {
+			cds.pendingContainers = append(cds.pendingContainers, id)
+		}
+		cds.containerUpdateIDs[id] = cds.systemUpdateID
+	}
+	if !cds.notifying {
+		cds.notifying = true
+		go cds.notifyChanges()
+	}
+}
+
+// Notifies event subscribers of changed containers until there are no more.
+// Only one runs at a time, so events go out in the order of their update IDs.
+func (cds *contentDirectoryService) notifyChanges() {
+	for {
+		cds.updateIDsMu.Lock()
+		if cds.systemUpdateID == cds.notifiedUpdateID {
+			cds.notifying = false
+			cds.updateIDsMu.Unlock()
+			return
+		}
+		containerUpdateIDs := make([]string, 0, 2*len(cds.pendingContainers))
+		for _, id := range cds.pendingContainers {
+			containerUpdateIDs = append(containerUpdateIDs, id, fmt.Sprint(cds.containerUpdateIDs[id]))
+		}
+		cds.pendingContainers = nil
+		cds.notifiedUpdateID = cds.systemUpdateID
+		vars := contentDirectoryEventedVariables(cds.systemUpdateID, containerUpdateIDs)
+		cds.updateIDsMu.Unlock()
+		cds.Notify(vars...)
+	}
+}
+
+// Returns the evented ContentDirectory state variables. containerUpdateIDs
+// alternates container object IDs and their update IDs.
+func contentDirectoryEventedVariables(systemUpdateID uint32, containerUpdateIDs []string) []upnp.Variable {
+	return []upnp.Variable{
+		{
+			XMLName: xml.Name{Local: "SystemUpdateID"},
+			Value:   fmt.Sprint(systemUpdateID),
+		},
+		{
+			XMLName: xml.Name{Local: "ContainerUpdateIDs"},
+			Value:   strings.Join(containerUpdateIDs, ","),
+		},
+	}
 }
 
 type dmsDynamicStreamResource struct {
@@ -71,7 +171,7 @@ func readDynamicStream(fsys fs.FS, metadataPath string) (*dmsDynamicMediaItem, e
 	return &re, nil
 }
 
-func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObject object, fileInfo fs.FileInfo, host, userAgent string) (ret interface{}, err error) {
+func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObject object, fileInfo fs.FileInfo, c client) (ret interface{}, err error) {
 	// at this point we know that entryFilePath points to a .dms.json file; slurp and parse
 	dmsMediaItem, err := readDynamicStream(me.FS, cdsObject.FilePath())
 	if err != nil {
@@ -80,22 +180,24 @@ func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObjec
 	}
 
 	obj := upnpav.Object{
-		ID:         cdsObject.ID(),
+		ID:         me.objectID(cdsObject, fileInfo),
 		Restricted: 1,
-		ParentID:   cdsObject.ParentID(),
-	}
-	iconURI := (&url.URL{
-		Scheme: "http",
-		Host:   host,
-		Path:   iconPath,
-		RawQuery: url.Values{
-			"path": {cdsObject.Path},
-		}.Encode(),
-	}).String()
-	obj.Icon = iconURI
-	// TODO(anacrolix): This might not be necessary due to item res image
-	// element.
-	obj.AlbumArtURI = iconURI
+		ParentID:   me.parentObjectID(cdsObject),
+	}
+	// A thumbnail is only offered if one can be made of the metadata file,
+	// as for other items, rather than the server's icon standing in for it.
+	metadataType, err := me.mimeTypeByPath(cdsObject.FilePath())
+	if err != nil {
+		return
+	}
+	_, thumbnails := me.thumbnailSource(cdsObject.FilePath(), metadataType, nil, nil)
+	if thumbnails {
+		iconURI := thumbnailURL(c.host, cdsObject.Path, thumbnailSizes[0])
+		obj.Icon = iconURI
+		// TODO(anacrolix): This might not be necessary due to item res image
+		// element.
+		obj.AlbumArtURI = iconURI
+	}
 
 	switch dmsMediaItem.Type {
 	case "video":
@@ -110,7 +212,7 @@ func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObjec
 	if obj.Title == "" {
 		obj.Title = strings.TrimSuffix(fileInfo.Name(), dmsMetadataSuffix)
 	}
-	obj.Date = upnpav.Timestamp{Time: fileInfo.ModTime()}
+	obj.Date = c.timestamp(fileInfo.ModTime())
 
 	item := upnpav.Item{
 		Object: obj,
@@ -126,7 +228,7 @@ func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObjec
 		item.Res = append(item.Res, upnpav.Resource{
 			URL: (&url.URL{
 				Scheme: "http",
-				Host:   host,
+				Host:   c.host,
 				Path:   resPath,
 				RawQuery: url.Values{
 					"path":  {cdsObject.Path},
@@ -147,29 +249,23 @@ func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObjec
 	}
 
 	// and an icon
-	item.Res = append(item.Res, upnpav.Resource{
-		URL: (&url.URL{
-			Scheme: "http",
-			Host:   host,
-			Path:   iconPath,
-			RawQuery: url.Values{
-				"path": {cdsObject.Path},
-				"c":    {"jpeg"},
-			}.Encode(),
-		}).String(),
-		ProtocolInfo: "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN",
-	})
+	if thumbnails {
+		item.Res = append(item.Res, thumbnailResource(c.host, cdsObject.Path, thumbnailSizes[0]))
+	}
 
 	ret = item
 	return
 }
 
-// Turns the given entry and DMS host into a UPnP object. A nil object is
-// returned if the entry is not of interest.
+// Turns the given entry into a UPnP object for the client. A nil object is
+// returned if the entry is not of interest. The siblings are the contents of
+// the entry's directory, if the caller has read them, which saves reading
+// them again for its subtitles and folder art.
 func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 	cdsObject object,
 	fileInfo fs.FileInfo,
-	host, userAgent string,
+	siblings []fs.FileInfo,
+	c client,
 ) (ret interface{}, err error) {
 	entryFilePath := cdsObject.FilePath()
 	ignored, err := me.IgnorePath(entryFilePath)
@@ -181,18 +277,24 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 	}
 	isDmsMetadata := strings.HasSuffix(entryFilePath, dmsMetadataSuffix)
 	if !fileInfo.IsDir() && me.AllowDynamicStreams && isDmsMetadata {
-		return me.cdsObjectDynamicStreamToUpnpavObject(cdsObject, fileInfo, host, userAgent)
+		return me.cdsObjectDynamicStreamToUpnpavObject(cdsObject, fileInfo, c)
 	}
 
 	obj := upnpav.Object{
-		ID:         cdsObject.ID(),
+		ID:         me.objectID(cdsObject, fileInfo),
 		Restricted: 1,
-		ParentID:   cdsObject.ParentID(),
+		ParentID:   me.parentObjectID(cdsObject),
 	}
 	if fileInfo.IsDir() {
 		obj.Class = "object.container.storageFolder"
 		obj.Title = fileInfo.Name()
-		childCount := me.objectChildCount(cdsObject)
+		obj.Searchable = 1
+		obj.Date = c.timestamp(fileInfo.ModTime())
+		children, _ := me.readDir(cdsObject)
+		if name, ok := folderArt(children); ok {
+			obj.AlbumArtURI = thumbnailURL(c.host, path.Join(cdsObject.Path, name), thumbnailSizes[0])
+		}
+		childCount := me.objectChildCount(cdsObject, children)
 		if childCount != 0 {
 			ret = upnpav.Container{Object: obj, ChildCount: childCount}
 		}
@@ -202,7 +304,7 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		me.Logger.Info("ignored: non-regular file", "path", cdsObject.FilePath())
 		return
 	}
-	mimeType, err := MimeTypeByPath(me.FS, entryFilePath)
+	mimeType, err := me.fileMimeType(entryFilePath, fileInfo)
 	if err != nil {
 		return
 	}
@@ -216,18 +318,6 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		}
 		return
 	}
-	iconURI := (&url.URL{
-		Scheme: "http",
-		Host:   host,
-		Path:   iconPath,
-		RawQuery: url.Values{
-			"path": {cdsObject.Path},
-		}.Encode(),
-	}).String()
-	obj.Icon = iconURI
-	// TODO(anacrolix): This might not be necessary due to item res image
-	// element.
-	obj.AlbumArtURI = iconURI
 	obj.Class = "object.item." + mimeType.Type() + "Item"
 	var (
 		ffInfo        *ffprobe.Info
@@ -235,7 +325,8 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		resDuration   string
 	)
 	if !me.NoProbe {
-		ffInfo, probeErr := me.ffmpegProbe(entryFilePath)
+		var probeErr error
+		ffInfo, probeErr = me.fileProbe(entryFilePath, fileInfo)
 		switch probeErr {
 		case nil:
 			if ffInfo != nil {
@@ -243,6 +334,7 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 				if d, err := ffInfo.Duration(); err == nil {
 					resDuration = misc.FormatDurationSexagesimal(d)
 				}
+				itemExtra(&obj, ffInfo)
 			}
 		case ffprobe.ExeNotFound:
 		default:
@@ -252,92 +344,126 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 	if obj.Title == "" {
 		obj.Title = fileInfo.Name()
 	}
-	resolution := func() string {
-		if ffInfo != nil {
-			for _, strm := range ffInfo.Streams {
-				if strm["codec_type"] != "video" {
-					continue
-				}
-				width := strm["width"]
-				height := strm["height"]
-				return fmt.Sprintf("%.0fx%.0f", width, height)
-			}
-		}
-		return ""
-	}()
+	obj.Date = c.timestamp(me.itemDate(entryFilePath, mimeType, fileInfo, ffInfo))
+	_, thumbnails := me.thumbnailSource(entryFilePath, mimeType, ffInfo, siblings)
+	if thumbnails {
+		iconURI := thumbnailURL(c.host, cdsObject.Path, thumbnailSizes[0])
+		obj.Icon = iconURI
+		// TODO(anacrolix): This might not be necessary due to item res image
+		// element.
+		obj.AlbumArtURI = iconURI
+	}
+	resolution := videoResolution(ffInfo)
 	item := upnpav.Item{
 		Object: obj,
-		// Capacity: 1 for raw, 1 for icon, plus transcodes.
-		Res: make([]upnpav.Resource, 0, 2+len(transcodes)),
+		// Capacity: 1 for raw, plus thumbnails, photo sizes and transcodes.
+		Res: make([]upnpav.Resource, 0, 1+len(thumbnailSizes)+len(photoSizes)+len(me.transcodeProfiles())),
 	}
-	item.Res = append(item.Res, upnpav.Resource{
+	original := upnpav.Resource{
 		URL: (&url.URL{
 			Scheme: "http",
-			Host:   host,
+			Host:   c.host,
 			Path:   resPath,
 			RawQuery: url.Values{
 				"path": {cdsObject.Path},
 			}.Encode(),
 		}).String(),
-		ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{
-			SupportRange: true,
-		}.String()),
-		Bitrate:    nativeBitrate,
-		Duration:   resDuration,
-		Size:       uint64(fileInfo.Size()),
-		Resolution: resolution,
-	})
+		ProtocolInfo: originalProtocolInfo(mimeType),
+		Bitrate:      nativeBitrate,
+		Duration:     resDuration,
+		Size:         uint64(fileInfo.Size()),
+		Resolution:   resolution,
+	}
+	setAudioFormat(&original, ffInfo)
+	var subs []subtitle
 	if mimeType.IsVideo() {
-		if !me.NoTranscode {
-			item.Res = append(item.Res, transcodeResources(host, cdsObject.Path, resolution, resDuration)...)
+		subs = me.subtitles(entryFilePath, siblings, ffInfo)
+	}
+	// Clients that are known to play the file get only the original. The
+	// rest get the alternatives first, in case they just pick the first
+	// resource they're given.
+	method, remuxProfile := c.profile.playMethod(mimeType, ffInfo)
+	switch {
+	case !me.transcodingEnabled() || c.profile.NoTranscode:
+		item.Res = append(item.Res, original)
+	case method == remux:
+		item.Res = append(item.Res, transcodeResource(c, url.Values{"path": {cdsObject.Path}}, remuxProfile, resolution, resDuration), original)
+	case method == fullTranscode:
+		item.Res = append(item.Res, me.transcodeResources(c, cdsObject.Path, mimeType, ffInfo, subs, resolution, resDuration)...)
+		item.Res = append(item.Res, original)
+	case c.profile.knowsCapabilities() && ffInfo != nil:
+		item.Res = append(item.Res, original)
+	default:
+		item.Res = append(item.Res, original)
+		item.Res = append(item.Res, me.transcodeResources(c, cdsObject.Path, mimeType, ffInfo, subs, resolution, resDuration)...)
+	}
+	if mimeType.IsVideo() {
+		me.addSubtitles(&item, c, cdsObject.Path, subs)
+	}
+	if thumbnails {
+		for _, size := range thumbnailSizes {
+			item.Res = append(item.Res, thumbnailResource(c.host, cdsObject.Path, size))
 		}
-		item.Res = append(item.Res, upnpav.Resource{
-			URL: (&url.URL{
-				Scheme: "http",
-				Host:   host,
-				Path:   subtitlePath,
-				RawQuery: url.Values{
-					"path": {cdsObject.Path},
-				}.Encode(),
-			}).String(),
-			ProtocolInfo: "http-get:*:text/srt:*",
-		})
 	}
-	if mimeType.IsVideo() || mimeType.IsImage() {
-		item.Res = append(item.Res, upnpav.Resource{
-			URL: (&url.URL{
-				Scheme: "http",
-				Host:   host,
-				Path:   iconPath,
-				RawQuery: url.Values{
-					"path": {cdsObject.Path},
-					"c":    {"jpeg"},
-				}.Encode(),
-			}).String(),
-			ProtocolInfo: "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN",
-		})
+	// Photo sizes are made like thumbnails, so they need the same support.
+	if mimeType.IsImage() && thumbnails {
+		if displayableImageTypes[mimeType] {
+			item.Res = append(item.Res, photoResources(c.host, cdsObject.Path)...)
+		} else {
+			// Ahead of the original, in case the client picks the first.
+			item.Res = append(photoResources(c.host, cdsObject.Path), item.Res...)
+		}
 	}
 	ret = item
 	return
 }
 
+// Returns the protocolInfo of the resource for a file as it is.
+func originalProtocolInfo(mimeType mimeType) string {
+	return fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{
+		SupportRange: true,
+	}.String())
+}
+
+// Returns the width and height of the first video stream, such as
+// "1920x1080", or "" if there isn't one.
+func videoResolution(ffInfo *ffprobe.Info) string {
+	if ffInfo == nil {
+		return ""
+	}
+	for _, strm := range ffInfo.Streams {
+		if strm["codec_type"] != "video" {
+			continue
+		}
+		width, err := ffprobe.AnyAsFloat64(strm["width"])
+		if err != nil {
+			continue
+		}
+		height, err := ffprobe.AnyAsFloat64(strm["height"])
+		if err != nil {
+			continue
+		}
+		return fmt.Sprintf("%.0fx%.0f", width, height)
+	}
+	return ""
+}
+
 // Returns all the upnpav objects in a directory.
 func (me *contentDirectoryService) readContainer(
 	o object,
-	host, userAgent string,
+	c client,
 ) (ret []interface{}, err error) {
 	sfis := sortableFileInfoSlice{
-		// TODO(anacrolix): Dig up why this special cast was added.
-		FoldersLast: strings.Contains(userAgent, `AwoX/1.1`),
+		FoldersLast: c.profile.FoldersLast,
 	}
-	sfis.fileInfoSlice, err = o.readDir(me.FS)
+	sfis.fileInfoSlice, err = me.readDir(o)
 	if err != nil {
 		return
 	}
 	sort.Sort(sfis)
 	for _, fi := range sfis.fileInfoSlice {
 		child := object{path.Join(o.Path, fi.Name()), me.RootObjectPath}
-		obj, err := me.cdsObjectToUpnpavObject(child, fi, host, userAgent)
+		obj, err := me.cdsObjectToUpnpavObject(child, fi, sfis.fileInfoSlice, c)
 		if err != nil {
 			me.Logger.Info("error with object", "path", child.FilePath(), "error", err)
 			continue
@@ -349,17 +475,138 @@ func (me *contentDirectoryService) readContainer(
 	return
 }
 
+// The client a ContentDirectory request is answered for.
+type client struct {
+	// The host the client addressed the server by, used in resource URLs.
+	host      string
+	userAgent string
+	profile   *DeviceProfile
+}
+
+// Returns a dc:date in the form the client takes.
+func (c client) timestamp(t time.Time) upnpav.Timestamp {
+	return upnpav.Timestamp{Time: t, DateOnly: !c.profile.DateTime}
+}
+
 type browse struct {
 	ObjectID       string
 	BrowseFlag     string
 	Filter         string
 	StartingIndex  int
 	RequestedCount int
+	SortCriteria   string
+}
+
+type search struct {
+	ContainerID    string
+	SearchCriteria string
+	Filter         string
+	StartingIndex  int
+	RequestedCount int
+	SortCriteria   string
+}
+
+// Returns the direct children of a container, deferring to
+// OnBrowseDirectChildren if it's set. The root container lists the views
+// first.
+func (me *contentDirectoryService) browseChildren(o object, c client) ([]interface{}, error) {
+	if me.OnBrowseDirectChildren != nil {
+		return me.OnBrowseDirectChildren(o.Path, o.RootObjectPath, c.host, c.userAgent)
+	}
+	objs, err := me.readContainer(o, c)
+	if err != nil {
+		return nil, err
+	}
+	if o.ID() == "0" {
+		objs = append(me.viewContainers(c), objs...)
+	}
+	return objs, nil
+}
+
+// Recursively collects the descendants of a container that satisfy the
+// search criteria. Containers are included if they match, and are always
+// descended into. Views are skipped, as they only hold items that are
+// already found in the directories.
+func (me *contentDirectoryService) searchContainer(
+	o object,
+	criteria upnpav.SearchCriteria,
+	c client,
+) (ret []interface{}, err error) {
+	children, err := me.browseChildren(o, c)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		container, isContainer := child.(upnpav.Container)
+		if isContainer && isVirtualID(container.ID) {
+			continue
+		}
+		if criteria.Match(child) {
+			ret = append(ret, child)
+		}
+		if !isContainer {
+			continue
+		}
+		childObj, err := me.objectFromID(container.ID)
+		if err != nil {
+			me.Logger.Info("bad container id", "id", container.ID, "error", err)
+			continue
+		}
+		descendants, err := me.searchContainer(childObj, criteria, c)
+		if err != nil {
+			me.Logger.Info("error searching container", "path", childObj.FilePath(), "error", err)
+			continue
+		}
+		ret = append(ret, descendants...)
+	}
+	return
+}
+
+// Returns the response arguments for a Browse or Search of the given objects,
+// applying StartingIndex and RequestedCount, and the Filter to those
+// returned.
+func (me *contentDirectoryService) objectsResult(objs []interface{}, filter upnpav.Filter, startingIndex, requestedCount int, updateID string) ([][2]string, error) {
+	page, totalMatches := objectsPage(objs, startingIndex, requestedCount)
+	return me.objectsPageResult(page, totalMatches, filter, updateID)
+}
+
+// Returns the objects requested by StartingIndex and RequestedCount, and how
+// many there are in all.
+func objectsPage(objs []interface{}, startingIndex, requestedCount int) (page []interface{}, totalMatches int) {
+	totalMatches = len(objs)
+	objs = objs[min(startingIndex, len(objs)):]
+	if requestedCount != 0 && requestedCount < len(objs) {
+		objs = objs[:requestedCount]
+	}
+	return objs, totalMatches
 }
 
-// ContentDirectory object from ObjectID.
+// Returns the result of a Browse or Search for a page of objects.
+func (me *contentDirectoryService) objectsPageResult(objs []interface{}, totalMatches int, filter upnpav.Filter, updateID string) ([][2]string, error) {
+	filtered := make([]interface{}, 0, len(objs))
+	for _, obj := range objs {
+		filtered = append(filtered, filter.Apply(obj))
+	}
+	result, err := xml.Marshal(filtered)
+	if err != nil {
+		return nil, err
+	}
+	return [][2]string{
+		{"Result", didl_lite(string(result))},
+		{"NumberReturned", fmt.Sprint(len(objs))},
+		{"TotalMatches", fmt.Sprint(totalMatches)},
+		{"UpdateID", updateID},
+	}, nil
+}
+
+// ContentDirectory object from ObjectID, which can be an opaque ID or a
+// query escaped path.
 func (me *contentDirectoryService) objectFromID(id string) (o object, err error) {
-	o.Path, err = url.QueryUnescape(id)
+	if isOpaqueID(id) {
+		o.Path, err = me.objectIDPath(id)
+	} else {
+		o.Path, err = url.QueryUnescape(id)
+	}
 	if err != nil {
 		return
 	}
@@ -372,8 +619,11 @@ func (me *contentDirectoryService) objectFromID(id string) (o object, err error)
 }
 
 func (me *contentDirectoryService) Handle(action string, argsXML []byte, r *http.Request) ([][2]string, error) {
-	host := r.Host
-	userAgent := r.UserAgent()
+	c := client{
+		host:      r.Host,
+		userAgent: r.UserAgent(),
+		profile:   me.deviceProfile(r),
+	}
 	switch action {
 	case "GetSystemUpdateID":
 		return [][2]string{
@@ -381,55 +631,40 @@ func (me *contentDirectoryService) Handle(action string, argsXML []byte, r *http
 		}, nil
 	case "GetSortCapabilities":
 		return [][2]string{
-			{"SortCaps", "dc:title"},
+			{"SortCaps", upnpav.SortCapabilities()},
 		}, nil
 	case "Browse":
 		var browse browse
 		if err := xml.Unmarshal([]byte(argsXML), &browse); err != nil {
 			return nil, err
 		}
+		sortCriteria, err := upnpav.ParseSortCriteria(browse.SortCriteria)
+		if err != nil {
+			return nil, upnp.Errorf(upnpav.InvalidSortCriteriaErrorCode, "%s", err.Error())
+		}
+		if isVirtualID(browse.ObjectID) {
+			return me.browseView(browse, sortCriteria, c)
+		}
 		obj, err := me.objectFromID(browse.ObjectID)
 		if err != nil {
 			return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%s", err.Error())
 		}
 		switch browse.BrowseFlag {
 		case "BrowseDirectChildren":
-			var objs []interface{}
-			if me.OnBrowseDirectChildren == nil {
-				objs, err = me.readContainer(obj, host, userAgent)
-			} else {
-				objs, err = me.OnBrowseDirectChildren(obj.Path, obj.RootObjectPath, host, userAgent)
-			}
+			objs, err := me.browseChildren(obj, c)
 			if err != nil {
 				return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%s", err.Error())
 			}
-			totalMatches := len(objs)
-			objs = objs[func() (low int) {
-				low = browse.StartingIndex
-				if low > len(objs) {
-					low = len(objs)
-				}
-				return
-			}():]
-			if browse.RequestedCount != 0 && int(browse.RequestedCount) < len(objs) {
-				objs = objs[:browse.RequestedCount]
-			}
-			result, err := xml.Marshal(objs)
-			if err != nil {
-				return nil, err
-			}
-			return [][2]string{
-				{"Result", didl_lite(string(result))},
-				{"NumberReturned", fmt.Sprint(len(objs))},
-				{"TotalMatches", fmt.Sprint(totalMatches)},
-				{"UpdateID", me.updateIDString()},
-			}, nil
+			sortCriteria.Sort(objs)
+			// Update IDs are kept by opaque ID, which a legacy ID isn't.
+			id, _ := me.pathObjectID(obj)
+			return me.objectsResult(objs, upnpav.ParseFilter(browse.Filter), browse.StartingIndex, browse.RequestedCount, me.containerUpdateIDString(id))
 		case "BrowseMetadata":
 			var ret interface{}
 			var err error
 			if me.OnBrowseMetadata == nil {
 				var fileInfo fs.FileInfo
-				fileInfo, err = fs.Stat(me.FS, obj.FilePath())
+				fileInfo, err = me.stat(obj.FilePath())
 				if err != nil {
 					if os.IsNotExist(err) {
 						return nil, &upnp.Error{
@@ -439,14 +674,14 @@ func (me *contentDirectoryService) Handle(action string, argsXML []byte, r *http
 					}
 					return nil, err
 				}
-				ret, err = me.cdsObjectToUpnpavObject(obj, fileInfo, host, userAgent)
+				ret, err = me.cdsObjectToUpnpavObject(obj, fileInfo, nil, c)
 			} else {
-				ret, err = me.OnBrowseMetadata(obj.Path, obj.RootObjectPath, host, userAgent)
+				ret, err = me.OnBrowseMetadata(obj.Path, obj.RootObjectPath, c.host, c.userAgent)
 			}
 			if err != nil {
 				return nil, err
 			}
-			buf, err := xml.Marshal(ret)
+			buf, err := xml.Marshal(upnpav.ParseFilter(browse.Filter).Apply(ret))
 			if err != nil {
 				return nil, err
 			}
@@ -465,8 +700,40 @@ func (me *contentDirectoryService) Handle(action string, argsXML []byte, r *http
 		}
 	case "GetSearchCapabilities":
 		return [][2]string{
-			{"SearchCaps", ""},
+			{"SearchCaps", upnpav.SearchCapabilities()},
 		}, nil
+	case "Search":
+		var search search
+		if err := xml.Unmarshal(argsXML, &search); err != nil {
+			return nil, err
+		}
+		criteria, err := upnpav.ParseSearchCriteria(search.SearchCriteria)
+		if err != nil {
+			return nil, upnp.Errorf(upnpav.InvalidSearchCriteriaErrorCode, "%s", err.Error())
+		}
+		sortCriteria, err := upnpav.ParseSortCriteria(search.SortCriteria)
+		if err != nil {
+			return nil, upnp.Errorf(upnpav.InvalidSortCriteriaErrorCode, "%s", err.Error())
+		}
+		if isVirtualID(search.ContainerID) {
+			n, err := me.viewNode(search.ContainerID)
+			if err != nil {
+				return nil, upnp.Errorf(upnpav.NoSuchContainerErrorCode, "%s", err.Error())
+			}
+			objs := me.searchView(n, criteria, c)
+			sortCriteria.Sort(objs)
+			return me.objectsResult(objs, upnpav.ParseFilter(search.Filter), search.StartingIndex, search.RequestedCount, me.updateIDString())
+		}
+		obj, err := me.objectFromID(search.ContainerID)
+		if err != nil {
+			return nil, upnp.Errorf(upnpav.NoSuchContainerErrorCode, "%s", err.Error())
+		}
+		objs, err := me.searchContainer(obj, criteria, c)
+		if err != nil {
+			return nil, upnp.Errorf(upnpav.NoSuchContainerErrorCode, "%s", err.Error())
+		}
+		sortCriteria.Sort(objs)
+		return me.objectsResult(objs, upnpav.ParseFilter(search.Filter), search.StartingIndex, search.RequestedCount, me.updateIDString())
 	// Samsung Extensions
 	case "X_GetFeatureList":
 		// TODO: make it dependable on model
@@ -520,7 +787,7 @@ func (me *contentDirectoryService) isOfInterest(
 		return
 	}
 
-	mimeType, err := MimeTypeByPath(me.FS, entryFilePath)
+	mimeType, err := me.mimeTypeByPath(entryFilePath)
 	if err != nil {
 		return
 	}
@@ -531,12 +798,9 @@ func (me *contentDirectoryService) isOfInterest(
 	return true, nil
 }
 
-// Returns the number of children this object has, such as for a container.
-func (cds *contentDirectoryService) objectChildCount(me object) (count int) {
-	fileInfoSlice, err := me.readDir(cds.FS)
-	if err != nil {
-		return
-	}
+// Returns the number of children this object has, such as for a container,
+// given the contents of its directory.
+func (cds *contentDirectoryService) objectChildCount(me object, fileInfoSlice []fs.FileInfo) (count int) {
 	for _, fi := range fileInfoSlice {
 		child := object{path.Join(me.Path, fi.Name()), cds.RootObjectPath}
 		isChild, err := cds.isOfInterest(child, fi)
@@ -549,6 +813,9 @@ func (cds *contentDirectoryService) objectChildCount(me object) (count int) {
 			count++
 		}
 	}
+	if me.ID() == "0" {
+		count += len(cds.viewRoots())
+	}
 	return
 }
 
@@ -562,7 +829,7 @@ func (me *contentDirectoryService) objectHasChildren(
 		panic("Expected directory")
 	}
 
-	files, err := cdsObject.readDir(me.FS)
+	files, err := me.readDir(cdsObject)
 	if err != nil {
 		return
 	}
@@ -585,7 +852,8 @@ func (o *object) FilePath() string {
 	return path.Join(o.RootObjectPath, path.Clean(o.Path))
 }
 
-// Returns the ObjectID for the object. This is used in various ContentDirectory actions.
+// Returns the legacy ObjectID for the object, its query escaped path. Clients
+// are given opaque IDs, from Server.objectID, but these are still accepted.
 func (o object) ID() string {
 	if len(o.Path) == 1 {
 		return "0"
@@ -597,8 +865,7 @@ func (o *object) IsRoot() bool {
 	return o.Path == "./"
 }
 
-// Returns the object's parent ObjectID. Fortunately it can be deduced from the
-// ObjectID (for now).
+// Returns the object's parent's legacy ObjectID.
 func (o object) ParentID() string {
 	if o.IsRoot() {
 		return "-1"
@@ -638,7 +905,7 @@ func (me sortableFileInfoSlice) Less(i, j int) bool {
 	if !me.fileInfoSlice[i].IsDir() && me.fileInfoSlice[j].IsDir() {
 		return me.FoldersLast
 	}
-	return strings.ToLower(me.fileInfoSlice[i].Name()) < strings.ToLower(me.fileInfoSlice[j].Name())
+	return upnpav.CompareNatural(me.fileInfoSlice[i].Name(), me.fileInfoSlice[j].Name()) < 0
 }
 
 func (me sortableFileInfoSlice) Swap(i, j int) {
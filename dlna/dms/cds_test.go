@@ -1,8 +1,17 @@
 package dms
 
 import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
 )
 
 func TestEscapeObjectID(t *testing.T) {
@@ -26,3 +35,114 @@ func TestRootParentObjectID(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestBrowseSortCriteria(t *testing.T) {
+	cds := &contentDirectoryService{Server: &Server{NoProbe: true, FS: fstest.MapFS{
+		"Episode 10.mp4": {},
+		"Episode 2.mp4":  {},
+		"Episode 1.mp4":  {},
+	}}}
+	r := httptest.NewRequest("POST", "/ctl", nil)
+	titles := func(sortCriteria string) string {
+		args := `<ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag><SortCriteria>` + sortCriteria + `</SortCriteria>`
+		ret, err := cds.Handle("Browse", []byte("<Browse>"+args+"</Browse>"), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var didl struct {
+			Items []struct {
+				Title string `xml:"title"`
+			} `xml:"item"`
+		}
+		if err := xml.Unmarshal([]byte(ret[0][1]), &didl); err != nil {
+			t.Fatal(err)
+		}
+		var ss []string
+		for _, item := range didl.Items {
+			ss = append(ss, item.Title)
+		}
+		return strings.Join(ss, ",")
+	}
+	// Without criteria, files are in natural order.
+	if got := titles(""); got != "Episode 1.mp4,Episode 2.mp4,Episode 10.mp4" {
+		t.Fatal(got)
+	}
+	if got := titles("+upnp:class,-dc:title"); got != "Episode 10.mp4,Episode 2.mp4,Episode 1.mp4" {
+		t.Fatal(got)
+	}
+	if _, err := cds.Handle("Browse", []byte("<Browse><ObjectID>0</ObjectID><SortCriteria>+dc:nonsense</SortCriteria></Browse>"), r); err == nil {
+		t.Fatal("expected error for unsupported sort property")
+	}
+}
+
+func TestDynamicStreamThumbnail(t *testing.T) {
+	cds := &contentDirectoryService{Server: &Server{NoProbe: true, AllowDynamicStreams: true, FS: fstest.MapFS{
+		"Live.dms.json": {Data: []byte(`{"Title": "Live", "Resources": [{"MimeType": "video/mp4", "Command": "true"}]}`)},
+	}}}
+	r := httptest.NewRequest("POST", "/ctl", nil)
+	ret, err := cds.Handle("Browse", []byte("<Browse><ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag></Browse>"), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var didl struct {
+		Items []struct {
+			Title string   `xml:"title"`
+			Icon  string   `xml:"icon"`
+			Res   []string `xml:"res"`
+		} `xml:"item"`
+	}
+	if err := xml.Unmarshal([]byte(ret[0][1]), &didl); err != nil {
+		t.Fatal(err)
+	}
+	// There's nothing to make a thumbnail of, so only the stream is offered.
+	if len(didl.Items) != 1 || didl.Items[0].Title != "Live" || didl.Items[0].Icon != "" || len(didl.Items[0].Res) != 1 {
+		t.Fatal(didl.Items)
+	}
+}
+
+func TestContainersChangedDoesNotWait(t *testing.T) {
+	bodies := make(chan string, 10)
+	release := make(chan struct{})
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		<-release
+	}))
+	defer sub.Close()
+	defer close(release)
+	cds := newContentDirectoryService(&Server{})
+	sid, _, err := cds.Subscribe(upnp.ParseCallbackURLs("<"+sub.URL+">"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cds.NotifyInitial(sid)
+	<-bodies
+	// The subscriber is stuck on the initial event, but changes aren't held
+	// up by it.
+	done := make(chan struct{})
+	go func() {
+		cds.containersChanged([]string{"a"})
+		cds.containersChanged([]string{"b"})
+		cds.containersChanged([]string{"a"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("containersChanged waited for the subscriber")
+	}
+	release <- struct{}{}
+	// Changes made while notifying are sent together, with their latest
+	// update IDs.
+	last := fmt.Sprint(cds.initialUpdateID + 3)
+	for {
+		body := <-bodies
+		release <- struct{}{}
+		if strings.Contains(body, "<SystemUpdateID>"+last+"<") {
+			if !strings.Contains(body, "a,"+last) {
+				t.Fatal(body)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package dms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Subtitle delivery modes for DeviceProfile.SubtitleMode.
+const (
+	// Subtitles are offered as separate resources of the item.
+	SubtitleModeExternal = "external"
+	// Subtitles aren't offered.
+	SubtitleModeNone = "none"
+	// An SRT subtitle is given in sec:CaptionInfoEx and the CaptionInfo.sec
+	// header, as Samsung TVs expect.
+	SubtitleModeSamsung = "samsung"
+)
+
+// DeviceProfile describes how to serve a particular kind of client.
+type DeviceProfile struct {
+	Name string
+	// How clients are recognized.
+	Match DeviceMatch
+	// What the client plays directly. Containers are ffprobe format names,
+	// such as "mp4" or "matroska", and codecs are ffprobe codec names, such
+	// as "h264" or "aac". Empty means anything.
+	Containers  []string `json:",omitempty"`
+	VideoCodecs []string `json:",omitempty"`
+	AudioCodecs []string `json:",omitempty"`
+	// The largest video the client plays directly. Zero means no limit.
+	MaxWidth  int `json:",omitempty"`
+	MaxHeight int `json:",omitempty"`
+	// The highest overall bitrate, in bits per second, the client plays
+	// directly. Zero means no limit.
+	MaxBitrate int64 `json:",omitempty"`
+	// Don't offer transcodes.
+	NoTranscode bool `json:",omitempty"`
+	// The names of the transcode profiles to offer, in order of preference.
+	// Empty means all of them.
+	TranscodeProfiles []string `json:",omitempty"`
+	// One of the SubtitleMode constants. Empty means SubtitleModeExternal.
+	SubtitleMode string `json:",omitempty"`
+	// List folders after items instead of before.
+	FoldersLast bool `json:",omitempty"`
+	// Never answer event subscriptions. See Server.StallEventSubscribe.
+	StallEventSubscribe bool `json:",omitempty"`
+	// Replace &#34; with " in SOAP responses. Some Samsung TVs don't display
+	// an empty content directory without it.
+	UnescapeQuotes bool `json:",omitempty"`
+	// Give dc:date as a date and time, for clients that accept one. Others
+	// get just the date.
+	DateTime bool `json:",omitempty"`
+}
+
+// DeviceMatch recognizes clients. Every criterion that's set must match,
+// and a DeviceMatch with none set matches nothing.
+type DeviceMatch struct {
+	// Regular expression matched against the User-Agent header.
+	UserAgent string `json:",omitempty"`
+	// Regular expression matched against the X-AV-Client-Info header.
+	ClientInfo string `json:",omitempty"`
+	// IP addresses and CIDR networks the client may be connecting from.
+	IPs []string `json:",omitempty"`
+
+	userAgent  *regexp.Regexp
+	clientInfo *regexp.Regexp
+	ipNets     []*net.IPNet
+}
+
+// The profile used for clients that don't match any other.
+var DefaultDeviceProfile = DeviceProfile{
+	Name: "default",
+	// Samsung TVs aren't all recognizable, and the hack is harmless for
+	// others.
+	UnescapeQuotes: true,
+}
+
+// BuiltinDeviceProfiles are tried after any configured profiles.
+var BuiltinDeviceProfiles = []DeviceProfile{
+	{
+		Name: "samsung",
+		Match: DeviceMatch{
+			UserAgent: `SEC_HHP_|(?i)samsung`,
+		},
+		Containers:     []string{"mp4", "matroska", "avi", "mpegts", "mpeg", "asf"},
+		VideoCodecs:    []string{"h264", "hevc", "mpeg2video", "mpeg4", "vc1"},
+		AudioCodecs:    []string{"aac", "ac3", "eac3", "mp3", "mp2", "dts"},
+		SubtitleMode:   SubtitleModeSamsung,
+		UnescapeQuotes: true,
+	},
+	{
+		Name: "lg",
+		Match: DeviceMatch{
+			UserAgent: `LGE_DLNA_SDK|(?i)webos|LG-?TV`,
+		},
+		Containers:  []string{"mp4", "matroska", "avi", "mpegts", "mpeg"},
+		VideoCodecs: []string{"h264", "hevc", "mpeg2video", "mpeg4", "vp9"},
+		AudioCodecs: []string{"aac", "ac3", "eac3", "mp3", "mp2"},
+	},
+	{
+		Name: "sony-bravia",
+		Match: DeviceMatch{
+			ClientInfo: `(?i)bravia`,
+		},
+		Containers:  []string{"mp4", "mpegts", "mpeg", "matroska"},
+		VideoCodecs: []string{"h264", "hevc", "mpeg2video"},
+		AudioCodecs: []string{"aac", "ac3", "mp3", "mp2"},
+	},
+	{
+		Name: "vlc",
+		Match: DeviceMatch{
+			UserAgent: `VLC|LibVLC`,
+		},
+		NoTranscode: true,
+		DateTime:    true,
+	},
+	{
+		Name: "kodi",
+		Match: DeviceMatch{
+			UserAgent: `Kodi|XBMC`,
+		},
+		NoTranscode: true,
+		DateTime:    true,
+	},
+	{
+		Name: "xbox",
+		Match: DeviceMatch{
+			UserAgent: `(?i)xbox`,
+		},
+		Containers:  []string{"mp4", "avi", "asf", "matroska", "mpegts"},
+		VideoCodecs: []string{"h264", "hevc", "mpeg4", "vc1", "wmv3"},
+		AudioCodecs: []string{"aac", "ac3", "mp3", "wmav2", "wmapro"},
+	},
+	{
+		Name: "awox",
+		Match: DeviceMatch{
+			UserAgent: `AwoX/1.1`,
+		},
+		// TODO(anacrolix): Dig up why this special case was added.
+		FoldersLast: true,
+	},
+}
+
+func (m *DeviceMatch) compile() (err error) {
+	if m.UserAgent != "" {
+		if m.userAgent, err = regexp.Compile(m.UserAgent); err != nil {
+			return
+		}
+	}
+	if m.ClientInfo != "" {
+		if m.clientInfo, err = regexp.Compile(m.ClientInfo); err != nil {
+			return
+		}
+	}
+	m.ipNets = nil
+	for _, s := range m.IPs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		var ipNet *net.IPNet
+		if _, ipNet, err = net.ParseCIDR(s); err != nil {
+			return
+		}
+		m.ipNets = append(m.ipNets, ipNet)
+	}
+	return
+}
+
+// Reports whether the request is from a client the match describes. ip is
+// the client's address.
+func (m *DeviceMatch) matches(r *http.Request, ip net.IP) bool {
+	if m.userAgent == nil && m.clientInfo == nil && m.ipNets == nil {
+		return false
+	}
+	if m.userAgent != nil && !m.userAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+	if m.clientInfo != nil && !m.clientInfo.MatchString(r.Header.Get("X-AV-Client-Info")) {
+		return false
+	}
+	if m.ipNets != nil {
+		found := false
+		for _, ipNet := range m.ipNets {
+			if ipNet.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *DeviceProfile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	switch p.SubtitleMode {
+	case "", SubtitleModeExternal, SubtitleModeNone, SubtitleModeSamsung:
+	default:
+		return fmt.Errorf("unknown subtitle mode %q", p.SubtitleMode)
+	}
+	return p.Match.compile()
+}
+
+func (p *DeviceProfile) subtitleMode() string {
+	if p.SubtitleMode == "" {
+		return SubtitleModeExternal
+	}
+	return p.SubtitleMode
+}
+
+// LoadDeviceProfiles reads a JSON array of device profiles.
+func LoadDeviceProfiles(r io.Reader) (ret []DeviceProfile, err error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err = d.Decode(&ret); err != nil {
+		return
+	}
+	for i := range ret {
+		if err = ret[i].Validate(); err != nil {
+			err = fmt.Errorf("device profile %d (%q): %w", i, ret[i].Name, err)
+			return
+		}
+	}
+	return
+}
+
+// LoadDeviceProfilesFile reads a JSON array of device profiles from a file.
+func LoadDeviceProfilesFile(name string) ([]DeviceProfile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadDeviceProfiles(f)
+}
+
+// Prepares the configured and builtin device profiles for matching.
+func (srv *Server) initDeviceProfiles() error {
+	srv.deviceProfiles = nil
+	for _, profiles := range [][]DeviceProfile{srv.DeviceProfiles, BuiltinDeviceProfiles} {
+		for _, p := range profiles {
+			if err := p.Validate(); err != nil {
+				return fmt.Errorf("device profile %q: %w", p.Name, err)
+			}
+			srv.deviceProfiles = append(srv.deviceProfiles, &p)
+		}
+	}
+	srv.clientDeviceProfiles = make(map[string]*DeviceProfile)
+	return nil
+}
+
+// Returns the device profile for the client making the request. Requests
+// that can't be matched themselves, such as event subscriptions that lack a
+// User-Agent, get the profile last matched for the client's address.
+func (srv *Server) deviceProfile(r *http.Request) *DeviceProfile {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if i := strings.Index(host, "%"); i != -1 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	for _, p := range srv.deviceProfiles {
+		if p.Match.matches(r, ip) {
+			srv.clientDeviceProfilesMu.Lock()
+			srv.clientDeviceProfiles[host] = p
+			srv.clientDeviceProfilesMu.Unlock()
+			return p
+		}
+	}
+	srv.clientDeviceProfilesMu.Lock()
+	p, ok := srv.clientDeviceProfiles[host]
+	srv.clientDeviceProfilesMu.Unlock()
+	if ok {
+		return p
+	}
+	return &DefaultDeviceProfile
+}
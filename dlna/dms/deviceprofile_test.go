@@ -0,0 +1,68 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeviceProfileMatching(t *testing.T) {
+	srv := &Server{
+		DeviceProfiles: []DeviceProfile{{
+			Name:  "bedroom",
+			Match: DeviceMatch{IPs: []string{"192.168.1.50", "10.0.0.0/8"}},
+		}},
+	}
+	if err := srv.initDeviceProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remoteAddr, userAgent, clientInfo, expected string
+	}{
+		{"192.168.1.2:1000", "DLNADOC/1.50 SEC_HHP_[TV] Samsung Q7 Series/1.0 UPnP/1.0", "", "samsung"},
+		{"192.168.1.3:1000", "Linux/3.10 UPnP/1.0 LGE_DLNA_SDK/1.6.0", "", "lg"},
+		{"192.168.1.4:1000", "UPnP/1.0", "PROTOCOLINFO=1; PLAYER=BRAVIA KDL-40", "sony-bravia"},
+		{"192.168.1.5:1000", "VLC/3.0.18 LibVLC/3.0.18", "", "vlc"},
+		{"192.168.1.6:1000", "Kodi/20.2 (Linux) App_Bitness/64", "", "kodi"},
+		{"192.168.1.7:1000", "NSPlayer/12.00 Xbox/10.0", "", "xbox"},
+		{"192.168.1.8:1000", "AwoX/1.1 UPnP/1.0 DLNADOC/1.50", "", "awox"},
+		{"192.168.1.9:1000", "curl/8.0", "", "default"},
+		// Configured profiles take precedence.
+		{"192.168.1.50:1000", "VLC/3.0.18 LibVLC/3.0.18", "", "bedroom"},
+		{"10.1.2.3:1000", "", "", "bedroom"},
+		// Unrecognizable requests get the profile last seen from the address.
+		{"192.168.1.2:1001", "", "", "samsung"},
+	} {
+		r := httptest.NewRequest("POST", "/ctl", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set("User-Agent", tc.userAgent)
+		if tc.clientInfo != "" {
+			r.Header.Set("X-AV-Client-Info", tc.clientInfo)
+		}
+		if actual := srv.deviceProfile(r).Name; actual != tc.expected {
+			t.Errorf("%s %q: got %q, expected %q", tc.remoteAddr, tc.userAgent, actual, tc.expected)
+		}
+	}
+}
+
+func TestLoadDeviceProfiles(t *testing.T) {
+	profiles, err := LoadDeviceProfiles(strings.NewReader(`[
+		{"Name": "tv", "Match": {"UserAgent": "MyTV"}, "VideoCodecs": ["h264"], "SubtitleMode": "none"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profiles[0].subtitleMode() != SubtitleModeNone || profiles[0].Match.userAgent == nil {
+		t.Fatalf("%#v", profiles[0])
+	}
+	for _, bad := range []string{
+		`[{"Match": {"UserAgent": "x"}}]`,
+		`[{"Name": "x", "Match": {"UserAgent": "("}}]`,
+		`[{"Name": "x", "Match": {"IPs": ["nope"]}}]`,
+		`[{"Name": "x", "SubtitleMode": "smoke signals"}]`,
+	} {
+		if _, err := LoadDeviceProfiles(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error loading %s", bad)
+		}
+	}
+}
@@ -2,24 +2,25 @@ package dms
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"log/slog"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,6 +29,7 @@ import (
 	"github.com/anacrolix/ffprobe"
 
 	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/library"
 	"github.com/anacrolix/dms/soap"
 	"github.com/anacrolix/dms/ssdp"
 	"github.com/anacrolix/dms/transcode"
@@ -66,15 +68,53 @@ type transcodeSpec struct {
 	Transcode       func(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error)
 }
 
-var transcodes = map[string]transcodeSpec{
-	"t": {
-		mimeType:        "video/mpeg",
-		DLNAProfileName: "MPEG_PS_PAL",
-		Transcode:       transcode.Transcode,
-	},
-	"vp8":        {mimeType: "video/webm", Transcode: transcode.VP8Transcode},
-	"chromecast": {mimeType: "video/mp4", Transcode: transcode.ChromecastTranscode},
-	"web":        {mimeType: "video/mp4", Transcode: transcode.WebTranscode},
+// Returns the transcode profiles in use.
+func (me *Server) transcodeProfiles() []transcode.Profile {
+	if me.TranscodeProfiles == nil {
+		return transcode.DefaultProfiles
+	}
+	return me.TranscodeProfiles
+}
+
+// Returns the named transcode or remux profile.
+func (me *Server) transcodeProfile(name string) (*transcode.Profile, bool) {
+	profiles := me.transcodeProfiles()
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i], true
+		}
+	}
+	for i := range transcode.RemuxProfiles {
+		if transcode.RemuxProfiles[i].Name == name {
+			return &transcode.RemuxProfiles[i], true
+		}
+	}
+	return nil, false
+}
+
+func (me *Server) profileTranscodeSpec(p *transcode.Profile) transcodeSpec {
+	return transcodeSpec{
+		mimeType:        p.MimeType,
+		DLNAProfileName: p.DLNAProfileName,
+		DLNAFlags:       p.DLNAFlags,
+		Transcode: func(path string, start, length time.Duration, stderr io.Writer) (io.ReadCloser, error) {
+			return me.transcoder.Transcode(p, path, start, length, stderr)
+		},
+	}
+}
+
+// Chooses the encoders for the transcode profiles, and logs the choices.
+func (me *Server) initTranscoder() {
+	me.transcoder = transcode.NewTranscoder(me.tools.ffmpeg.Path, me.Logger)
+	for _, profiles := range [][]transcode.Profile{me.transcodeProfiles(), {transcode.HLSProfile}} {
+		for _, p := range profiles {
+			if p.VideoCodec == "" {
+				continue
+			}
+			e, _ := me.transcoder.Encoder(p.VideoCodec)
+			me.Logger.Info("transcode profile encoder", "profile", p.Name, "encoder", e.Name, "hardware", e.HWAccel != "")
+		}
+	}
 }
 
 func makeDeviceUuid(unique string) string {
@@ -253,6 +293,9 @@ type Server struct {
 	// (ffmpeg), which run with dms's working directory rather than the media
 	// root.
 	rootPath string
+	// Named directories served instead of RootObjectPath and FS, each as a
+	// container in the root container.
+	Roots []Root
 	OnBrowseDirectChildren func(path string, rootObjectPath string, host, userAgent string) (ret []interface{}, err error)
 	OnBrowseMetadata       func(path string, rootObjectPath string, host, userAgent string) (ret interface{}, err error)
 	rootDescXML            []byte
@@ -261,12 +304,18 @@ type Server struct {
 	closed                 chan struct{}
 	ssdpStopped            chan struct{}
 	// The service SOAP handler keyed by service URN.
-	services   map[string]UPnPService
+	services         map[string]UPnPService
+	contentDirectory *contentDirectoryService
 	LogHeaders bool
 	// Disable transcoding, and the resource elements implied in the CDS.
 	NoTranscode bool
-	// Force transcoding to certain format of the 'transcodes' map
+	// Force transcoding with the named transcode profile. Clients whose
+	// device profiles say what they play are still sent files they can play
+	// as is, and remuxes where only the container is a problem.
 	ForceTranscodeTo string
+	// The transcode profiles offered to clients. transcode.DefaultProfiles
+	// is used if nil.
+	TranscodeProfiles []transcode.Profile
 	// Disable media probing with ffprobe
 	NoProbe bool
 	Icons   []Icon
@@ -293,12 +342,72 @@ type Server struct {
 	Logger              *slog.Logger
 	eventingLogger      *slog.Logger
 	FS                  fs.FS
+	// Walk the filesystem on every browse instead of answering from the
+	// media library index.
+	NoIndex bool
+	// Where the media library index is persisted between runs. If empty the
+	// index is rebuilt on each start.
+	IndexPath      string
+	library        *library.Library
+	libraryScanned chan struct{}
+	// Where the objects with opaque IDs were last seen.
+	objectIDs objectIDs
+	// Don't watch the filesystem for changes to event to subscribers.
+	NoWatch bool
+	// Don't list the Music, Videos and Photos views in the root container.
+	// The views require the media library index.
+	NoViews bool
+	// The views, as last built from the library.
+	views viewCache
+	// Device profiles tried before BuiltinDeviceProfiles when recognizing
+	// clients.
+	DeviceProfiles         []DeviceProfile
+	deviceProfiles         []*DeviceProfile
+	clientDeviceProfilesMu sync.Mutex
+	// Client IPs to the profile they were last recognized as.
+	clientDeviceProfiles map[string]*DeviceProfile
+	// The directory beneath which HLS segments are cached. The system's
+	// temporary directory is used if empty.
+	HLSCachePath string
+	// The most disk space cached HLS segments may use, in bytes.
+	// DefaultHLSCacheSize is used if zero.
+	HLSCacheSize int64
+	// The most HLS segments transcoded at once. The number of CPUs is used
+	// if zero.
+	HLSWorkers int
+	// The most transcodes run at once, not counting HLS segments. Zero means
+	// no limit.
+	MaxTranscodes int
+	// How long a request waits for a transcode to finish when
+	// MaxTranscodes are running, before it's rejected.
+	TranscodeQueueTimeout time.Duration
+	// Paths to the external programs run for transcodes, thumbnails and
+	// probing. Their names are looked up on PATH if empty.
+	FFmpegPath  string
+	FFprobePath string
+	tools       externalTools
+	// Languages of the audio streams transcodes of videos with several use,
+	// most preferred first. They're matched against the streams' language
+	// tags, such as "ger" or "eng", regardless of case.
+	PreferredAudioLanguages []string
+	// The directory thumbnails are cached in. One beneath the system's
+	// temporary directory is used if empty.
+	ThumbnailCachePath string
+	thumbnails         *thumbnailCache
+	// The most disk space cached thumbnails may use, in bytes.
+	// DefaultThumbnailCacheSize is used if zero.
+	ThumbnailCacheSize int64
+	transcodes      *transcodeManager
+	transcoder      *transcode.Transcoder
+	hls             *hlsServer
+	hlsCleaned      chan struct{}
 }
 
 // UPnP SOAP service.
 type UPnPService interface {
 	Handle(action string, argsXML []byte, r *http.Request) (respArgs [][2]string, err error)
 	Subscribe(callback []*url.URL, timeoutSeconds int) (sid string, actualTimeout int, err error)
+	Renew(sid string, timeoutSeconds int) (actualTimeout int, err error)
 	Unsubscribe(sid string) error
 }
 
@@ -321,29 +430,65 @@ type FfprobeCacheItem struct {
 	Value *ffprobe.Info
 }
 
-// update the UPnP object fields from ffprobe data
-// priority is given the format section, and then the streams sequentially
-func itemExtra(item *upnpav.Object, info *ffprobe.Info) {
-	setFromTags := func(m map[string]interface{}) {
-		for key, val := range m {
-			setIfUnset := func(s *string) {
-				if *s == "" {
-					*s = val.(string)
-				}
+// Returns the value of a metadata tag from ffprobe data, or "" if it's not
+// present. Priority is given to the format section, and then the streams
+// sequentially. Tag names are case-insensitive.
+func probeTag(info *ffprobe.Info, name string) string {
+	fromTags := func(m map[string]interface{}) string {
+		tags, _ := m["tags"].(map[string]interface{})
+		for key, val := range tags {
+			if s, ok := val.(string); ok && s != "" && strings.EqualFold(key, name) {
+				return s
 			}
-			switch strings.ToLower(key) {
-			case "tag:artist":
-				setIfUnset(&item.Artist)
-			case "tag:album":
-				setIfUnset(&item.Album)
-			case "tag:genre":
-				setIfUnset(&item.Genre)
+		}
+		// Flat output from older ffprobe versions puts tags in the section.
+		for key, val := range m {
+			if s, ok := val.(string); ok && s != "" && strings.EqualFold(key, "tag:"+name) {
+				return s
 			}
 		}
+		return ""
+	}
+	if s := fromTags(info.Format); s != "" {
+		return s
 	}
-	setFromTags(info.Format)
 	for _, m := range info.Streams {
-		setFromTags(m)
+		if s := fromTags(m); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// update the UPnP object fields from ffprobe data
+func itemExtra(item *upnpav.Object, info *ffprobe.Info) {
+	// Sets s from the first of the tags that's present.
+	setIfUnset := func(s *string, tags ...string) {
+		for _, tag := range tags {
+			if *s != "" {
+				return
+			}
+			*s = probeTag(info, tag)
+		}
+	}
+	setIfUnset(&item.Artist, "artist")
+	setIfUnset(&item.Album, "album")
+	setIfUnset(&item.Genre, "genre")
+	setIfUnset(&item.Creator, "artist", "composer")
+	setIfUnset(&item.Description, "description", "synopsis", "comment")
+	setIfUnset(&item.Director, "director")
+	if item.TrackNumber == 0 {
+		item.TrackNumber = parseNumberTag(probeTag(info, "track"))
+	}
+	if item.Actors == nil {
+		// Matroska's ACTOR tag, which can list several.
+		for _, actor := range strings.FieldsFunc(probeTag(info, "actor"), func(r rune) bool {
+			return r == ',' || r == ';'
+		}) {
+			if actor = strings.TrimSpace(actor); actor != "" {
+				item.Actors = append(item.Actors, actor)
+			}
+		}
 	}
 }
 
@@ -352,31 +497,128 @@ type ffmpegInfoCacheKey struct {
 	ModTime int64
 }
 
-func transcodeResources(host, path, resolution, duration string) (ret []upnpav.Resource) {
-	ret = make([]upnpav.Resource, 0, len(transcodes))
-	for k, v := range transcodes {
-		ret = append(ret, upnpav.Resource{
-			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", v.mimeType, dlna.ContentFeatures{
-				SupportTimeSeek: true,
-				Transcoded:      true,
-				ProfileName:     v.DLNAProfileName,
-			}.String()),
-			URL: (&url.URL{
-				Scheme: "http",
-				Host:   host,
-				Path:   resPath,
-				RawQuery: url.Values{
-					"path":      {path},
-					"transcode": {k},
-				}.Encode(),
-			}).String(),
-			Resolution: resolution,
-			Duration:   duration,
+// Returns a resource for each transcode profile that applies to the source
+// MIME type, limited to those the client's device profile wants. Videos with
+// subtitles also get a transcode with each rendered into it, in the first
+// profile that encodes video, and those with several audio streams get a
+// transcode of each in the first profile.
+func (me *Server) transcodeResources(c client, path string, mimeType mimeType, info *ffprobe.Info, subs []subtitle, resolution, duration string) (ret []upnpav.Resource) {
+	var firstProfile, burnProfile *transcode.Profile
+	for _, p := range me.applicableTranscodeProfiles(c.profile, mimeType) {
+		ret = append(ret, transcodeResource(c, url.Values{"path": {path}}, &p, resolution, duration))
+		if firstProfile == nil {
+			firstProfile = &p
+		}
+		if burnProfile == nil && p.CanBurnSubtitles() {
+			burnProfile = &p
+		}
+	}
+	if !mimeType.IsVideo() {
+		return
+	}
+	if tracks := audioTracks(info); firstProfile != nil && len(tracks) > 1 {
+		for _, t := range tracks {
+			q := url.Values{"path": {path}}
+			t.setQuery(q)
+			ret = append(ret, transcodeResource(c, q, firstProfile, resolution, duration))
+		}
+	}
+	if burnProfile == nil || c.profile.subtitleMode() == SubtitleModeNone {
+		return
+	}
+	for _, s := range subs {
+		q := url.Values{"path": {path}}
+		s.setBurnQuery(q)
+		ret = append(ret, transcodeResource(c, q, burnProfile, resolution, duration))
+	}
+	return
+}
+
+// Returns the transcode profiles that apply to the source MIME type, limited
+// to those the client's device profile wants. Audio transcodes in codecs the
+// client plays come first.
+func (me *Server) applicableTranscodeProfiles(dp *DeviceProfile, mimeType mimeType) (ret []transcode.Profile) {
+	profiles := me.transcodeProfiles()
+	if names := dp.TranscodeProfiles; len(names) != 0 {
+		profiles = nil
+		for _, name := range names {
+			if p, ok := me.transcodeProfile(name); ok {
+				profiles = append(profiles, *p)
+			}
+		}
+	}
+	for _, p := range profiles {
+		if p.AppliesTo(mimeType.String()) {
+			ret = append(ret, p)
+		}
+	}
+	if mimeType.IsAudio() {
+		plays := func(p transcode.Profile) bool {
+			return p.AudioCodec != "" && supported(dp.AudioCodecs, p.AudioCodec)
+		}
+		sort.SliceStable(ret, func(i, j int) bool {
+			return plays(ret[i]) && !plays(ret[j])
 		})
 	}
 	return
 }
 
+// Returns the name of the transcode profile to serve the file with when
+// ForceTranscodeTo is set, or "" to serve it as is. Clients whose
+// capabilities are known only get what they need, and audio the client
+// can't play gets a transcode it can if the forced profile is only for
+// video.
+func (me *Server) forcedTranscode(profile *DeviceProfile, filePath string) string {
+	mimeType, err := me.mimeTypeByPath(filePath)
+	if err != nil {
+		return me.ForceTranscodeTo
+	}
+	forced := me.ForceTranscodeTo
+	if p, ok := me.transcodeProfile(forced); ok && !p.AppliesTo(mimeType.String()) {
+		forced = ""
+	}
+	if !profile.knowsCapabilities() || me.NoProbe {
+		return forced
+	}
+	info, err := me.ffmpegProbe(filePath)
+	if err != nil || info == nil {
+		return forced
+	}
+	switch method, remuxProfile := profile.playMethod(mimeType, info); method {
+	case directPlay:
+		return ""
+	case remux:
+		return remuxProfile.Name
+	}
+	if profiles := me.applicableTranscodeProfiles(profile, mimeType); forced == "" && mimeType.IsAudio() && len(profiles) != 0 {
+		return profiles[0].Name
+	}
+	return forced
+}
+
+// Returns the resource for the transcode with the given profile of the file
+// the query identifies.
+func transcodeResource(c client, q url.Values, p *transcode.Profile, resolution, duration string) upnpav.Resource {
+	q.Set("transcode", p.Name)
+	return upnpav.Resource{
+		ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", p.MimeType, dlna.ContentFeatures{
+			SupportTimeSeek: true,
+			Transcoded:      true,
+			ProfileName:     p.DLNAProfileName,
+			Flags:           p.DLNAFlags,
+		}.String()),
+		URL: (&url.URL{
+			Scheme:   "http",
+			Host:     c.host,
+			Path:     resPath,
+			RawQuery: q.Encode(),
+		}).String(),
+		Resolution: resolution,
+		Duration:   duration,
+		ProfileID:  p.DLNAProfileName,
+	}
+}
+
 func parseDLNARangeHeader(val string) (ret dlna.NPTRange, err error) {
 	if !strings.HasPrefix(val, "npt=") {
 		err = errors.New("bad prefix")
@@ -390,25 +632,30 @@ func parseDLNARangeHeader(val string) (ret dlna.NPTRange, err error) {
 }
 
 // Determines the time-based range to transcode, and sets the appropriate
-// headers. Returns !ok if there was an error and the caller should stop
-// handling the request.
-func handleDLNARange(w http.ResponseWriter, hs http.Header, dynamicMode bool) (r dlna.NPTRange, partialResponse, ok bool) {
+// headers. duration is that of the media, or zero if it isn't known. Returns
+// !ok if there was an error and the caller should stop handling the request.
+func handleDLNARange(w http.ResponseWriter, hs http.Header, duration time.Duration, dynamicMode bool) (r dlna.NPTRange, partialResponse, ok bool) {
+	r.End = -1
 	if dynamicMode || len(hs[http.CanonicalHeaderKey(dlna.TimeSeekRangeDomain)]) == 0 {
 		ok = true
 		return
 	}
 	partialResponse = true
-	h := hs.Get(dlna.TimeSeekRangeDomain)
-	r, err := parseDLNARangeHeader(h)
+	r, err := parseDLNARangeHeader(hs.Get(dlna.TimeSeekRangeDomain))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Passing an exact NPT duration seems to cause trouble pass the "iono"
-	// (*) duration instead.
-	//
-	// TODO: Check that the request range can't already have /.
-	w.Header().Set(dlna.TimeSeekRangeDomain, h+"/*")
+	r, err = r.Resolve(duration)
+	if err == dlna.ErrNPTRangeNotSatisfiable {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(dlna.TimeSeekRangeDomain, r.ResponseHeader(duration))
 	ok = true
 	return
 }
@@ -432,26 +679,15 @@ func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, pat
 		ProfileName:     ts.DLNAProfileName,
 		Flags:           ts.DLNAFlags,
 	}).String())
-	// If a range of any kind is given, we have to respond with 206 if we're
-	// interpreting that range. Since only the DLNA range is handled in this
-	// function, it alone determines if we'll give a partial response.
-	range_, partialResponse, ok := handleDLNARange(w, r.Header, dynamicMode)
-	if !ok {
-		return
-	}
-
-	// Samsung Frame TVs send a HEAD request first. If we don't terminate processing here,
-	// the TV will keep reading the data and crash eventually :)
-	if r.Method == "HEAD" {
-		writeResponseCode(w, partialResponse)
-		return
-	}
-
-	var logTsName string
+	var (
+		logTsName string
+		duration  time.Duration
+	)
 	if !dynamicMode {
 		ffInfo, _ := me.ffmpegProbe(path_)
 		if ffInfo != nil {
-			if duration, err := ffInfo.Duration(); err == nil {
+			if d, err := ffInfo.Duration(); err == nil {
+				duration = d
 				s := fmt.Sprintf("%f", duration.Seconds())
 				w.Header().Set("content-duration", s)
 				w.Header().Set("x-content-duration", s)
@@ -462,31 +698,60 @@ func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, pat
 	} else {
 		logTsName = tsname
 	}
-	stderrPath := strings.Replace(me.TranscodeLogPattern, "[tsname]", logTsName, -1)
-	var logFile io.Writer
-	if stderrPath != "" {
-		os.MkdirAll(filepath.Dir(stderrPath), 0o750)
-		aLogFile, err := os.Create(stderrPath)
-		if err != nil {
-			slog.Info("couldn't create transcode log file", "error", err)
-		} else {
-			defer aLogFile.Close()
-			slog.Info("logging transcode", "path", stderrPath)
-		}
-		logFile = aLogFile
+	// If a range of any kind is given, we have to respond with 206 if we're
+	// interpreting that range. Since only the DLNA range is handled in this
+	// function, it alone determines if we'll give a partial response.
+	range_, partialResponse, ok := handleDLNARange(w, r.Header, duration, dynamicMode)
+	if !ok {
+		return
+	}
+
+	// Samsung Frame TVs send a HEAD request first. If we don't terminate processing here,
+	// the TV will keep reading the data and crash eventually :)
+	if r.Method == "HEAD" {
+		writeResponseCode(w, partialResponse)
+		return
 	}
+
 	// External ffmpeg runs with dms's working directory, not the media root, so
 	// it needs an absolute path. In dynamic mode path_ is a command, not a file.
 	transcodePath := path_
 	if !dynamicMode {
-		transcodePath = filepath.Join(me.rootPath, path_)
+		transcodePath = me.osPath(path_)
+	}
+	key := transcodeKey{transcodePath, tsname, range_.Start, range_.Length()}
+	p, err := me.transcodes.open(r.Context(), key, func() (io.ReadCloser, error) {
+		stderrPath := strings.Replace(me.TranscodeLogPattern, "[tsname]", logTsName, -1)
+		var logFile io.Writer
+		if stderrPath != "" {
+			os.MkdirAll(filepath.Dir(stderrPath), 0o750)
+			aLogFile, err := os.Create(stderrPath)
+			if err != nil {
+				slog.Info("couldn't create transcode log file", "error", err)
+			} else {
+				// The transcode has its own copy once it's started.
+				defer aLogFile.Close()
+				slog.Info("logging transcode", "path", stderrPath)
+				logFile = aLogFile
+			}
+		}
+		return ts.Transcode(transcodePath, range_.Start, range_.Length(), logFile)
+	})
+	if err == errTooManyTranscodes {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	p, err := ts.Transcode(transcodePath, range_.Start, range_.End-range_.Start, logFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 	defer p.Close()
+	// Stop waiting on the transcode as soon as the client goes away.
+	stop := context.AfterFunc(r.Context(), func() { p.Close() })
+	defer stop()
 	// I recently switched this to returning 200 if no range is specified for
 	// pure UPnP clients. It's possible that DLNA clients will *always* expect
 	// 206. It appears the HTTP standard requires that 206 only be used if a
@@ -495,6 +760,11 @@ func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, pat
 	io.Copy(w, p)
 }
 
+// TranscodeSessions returns the transcodes running for /res requests.
+func (srv *Server) TranscodeSessions() []TranscodeSession {
+	return srv.transcodes.list()
+}
+
 func init() {
 	startTime = time.Now()
 }
@@ -652,7 +922,9 @@ func (me *Server) serviceControlHandler(w http.ResponseWriter, r *http.Request)
 	}()
 	bodyStr := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8" standalone="yes"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>%s</s:Body></s:Envelope>`, soapRespXML)
 	// Compatibility with Samsung Frame TV's - they don't display an empty content directory without this hack:
-	bodyStr = strings.Replace(bodyStr, "&#34;", `"`, -1)
+	if me.deviceProfile(r).UnescapeQuotes {
+		bodyStr = strings.Replace(bodyStr, "&#34;", `"`, -1)
+	}
 	w.WriteHeader(code)
 	if _, err := w.Write([]byte(bodyStr)); err != nil {
 		slog.Info("error writing response", "error", err)
@@ -667,104 +939,19 @@ func (s *Server) filePath(_path string) string {
 	return safeFilePath(s.RootObjectPath, _path)
 }
 
-func (me *Server) serveIcon(w http.ResponseWriter, r *http.Request) {
-	filePath := me.filePath(r.URL.Query().Get("path"))
-	c := r.URL.Query().Get("c")
-	if c == "" {
-		c = "png"
-	}
-	args := []string{}
-	_, fqThumbnail := os.LookupEnv("DMS_THUMBNAIL_FULLQUALITY")
-	if fqThumbnail {
-		args = append(args, "-s", "0", "-q", "10")
-	}
-
-	_, randThumbnail := os.LookupEnv("DMS_THUMBNAIL_RANDOM")
-	if randThumbnail {
-		args = append(args, "-t", strconv.Itoa(rand.Intn(100)))
-	}
-
-	args = append(args, "-i", filePath, "-o", "/dev/stdout", "-c"+c)
-	cmd := exec.Command("ffmpegthumbnailer", args...)
-	// cmd.Stderr = os.Stderr
-	body, err := cmd.Output()
-	if err != nil {
-		// serve 1st Icon if no ffmpegthumbnailer
-		w.Header().Set("Content-Type", me.Icons[0].Mimetype)
-		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(me.Icons[0].Bytes))
-		// http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	http.ServeContent(w, r, "", time.Now(), bytes.NewReader(body))
-}
-
-func (me *Server) serveSubtitle(w http.ResponseWriter, r *http.Request) {
-	filePath := me.filePath(r.URL.Query().Get("path"))
-	subtitleFilePath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".srt"
-	http.ServeFile(w, r, subtitleFilePath)
-}
-
-func (server *Server) contentDirectoryInitialEvent(urls []*url.URL, sid string) {
-	body := xmlMarshalOrPanic(upnp.PropertySet{
-		Properties: []upnp.Property{
-			{
-				Variable: upnp.Variable{
-					XMLName: xml.Name{
-						Local: "SystemUpdateID",
-					},
-					Value: "0",
-				},
-			},
-			// upnp.Property{
-			// 	Variable: upnp.Variable{
-			// 		XMLName: xml.Name{
-			// 			Local: "ContainerUpdateIDs",
-			// 		},
-			// 	},
-			// },
-			// upnp.Property{
-			// 	Variable: upnp.Variable{
-			// 		XMLName: xml.Name{
-			// 			Local: "TransferIDs",
-			// 		},
-			// 	},
-			// },
-		},
-		Space: "urn:schemas-upnp-org:event-1-0",
-	})
-	body = append([]byte(`<?xml version="1.0"?>`+"\n"), body...)
-	server.eventingLogger.Info("initial event", "body", string(body))
-	for _, _url := range urls {
-		bodyReader := bytes.NewReader(body)
-		req, err := http.NewRequest("NOTIFY", _url.String(), bodyReader)
-		if err != nil {
-			slog.Info("could not create a request to notify", "url", _url.String(), "error", err)
-			continue
-		}
-		req.Header["CONTENT-TYPE"] = []string{`text/xml; charset="utf-8"`}
-		req.Header["NT"] = []string{"upnp:event"}
-		req.Header["NTS"] = []string{"upnp:propchange"}
-		req.Header["SID"] = []string{sid}
-		req.Header["SEQ"] = []string{"0"}
-		// req.Header["TRANSFER-ENCODING"] = []string{"chunked"}
-		// req.ContentLength = int64(bodyReader.Len())
-		server.eventingLogger.Info("notify request header", "header", req.Header)
-		server.eventingLogger.Info("starting notify")
-		resp, err := http.DefaultClient.Do(req)
-		server.eventingLogger.Info("finished notify")
-		if err != nil {
-			slog.Info("could not notify", "url", _url.String(), "error", err)
-			continue
-		}
-		server.eventingLogger.Info("notify response", "response", resp)
-		b, _ := ioutil.ReadAll(resp.Body)
-		server.eventingLogger.Info("notify response body", "body", string(b))
-		resp.Body.Close()
+func (server *Server) contentDirectoryInitialEvent(sid string) {
+	cds := server.contentDirectory
+	cds.updateIDsMu.Lock()
+	vars := contentDirectoryEventedVariables(cds.systemUpdateID, nil)
+	cds.updateIDsMu.Unlock()
+	server.eventingLogger.Info("initial event", "sid", sid, "vars", vars)
+	if err := cds.NotifyInitial(sid, vars...); err != nil {
+		server.eventingLogger.Info("could not send initial event", "sid", sid, "error", err)
 	}
 }
 
 func (server *Server) contentDirectoryEventSubHandler(w http.ResponseWriter, r *http.Request) {
-	if server.StallEventSubscribe {
+	if server.StallEventSubscribe || server.deviceProfile(r).StallEventSubscribe {
 		// I have an LG TV that doesn't like my eventing implementation.
 		// Returning unimplemented (501?) errors, results in repeat subscribe
 		// attempts which hits some kind of error count limit on the TV
@@ -784,31 +971,63 @@ func (server *Server) contentDirectoryEventSubHandler(w http.ResponseWriter, r *
 		server.eventingLogger.Info("stalled subscribe connection went away", "duration", time.Since(t))
 		return
 	}
-	// The following code is a work in progress. It partially implements
-	// the spec on eventing but hasn't been completed as I have nothing to
-	// test it with.
+	// See UPnP Device Architecture 1.0 section 4.1 for the status codes.
 	server.eventingLogger.Info("event subscription", "header", r.Header)
 	service := server.services["ContentDirectory"]
 	server.eventingLogger.Info("event subscription request", "remote_addr", r.RemoteAddr, "method", r.Method, "sid", r.Header.Get("SID"))
-	if r.Method == "SUBSCRIBE" && r.Header.Get("SID") == "" {
-		urls := upnp.ParseCallbackURLs(r.Header.Get("CALLBACK"))
+	sid := r.Header.Get("SID")
+	callback := r.Header.Get("CALLBACK")
+	nt := r.Header.Get("NT")
+	switch {
+	case r.Method == "SUBSCRIBE" && sid == "":
+		urls := upnp.ParseCallbackURLs(callback)
 		server.eventingLogger.Info("callback urls", "urls", urls)
-		var timeout int
-		fmt.Sscanf(r.Header.Get("TIMEOUT"), "Second-%d", &timeout)
+		if len(urls) == 0 || (nt != "" && nt != "upnp:event") {
+			http.Error(w, "missing or invalid CALLBACK or NT", http.StatusPreconditionFailed)
+			return
+		}
+		timeout := upnp.ParseTimeoutHeader(r.Header.Get("TIMEOUT"))
 		server.eventingLogger.Info("event subscription timeout", "timeout", timeout, "header", r.Header.Get("TIMEOUT"))
-		sid, timeout, _ := service.Subscribe(urls, timeout)
+		sid, timeout, err := service.Subscribe(urls, timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Header()["SID"] = []string{sid}
 		w.Header()["TIMEOUT"] = []string{fmt.Sprintf("Second-%d", timeout)}
 		// TODO: Shouldn't have to do this to get headers logged.
 		w.WriteHeader(http.StatusOK)
 		go func() {
 			time.Sleep(100 * time.Millisecond)
-			server.contentDirectoryInitialEvent(urls, sid)
+			server.contentDirectoryInitialEvent(sid)
 		}()
-	} else if r.Method == "SUBSCRIBE" {
-		http.Error(w, "meh", http.StatusPreconditionFailed)
-	} else {
+	case r.Method == "SUBSCRIBE":
+		// Renewal. It's incompatible with the headers of a new subscription.
+		if callback != "" || nt != "" {
+			http.Error(w, "renewal with CALLBACK or NT", http.StatusBadRequest)
+			return
+		}
+		timeout, err := service.Renew(sid, upnp.ParseTimeoutHeader(r.Header.Get("TIMEOUT")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		w.Header()["SID"] = []string{sid}
+		w.Header()["TIMEOUT"] = []string{fmt.Sprintf("Second-%d", timeout)}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "UNSUBSCRIBE":
+		if callback != "" || nt != "" {
+			http.Error(w, "unsubscribe with CALLBACK or NT", http.StatusBadRequest)
+			return
+		}
+		if err := service.Unsubscribe(sid); err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
 		server.eventingLogger.Info("unhandled event method", "method", r.Method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -859,6 +1078,7 @@ func (server *Server) initMux(mux *http.ServeMux) {
 	mux.HandleFunc(contentDirectoryEventSubURL, server.contentDirectoryEventSubHandler)
 	mux.HandleFunc(iconPath, server.serveIcon)
 	mux.HandleFunc(subtitlePath, server.serveSubtitle)
+	mux.HandleFunc(hlsPath, server.serveHLS)
 	mux.HandleFunc(resPath, func(w http.ResponseWriter, r *http.Request) {
 		filePath := server.filePath(r.URL.Query().Get("path"))
 		if ignored, err := server.IgnorePath(filePath); err != nil {
@@ -881,12 +1101,15 @@ func (server *Server) initMux(mux *http.ServeMux) {
 			}
 		}
 		var k string
-		if server.ForceTranscodeTo != "" {
-			k = server.ForceTranscodeTo
+		if server.ForceTranscodeTo != "" && server.transcodingEnabled() {
+			k = server.forcedTranscode(server.deviceProfile(r), filePath)
 		} else {
 			k = r.URL.Query().Get("transcode")
 		}
-		mimeType, err := MimeTypeByPath(server.FS, filePath)
+		mimeType, err := server.mimeTypeByPath(filePath)
+		if mimeType.IsVideo() && r.Header.Get("getCaptionInfo.sec") != "" {
+			server.setCaptionInfo(w, r, filePath)
+		}
 		if k == "" || mimeType.IsImage() {
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -903,16 +1126,38 @@ func (server *Server) initMux(mux *http.ServeMux) {
 			http.ServeFileFS(w, r, server.FS, filePath)
 			return
 		}
-		if server.NoTranscode {
+		if !server.transcodingEnabled() {
 			http.Error(w, "transcodes disabled", http.StatusNotFound)
 			return
 		}
-		spec, ok := transcodes[k]
+		profile, ok := server.transcodeProfile(k)
 		if !ok {
 			http.Error(w, fmt.Sprintf("bad transcode spec key: %s", k), http.StatusBadRequest)
 			return
 		}
-		server.serveDLNATranscode(w, r, filePath, spec, k, false)
+		s, burn, err := server.burnSubtitle(filePath, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if burn {
+			if !profile.CanBurnSubtitles() {
+				http.Error(w, fmt.Sprintf("transcode %s can't render subtitles", k), http.StatusBadRequest)
+				return
+			}
+			burned := server.burnSubtitles(profile, filePath, s)
+			profile, k = &burned, k+"+"+s.burnName()
+		}
+		track, selectAudio, err := server.transcodeAudio(filePath, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if selectAudio {
+			selected := profile.SelectAudio(track.stream)
+			profile, k = &selected, fmt.Sprintf("%s+audio-%d", k, track.stream)
+		}
+		server.serveDLNATranscode(w, r, filePath, server.profileTranscodeSpec(profile), k, false)
 	})
 	mux.HandleFunc(rootDescPath, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", `text/xml; charset="utf-8"`)
@@ -923,6 +1168,10 @@ func (server *Server) initMux(mux *http.ServeMux) {
 	handleSCPDs(mux)
 	mux.HandleFunc(serviceControlURL, server.serviceControlHandler)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/transcodes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.TranscodeSessions())
+	})
 	// DeviceIcons
 	iconHandl := func(w http.ResponseWriter, r *http.Request) {
 		idStr := path.Base(r.URL.Path)
@@ -952,10 +1201,9 @@ func (s *Server) initServices() (err error) {
 	if err != nil {
 		return
 	}
+	s.contentDirectory = newContentDirectoryService(s)
 	s.services = map[string]UPnPService{
-		urn.Type: &contentDirectoryService{
-			Server: s,
-		},
+		urn.Type: s.contentDirectory,
 		urn1.Type: &connectionManagerService{
 			Server: s,
 		},
@@ -967,12 +1215,40 @@ func (s *Server) initServices() (err error) {
 }
 
 func (srv *Server) Init() (err error) {
-	if srv.FS == nil {
+	if len(srv.Roots) != 0 {
+		if srv.Roots, err = initRoots(srv.Roots); err != nil {
+			return
+		}
+		srv.FS = rootsFS(srv.Roots)
+	} else if srv.FS == nil {
 		fsys := os.DirFS(srv.RootObjectPath)
 		srv.FS = fsys
 	}
 	srv.rootPath = srv.RootObjectPath
 	srv.RootObjectPath = "./"
+	if err = srv.initDeviceProfiles(); err != nil {
+		return
+	}
+	if srv.ForceTranscodeTo != "" {
+		if _, ok := srv.transcodeProfile(srv.ForceTranscodeTo); !ok {
+			return fmt.Errorf("no transcode profile named %q", srv.ForceTranscodeTo)
+		}
+	}
+	srv.initTools()
+	if srv.transcodingEnabled() {
+		srv.initTranscoder()
+		workers := srv.HLSWorkers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		if srv.hls, err = newHLSServer(srv.transcoder, srv.HLSCachePath, srv.HLSCacheSize, workers); err != nil {
+			return fmt.Errorf("creating hls cache: %w", err)
+		}
+	}
+	if srv.thumbnails, err = newThumbnailCache(srv.ThumbnailCachePath, srv.ThumbnailCacheSize, runtime.NumCPU()); err != nil {
+		return fmt.Errorf("creating thumbnail cache: %w", err)
+	}
+	srv.transcodes = newTranscodeManager(srv.MaxTranscodes, srv.TranscodeQueueTimeout)
 	srv.eventingLogger = srv.Logger.With(slog.String("subsystem", "eventing"))
 	srv.eventingLogger.Debug("eventing logger initialized")
 	if err = srv.initServices(); err != nil {
@@ -1053,6 +1329,7 @@ func (srv *Server) Init() (err error) {
 	srv.Logger.Info("HTTP server", "address", srv.HTTPConn.Addr())
 	srv.initMux(srv.httpServeMux)
 	srv.ssdpStopped = make(chan struct{})
+	srv.initLibrary()
 	return nil
 }
 
@@ -1071,6 +1348,23 @@ func (srv *Server) Run() (err error) {
 		srv.doSSDP()
 		close(srv.ssdpStopped)
 	}()
+	if !srv.NoWatch && (srv.rootPath != "" || len(srv.Roots) != 0) {
+		go srv.watch()
+	}
+	if srv.library != nil {
+		srv.libraryScanned = make(chan struct{})
+		go func() {
+			srv.scanLibrary()
+			close(srv.libraryScanned)
+		}()
+	}
+	if srv.hls != nil {
+		srv.hlsCleaned = make(chan struct{})
+		go func() {
+			srv.cleanHLS()
+			close(srv.hlsCleaned)
+		}()
+	}
 	return srv.serveHTTP()
 }
 
@@ -1078,6 +1372,12 @@ func (srv *Server) Close() (err error) {
 	close(srv.closed)
 	err = srv.HTTPConn.Close()
 	<-srv.ssdpStopped
+	if srv.libraryScanned != nil {
+		<-srv.libraryScanned
+	}
+	if srv.hlsCleaned != nil {
+		<-srv.hlsCleaned
+	}
 	return
 }
 
@@ -1086,7 +1386,8 @@ func didl_lite(chardata string) string {
 		` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
 		` xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"` +
 		` xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"` +
-		` xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">` +
+		` xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/"` +
+		` xmlns:sec="http://www.sec.co.kr/">` +
 		chardata +
 		`</DIDL-Lite>`
 }
@@ -1105,6 +1406,19 @@ func (me *Server) location(ip net.IP) string {
 
 // Can return nil info with nil err if an earlier Probe gave an error.
 func (srv *Server) ffmpegProbe(path string) (info *ffprobe.Info, err error) {
+	return srv.fileProbe(path, nil)
+}
+
+// Like ffmpegProbe, for a file whose info the caller has. fi may be nil.
+func (srv *Server) fileProbe(path string, fi fs.FileInfo) (info *ffprobe.Info, err error) {
+	if e, ok := srv.currentEntry(path, fi); ok && e.Probe != nil {
+		return e.Probe, nil
+	}
+	return srv.probeFile(path)
+}
+
+// Probes a file, going through the FFProbeCache.
+func (srv *Server) probeFile(path string) (info *ffprobe.Info, err error) {
 	fi, err := fs.Stat(srv.FS, path)
 	if err != nil {
 		return
@@ -1112,10 +1426,18 @@ func (srv *Server) ffmpegProbe(path string) (info *ffprobe.Info, err error) {
 	key := ffmpegInfoCacheKey{path, fi.ModTime().UnixNano()}
 	value, ok := srv.FFProbeCache.Get(key)
 	if !ok {
-		uri := fmt.Sprintf("http://localhost:%d%s?path=%s", srv.httpPort(), resPath, path)
-		info, err = ffprobe.Run(uri)
+		if !srv.tools.ffprobe.Available() {
+			err = ffprobe.ExeNotFound
+			return
+		}
+		uri := fmt.Sprintf("http://localhost:%d%s?path=%s", srv.httpPort(), resPath, url.QueryEscape(path))
+		info, err = runFFprobe(srv.tools.ffprobe.Path, uri)
 		err = suppressFFmpegProbeDataErrors(err)
-		srv.FFProbeCache.Set(key, info)
+		// Failures may be passing, so they're tried again next time. Files
+		// ffprobe finds invalid are cached as having no info.
+		if err == nil {
+			srv.FFProbeCache.Set(key, info)
+		}
 		return
 	}
 	info = value.(*ffprobe.Info)
@@ -1124,31 +1446,52 @@ func (srv *Server) ffmpegProbe(path string) (info *ffprobe.Info, err error) {
 
 // IgnorePath detects if a file/directory should be ignored.
 func (server *Server) IgnorePath(path string) (bool, error) {
-	if server.IgnoreHidden {
-		if hidden, err := isHiddenPath(server.FS, path); err != nil {
+	if ignored, err := ignorePath(server.FS, path, server.IgnoreHidden, server.IgnoreUnreadable); err != nil || ignored {
+		return ignored, err
+	}
+	if inIgnoreList(path, server.IgnorePaths) {
+		return true, nil
+	}
+	// Roots have their own rules, on top of the server's. The ignore list is
+	// matched against the path with the root's name, so it can name the
+	// root's top-level directories.
+	if root, rel, ok := server.root(path); ok && rel != "." {
+		if ignored, err := ignorePath(root.FS, rel, root.IgnoreHidden, root.IgnoreUnreadable); err != nil || ignored {
+			return ignored, err
+		}
+		return inIgnoreList(path, root.IgnorePaths), nil
+	}
+	return false, nil
+}
+
+func ignorePath(fsys fs.FS, path string, ignoreHidden, ignoreUnreadable bool) (bool, error) {
+	if ignoreHidden {
+		if hidden, err := isHiddenPath(fsys, path); err != nil {
 			return false, err
 		} else if hidden {
 			slog.Info("ignored: hidden", "path", path)
 			return true, nil
 		}
 	}
-	if server.IgnoreUnreadable {
-		if readable, err := isReadablePath(server.FS, path); err != nil {
+	if ignoreUnreadable {
+		if readable, err := isReadablePath(fsys, path); err != nil {
 			return false, err
 		} else if !readable {
 			slog.Info("ignored: unreadable", "path", path)
 			return true, nil
 		}
 	}
+	return false, nil
+}
 
-	for _, element := range server.IgnorePaths {
+func inIgnoreList(path string, ignorePaths []string) bool {
+	for _, element := range ignorePaths {
 		if strings.Contains(path, fmt.Sprintf("/%s/", element)) {
 			slog.Info("ignored: in ignore list", "path", path)
-			return true, nil
+			return true
 		}
 	}
-
-	return false, nil
+	return false
 }
 
 func isReadablePath(fsys fs.FS, path string) (bool, error) {
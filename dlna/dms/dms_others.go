@@ -8,3 +8,7 @@ import "io/fs"
 func isHiddenPath(fsys fs.FS, path string) (bool, error) {
 	return false, nil
 }
+
+func fileIdentity(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	return
+}
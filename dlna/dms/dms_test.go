@@ -3,8 +3,16 @@ package dms
 import (
 	"bytes"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnpav"
 )
 
 type safeFilePathTestCase struct {
@@ -64,3 +72,56 @@ func TestResponse(t *testing.T) {
 	resp.Write(&buf)
 	t.Logf("%q", buf.String())
 }
+
+func TestHandleDLNARange(t *testing.T) {
+	for _, tc := range []struct {
+		request, response string
+		code              int
+		start, length     time.Duration
+	}{
+		{"", "", 0, 0, 0},
+		{"npt=30-", "npt=00:00:30.000-00:02:00.000/00:02:00.000", 0, 30 * time.Second, 90 * time.Second},
+		{"npt=00:00:10-00:00:20", "npt=00:00:10.000-00:00:20.000/00:02:00.000", 0, 10 * time.Second, 10 * time.Second},
+		{"npt=-15", "npt=00:01:45.000-00:02:00.000/00:02:00.000", 0, 105 * time.Second, 15 * time.Second},
+		{"npt=120-", "", http.StatusRequestedRangeNotSatisfiable, 0, 0},
+		{"bytes=0-", "", http.StatusBadRequest, 0, 0},
+	} {
+		w := httptest.NewRecorder()
+		hs := http.Header{}
+		if tc.request != "" {
+			hs.Set(dlna.TimeSeekRangeDomain, tc.request)
+		}
+		r, partial, ok := handleDLNARange(w, hs, 2*time.Minute, false)
+		if tc.code != 0 {
+			if ok || w.Code != tc.code {
+				t.Errorf("%q: got %v, %d", tc.request, ok, w.Code)
+			}
+			continue
+		}
+		if !ok || partial != (tc.request != "") {
+			t.Errorf("%q: got %v, %v", tc.request, ok, partial)
+		}
+		if got := w.Header().Get(dlna.TimeSeekRangeDomain); got != tc.response {
+			t.Errorf("%q: got response %q", tc.request, got)
+		}
+		if r.Start != tc.start || r.Length() != tc.length {
+			t.Errorf("%q: got range %v", tc.request, r)
+		}
+	}
+}
+
+func TestItemExtra(t *testing.T) {
+	info := &ffprobe.Info{Format: map[string]interface{}{"tags": map[string]interface{}{
+		"ARTIST":   "Queen",
+		"composer": "Mercury",
+		"comment":  "Live",
+		"track":    "3/12",
+		"ACTOR":    "Freddie Mercury; Brian May,",
+	}}}
+	var obj upnpav.Object
+	itemExtra(&obj, info)
+	if obj.Creator != "Queen" || obj.Description != "Live" || obj.TrackNumber != 3 ||
+		strings.Join(obj.Actors, "|") != "Freddie Mercury|Brian May" {
+		t.Fatalf("%+v", obj)
+	}
+}
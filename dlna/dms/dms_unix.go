@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 func isHiddenPath(fsys fs.FS, path string) (bool, error) {
@@ -20,3 +21,13 @@ func isHiddenPath(fsys fs.FS, path string) (bool, error) {
 
 	return isHiddenPath(fsys, filepath.Dir(path))
 }
+
+// Returns the device and inode numbers of a file. Files with more than one
+// link aren't identified by them, since each link is a separate object.
+func fileIdentity(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.IsDir() && st.Nlink > 1 {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), st.Ino, true
+}
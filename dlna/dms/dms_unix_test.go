@@ -3,7 +3,11 @@
 
 package dms
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestIsHiddenPath(t *testing.T) {
 	data := map[string]bool{
@@ -21,3 +25,47 @@ func TestIsHiddenPath(t *testing.T) {
 		}
 	}
 }
+
+func TestObjectIDSurvivesRename(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "Old Name"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{FS: os.DirFS(dir)}
+	id, err := srv.pathObjectID(object{"Old Name", "./"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "Old Name"), filepath.Join(dir, "New Name")); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := srv.objectIDPath(id); err != nil || p != "New Name" {
+		t.Fatal(p, err)
+	}
+}
+
+func TestHardLinkObjectIDs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a.mp3"), filepath.Join(dir, "b.mp3")); err != nil {
+		t.Skip(err)
+	}
+	srv := &Server{FS: os.DirFS(dir)}
+	a, err := srv.pathObjectID(object{"a.mp3", "./"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := srv.pathObjectID(object{"b.mp3", "./"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each link is its own object.
+	if a == b {
+		t.Fatal(a)
+	}
+	if p, err := srv.objectIDPath(b); err != nil || p != "b.mp3" {
+		t.Fatal(p, err)
+	}
+}
@@ -37,3 +37,8 @@ func isHiddenPath(fsys fs.FS, path string) (hidden bool, err error) {
 
 	return isHiddenPath(fsys, filepath.ToSlash(filepath.Dir(path)))
 }
+
+// The file index isn't available from a FileInfo on Windows.
+func fileIdentity(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	return
+}
@@ -1,18 +1,52 @@
 package dms
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os/exec"
 	"runtime"
+	"strings"
 	"syscall"
+
+	"github.com/anacrolix/ffprobe"
 )
 
+// Runs the ffprobe at exe on the input, as ffprobe.Run does with the one on
+// PATH. The info is nil if ffprobe fails or its output can't be decoded.
+func runFFprobe(exe, input string) (info *ffprobe.Info, err error) {
+	cmd := exec.Command(exe,
+		"-loglevel", "error",
+		"-show_format",
+		"-show_streams",
+		"-print_format", "json",
+		input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if lines := strings.Split(strings.TrimSpace(stderr.String()), "\n"); lines[len(lines)-1] != "" {
+			err = fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(out))
+	d.UseNumber()
+	info = new(ffprobe.Info)
+	if err = d.Decode(info); err != nil {
+		return nil, err
+	}
+	return
+}
+
 func suppressFFmpegProbeDataErrors(_err error) (err error) {
 	if _err == nil {
 		return
 	}
 	err = _err
-	exitErr, ok := err.(*exec.ExitError)
-	if !ok {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
 		return
 	}
 	waitStat, ok := exitErr.Sys().(syscall.WaitStatus)
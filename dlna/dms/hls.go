@@ -0,0 +1,402 @@
+package dms
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/transcode"
+)
+
+// HLS streams are served as /hls/<path>/index.m3u8, with the segments
+// alongside it as <n>.ts. Segments are transcoded on demand, so clients can
+// seek anywhere without restarting a transcode, and several clients can
+// share them.
+const (
+	hlsPath            = "/hls/"
+	hlsPlaylistName    = "index.m3u8"
+	hlsSegmentDuration = 6 * time.Second
+	// Sessions that haven't had a segment requested for this long have
+	// their segments removed.
+	hlsIdleTimeout = 5 * time.Minute
+	// DefaultHLSCacheSize is the disk space HLS segments may use if
+	// Server.HLSCacheSize isn't set.
+	DefaultHLSCacheSize = 2 << 30
+)
+
+// The segments of one version of a source file.
+type hlsSession struct {
+	dir      string
+	lastUsed time.Time
+	segments map[int]*hlsSegment
+}
+
+type hlsSegment struct {
+	// Closed once the transcode completes.
+	ready    chan struct{}
+	err      error
+	file     string
+	size     int64
+	lastUsed time.Time
+}
+
+type hlsServer struct {
+	dir     string
+	maxSize int64
+	// Limits the segments transcoded at once.
+	workers chan struct{}
+	// Transcodes a segment of the input.
+	transcode func(input string, start, length time.Duration) (io.ReadCloser, error)
+
+	mu sync.Mutex
+	// By hlsSessionKey.
+	sessions map[string]*hlsSession
+	// The total size of the cached segments.
+	size int64
+}
+
+// Creates a directory for the server's HLS segments beneath cacheDir.
+func newHLSServer(transcoder *transcode.Transcoder, cacheDir string, maxSize int64, workers int) (*hlsServer, error) {
+	if cacheDir == "" {
+		cacheDir = os.TempDir()
+	}
+	if err := os.MkdirAll(cacheDir, 0o750); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(cacheDir, "dms-hls-")
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultHLSCacheSize
+	}
+	return &hlsServer{
+		dir:      dir,
+		maxSize:  maxSize,
+		workers:  make(chan struct{}, workers),
+		sessions: make(map[string]*hlsSession),
+		transcode: func(input string, start, length time.Duration) (io.ReadCloser, error) {
+			return transcoder.Transcode(&transcode.HLSProfile, input, start, length, nil)
+		},
+	}, nil
+}
+
+// Returns the number of segments in media of the given duration, and the
+// duration of the last of them.
+func hlsSegments(duration time.Duration) (count int, last time.Duration) {
+	count = int(math.Ceil(float64(duration) / float64(hlsSegmentDuration)))
+	last = duration - time.Duration(count-1)*hlsSegmentDuration
+	return
+}
+
+// Writes a VOD playlist of the segments of media with the given duration.
+func writeHLSPlaylist(w io.Writer, duration time.Duration) error {
+	count, last := hlsSegments(duration)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(hlsSegmentDuration/time.Second))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	for i := 0; i < count; i++ {
+		d := hlsSegmentDuration
+		if i == count-1 {
+			d = last
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", d.Seconds(), i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Splits an HLS request path into the object path and the name of the
+// playlist or segment requested.
+func parseHLSPath(urlPath string) (objectPath, name string, ok bool) {
+	rest, ok := strings.CutPrefix(urlPath, hlsPath)
+	if !ok {
+		return
+	}
+	objectPath, name = path.Split(rest)
+	objectPath = strings.TrimSuffix(objectPath, "/")
+	ok = objectPath != "" && name != ""
+	return
+}
+
+// Parses a segment name, such as "12.ts".
+func parseHLSSegmentName(name string) (int, bool) {
+	s, ok := strings.CutSuffix(name, ".ts")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n >= 0
+}
+
+func (me *Server) serveHLS(w http.ResponseWriter, r *http.Request) {
+	if !me.transcodingEnabled() || me.hls == nil {
+		http.Error(w, "transcodes disabled", http.StatusNotFound)
+		return
+	}
+	objectPath, name, ok := parseHLSPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	filePath := me.filePath(objectPath)
+	if ignored, err := me.IgnorePath(filePath); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ignored {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	if mimeType, err := me.mimeTypeByPath(filePath); err != nil || !mimeType.IsVideo() {
+		http.Error(w, "not a video", http.StatusNotFound)
+		return
+	}
+	info, err := me.ffmpegProbe(filePath)
+	if err != nil || info == nil {
+		http.Error(w, fmt.Sprintf("error probing: %v", err), http.StatusInternalServerError)
+		return
+	}
+	duration, err := info.Duration()
+	if err != nil || duration <= 0 {
+		http.Error(w, "unknown duration", http.StatusInternalServerError)
+		return
+	}
+	if name == hlsPlaylistName {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		writeHLSPlaylist(w, duration)
+		return
+	}
+	n, ok := parseHLSSegmentName(name)
+	if count, _ := hlsSegments(duration); !ok || n >= count {
+		http.NotFound(w, r)
+		return
+	}
+	fi, err := me.stat(filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := me.hls.segment(r.Context(), me.osPath(filePath), fi, duration, n)
+	if err != nil {
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", transcode.HLSProfile.MimeType)
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// Returns the cached segment, transcoding it if necessary. input is the
+// path of the source file given to ffmpeg, and fi its file info, so that
+// segments of a file that has since changed aren't served.
+func (h *hlsServer) segment(ctx context.Context, input string, fi fs.FileInfo, duration time.Duration, n int) (*os.File, error) {
+	for {
+		h.mu.Lock()
+		s := h.session(hlsSessionKey(input, fi))
+		seg, ok := s.segments[n]
+		if !ok {
+			seg = &hlsSegment{
+				ready: make(chan struct{}),
+				file:  filepath.Join(s.dir, fmt.Sprintf("%d.ts", n)),
+			}
+			s.segments[n] = seg
+			go h.transcodeSegment(s, seg, input, duration, n)
+		}
+		h.mu.Unlock()
+		select {
+		case <-seg.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if seg.err != nil {
+			return nil, seg.err
+		}
+		h.mu.Lock()
+		if s.segments[n] != seg {
+			// Evicted since it was transcoded.
+			h.mu.Unlock()
+			continue
+		}
+		now := time.Now()
+		seg.lastUsed = now
+		s.lastUsed = now
+		f, err := os.Open(seg.file)
+		h.mu.Unlock()
+		return f, err
+	}
+}
+
+// Returns the key of the session of the input with the file info. A file
+// that's changed gets a new session, and the old one is left to go idle.
+func hlsSessionKey(input string, fi fs.FileInfo) string {
+	return fmt.Sprintf("%s\x00%d\x00%d", input, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// Returns the session with the key, creating it if necessary. h.mu must be
+// held.
+func (h *hlsServer) session(key string) *hlsSession {
+	s, ok := h.sessions[key]
+	if !ok {
+		s = &hlsSession{
+			dir:      filepath.Join(h.dir, fmt.Sprintf("%x", md5.Sum([]byte(key)))),
+			segments: make(map[int]*hlsSegment),
+		}
+		h.sessions[key] = s
+	}
+	s.lastUsed = time.Now()
+	return s
+}
+
+func (h *hlsServer) transcodeSegment(s *hlsSession, seg *hlsSegment, input string, duration time.Duration, n int) {
+	h.workers <- struct{}{}
+	size, err := h.writeSegment(s.dir, seg.file, input, duration, n)
+	<-h.workers
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seg.err = err
+	seg.size = size
+	seg.lastUsed = time.Now()
+	if err != nil {
+		// Let the next request retry.
+		if s.segments[n] == seg {
+			delete(s.segments, n)
+		}
+	} else {
+		h.size += size
+		h.evict()
+	}
+	close(seg.ready)
+}
+
+// Transcodes a segment to its file, and returns its size.
+func (h *hlsServer) writeSegment(dir, file, input string, duration time.Duration, n int) (size int64, err error) {
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return
+	}
+	start := time.Duration(n) * hlsSegmentDuration
+	r, err := h.transcode(input, start, min(hlsSegmentDuration, duration-start))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	f, err := os.CreateTemp(dir, "partial-")
+	if err != nil {
+		return
+	}
+	size, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size == 0 {
+		err = errors.New("transcode produced no output")
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// Removes the least recently used segments until the cache is within its
+// size limit. h.mu must be held.
+func (h *hlsServer) evict() {
+	for h.size > h.maxSize {
+		var (
+			oldest        *hlsSegment
+			oldestSession *hlsSession
+			oldestN       int
+		)
+		for _, s := range h.sessions {
+			for n, seg := range s.segments {
+				if !seg.isReady() {
+					continue
+				}
+				if oldest == nil || seg.lastUsed.Before(oldest.lastUsed) {
+					oldest, oldestSession, oldestN = seg, s, n
+				}
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		h.removeSegment(oldestSession, oldestN)
+	}
+}
+
+func (seg *hlsSegment) isReady() bool {
+	select {
+	case <-seg.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// h.mu must be held.
+func (h *hlsServer) removeSegment(s *hlsSession, n int) {
+	seg := s.segments[n]
+	delete(s.segments, n)
+	h.size -= seg.size
+	os.Remove(seg.file)
+}
+
+// Removes the sessions that have been idle since before the given time, and
+// have no segments being transcoded.
+func (h *hlsServer) removeIdleSessions(before time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+sessions:
+	for input, s := range h.sessions {
+		if !s.lastUsed.Before(before) {
+			continue
+		}
+		for _, seg := range s.segments {
+			if !seg.isReady() {
+				continue sessions
+			}
+		}
+		for n := range s.segments {
+			h.removeSegment(s, n)
+		}
+		os.RemoveAll(s.dir)
+		delete(h.sessions, input)
+	}
+}
+
+// Removes idle sessions until the server is closed, and then the cache
+// directory.
+func (srv *Server) cleanHLS() {
+	ticker := time.NewTicker(hlsIdleTimeout / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.closed:
+			srv.hls.mu.Lock()
+			defer srv.hls.mu.Unlock()
+			os.RemoveAll(srv.hls.dir)
+			return
+		case now := <-ticker.C:
+			srv.hls.removeIdleSessions(now.Add(-hlsIdleTimeout))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dms
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+	var b strings.Builder
+	if err := writeHLSPlaylist(&b, 15*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:6.000,\n0.ts\n" +
+		"#EXTINF:6.000,\n1.ts\n" +
+		"#EXTINF:3.000,\n2.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	if b.String() != expected {
+		t.Fatal(b.String())
+	}
+	if count, last := hlsSegments(12 * time.Second); count != 2 || last != 6*time.Second {
+		t.Fatal(count, last)
+	}
+}
+
+func TestParseHLSPath(t *testing.T) {
+	objectPath, name, ok := parseHLSPath("/hls/Movies/The Big Lebowski.mkv/index.m3u8")
+	if !ok || objectPath != "Movies/The Big Lebowski.mkv" || name != "index.m3u8" {
+		t.Fatal(objectPath, name, ok)
+	}
+	if _, _, ok := parseHLSPath("/hls/index.m3u8"); ok {
+		t.Fatal("expected no object path")
+	}
+	if n, ok := parseHLSSegmentName("12.ts"); !ok || n != 12 {
+		t.Fatal(n, ok)
+	}
+	for _, bad := range []string{"12", "-1.ts", "x.ts"} {
+		if _, ok := parseHLSSegmentName(bad); ok {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestHLSSegmentCache(t *testing.T) {
+	h, err := newHLSServer(nil, t.TempDir(), 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu         sync.Mutex
+		transcodes []time.Duration
+	)
+	h.transcode = func(input string, start, length time.Duration) (io.ReadCloser, error) {
+		mu.Lock()
+		transcodes = append(transcodes, start)
+		mu.Unlock()
+		return io.NopCloser(strings.NewReader("0123456789")), nil
+	}
+	fsys := fstest.MapFS{"in.mkv": {Data: []byte("mkv"), ModTime: time.Unix(1, 0)}}
+	get := func(n int) {
+		t.Helper()
+		fi, err := fs.Stat(fsys, "in.mkv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := h.segment(context.Background(), "in.mkv", fi, time.Minute, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		if string(b) != "0123456789" {
+			t.Fatalf("segment %d: %q", n, b)
+		}
+	}
+	// Concurrent requests share a transcode.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(1)
+		}()
+	}
+	wg.Wait()
+	get(2)
+	if len(transcodes) != 2 || transcodes[0] != hlsSegmentDuration || transcodes[1] != 2*hlsSegmentDuration {
+		t.Fatal(transcodes)
+	}
+	// The third segment exceeds the size limit, so the least recently used
+	// is evicted and has to be transcoded again.
+	get(1)
+	get(3)
+	get(2)
+	if len(transcodes) != 4 {
+		t.Fatal(transcodes)
+	}
+	if h.size != 20 {
+		t.Fatal(h.size)
+	}
+	// Segments of the file from before it changed aren't used.
+	fsys["in.mkv"].ModTime = time.Unix(2, 0)
+	get(2)
+	if len(transcodes) != 5 || len(h.sessions) != 2 {
+		t.Fatal(transcodes, len(h.sessions))
+	}
+
+	var dirs []string
+	for _, s := range h.sessions {
+		dirs = append(dirs, s.dir)
+	}
+	h.removeIdleSessions(time.Now().Add(-time.Minute))
+	if len(h.sessions) != 2 {
+		t.Fatal("removed active session")
+	}
+	h.removeIdleSessions(time.Now().Add(time.Minute))
+	if len(h.sessions) != 0 || h.size != 0 {
+		t.Fatal(len(h.sessions), h.size)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package dms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/exif"
+	"github.com/anacrolix/dms/library"
+)
+
+func (srv *Server) initLibrary() {
+	if srv.NoIndex {
+		return
+	}
+	srv.library = &library.Library{
+		FS:   srv.FS,
+		Path: srv.IndexPath,
+		Root: srv.indexRoot(),
+		MimeType: func(path string) (string, error) {
+			mimeType, err := MimeTypeByPath(srv.FS, path)
+			return string(mimeType), err
+		},
+		Probe: func(e *library.Entry) (*ffprobe.Info, error) {
+			if srv.NoProbe || !mimeType(e.MimeType).IsMedia() {
+				return nil, nil
+			}
+			info, err := srv.probeFile(e.Path)
+			if errors.Is(err, ffprobe.ExeNotFound) {
+				err = nil
+			}
+			return info, err
+		},
+		Date:   srv.mediaDate,
+		Ignore: srv.IgnorePath,
+		ID:     fileObjectID,
+		Logger: srv.Logger.With("subsystem", "library"),
+	}
+	if srv.IndexPath == "" {
+		return
+	}
+	if err := srv.library.Load(); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			srv.Logger.Info("error loading library index", "path", srv.IndexPath, "error", err)
+		}
+		return
+	}
+	srv.Logger.Info("loaded library index", "path", srv.IndexPath, "entries", srv.library.Len())
+}
+
+// Identifies the directories served, so that an index of others isn't used.
+func (srv *Server) indexRoot() string {
+	if len(srv.Roots) == 0 {
+		return srv.rootPath
+	}
+	roots := make([]string, 0, len(srv.Roots))
+	for _, r := range srv.Roots {
+		roots = append(roots, r.Name+"="+r.Path)
+	}
+	return strings.Join(roots, string(filepath.ListSeparator))
+}
+
+// Determines when a library entry's media was created.
+func (srv *Server) mediaDate(e *library.Entry) (time.Time, error) {
+	return srv.embeddedDate(e.Path, mimeType(e.MimeType), e.Probe)
+}
+
+// Determines when a file's media was created, from the EXIF data of JPEGs
+// and the creation_time or date tag of probed media. It's zero if the file
+// doesn't say.
+func (srv *Server) embeddedDate(path string, mt mimeType, info *ffprobe.Info) (time.Time, error) {
+	if mt == "image/jpeg" {
+		f, err := srv.FS.Open(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer f.Close()
+		x, err := exif.Decode(f)
+		if errors.Is(err, exif.ErrNoExif) {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		return x.Date(), nil
+	}
+	if info != nil {
+		if s := probeTag(info, "creation_time"); s != "" {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		if s := probeTag(info, "date"); s != "" {
+			return parseDateTag(s)
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Layouts of the date tag, which can be anything from a year to an ISO 8601
+// date and time.
+var dateTagLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	time.DateTime,
+	time.DateOnly,
+	"2006-01",
+	"2006",
+}
+
+func parseDateTag(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateTagLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+// Returns when an item's media was created, from the library index if it's
+// there, or else the file's embedded metadata. Either falls back on the
+// modification time.
+func (srv *Server) itemDate(path string, mt mimeType, fi fs.FileInfo, info *ffprobe.Info) time.Time {
+	if srv.library != nil {
+		if e, ok := srv.library.Get(path); ok {
+			return entryDate(e)
+		}
+	}
+	date, err := srv.embeddedDate(path, mt, info)
+	if err != nil {
+		srv.Logger.Debug("error determining date", "path", path, "error", err)
+	}
+	if date.IsZero() {
+		return fi.ModTime()
+	}
+	return date
+}
+
+// Scans the library until it completes or the server is closed, then persists
+// the index.
+func (srv *Server) scanLibrary() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-srv.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	started := time.Now()
+	err := srv.library.Scan(ctx)
+	if err != nil {
+		srv.Logger.Info("library scan stopped", "error", err, "duration", time.Since(started))
+	} else {
+		srv.Logger.Info("library scan completed", "entries", srv.library.Len(), "duration", time.Since(started))
+	}
+	if srv.IndexPath == "" {
+		return
+	}
+	if err := srv.library.Save(); err != nil {
+		srv.Logger.Info("error saving library index", "path", srv.IndexPath, "error", err)
+	}
+}
+
+// Returns the contents of the object's directory, from the library index if
+// it's available.
+func (srv *Server) readDir(o object) ([]fs.FileInfo, error) {
+	if srv.library != nil {
+		if children, ok := srv.library.Children(o.FilePath()); ok {
+			fis := make([]fs.FileInfo, 0, len(children))
+			for _, e := range children {
+				fis = append(fis, e.FileInfo())
+			}
+			return fis, nil
+		}
+	}
+	return o.readDir(srv.FS)
+}
+
+// Returns the library index's entry for a path, if there's an index and the
+// entry is current. fi is the file's info if the caller has it, such as from
+// a directory listing, which saves statting the file again. It may be nil.
+func (srv *Server) currentEntry(path string, fi fs.FileInfo) (*library.Entry, bool) {
+	if srv.library == nil {
+		return nil, false
+	}
+	if fi == nil {
+		return srv.library.GetCurrent(path)
+	}
+	return srv.library.GetCurrentInfo(path, fi)
+}
+
+// Returns the file info for a path, from the library index if it's available
+// and current.
+func (srv *Server) stat(path string) (fs.FileInfo, error) {
+	if e, ok := srv.currentEntry(path, nil); ok {
+		return e.FileInfo(), nil
+	}
+	return fs.Stat(srv.FS, path)
+}
+
+// Determines the MIME type of a path, from the library index if it's
+// available and current.
+func (srv *Server) mimeTypeByPath(path string) (mimeType, error) {
+	return srv.fileMimeType(path, nil)
+}
+
+// Like mimeTypeByPath, for a file whose info the caller has. fi may be nil.
+func (srv *Server) fileMimeType(path string, fi fs.FileInfo) (mimeType, error) {
+	if e, ok := srv.currentEntry(path, fi); ok && e.MimeType != "" {
+		return mimeType(e.MimeType), nil
+	}
+	return MimeTypeByPath(srv.FS, path)
+}
@@ -0,0 +1,63 @@
+package dms
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+func TestItemDate(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	srv := &Server{FS: fstest.MapFS{"song.mp3": {ModTime: modTime}}}
+	fi, err := srv.stat("song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, expected := range map[string]time.Time{
+		"":                    modTime,
+		"1975":                time.Date(1975, 1, 1, 0, 0, 0, 0, time.UTC),
+		"1975-10-31":          time.Date(1975, 10, 31, 0, 0, 0, 0, time.UTC),
+		"1975-10-31 12:30:00": time.Date(1975, 10, 31, 12, 30, 0, 0, time.UTC),
+	} {
+		info := &ffprobe.Info{Format: map[string]interface{}{"tags": map[string]interface{}{"date": tag}}}
+		if got := srv.itemDate("song.mp3", "audio/mpeg", fi, info); !got.Equal(expected) {
+			t.Errorf("%q: got %v", tag, got)
+		}
+	}
+	// creation_time takes precedence.
+	info := &ffprobe.Info{Format: map[string]interface{}{"tags": map[string]interface{}{
+		"date":          "1975",
+		"creation_time": "2001-02-03T04:05:06.000000Z",
+	}}}
+	if got := srv.itemDate("song.mp3", "audio/mpeg", fi, info); !got.Equal(time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)) {
+		t.Fatal(got)
+	}
+	if _, err := parseDateTag("last week"); err == nil {
+		t.Fatal("parsed nonsense date")
+	}
+}
+
+func TestLibraryEntriesKeptCurrent(t *testing.T) {
+	fsys := fstest.MapFS{"song.mp3": {Data: []byte("a")}}
+	tags := map[string]map[string]interface{}{"song.mp3": {"title": "Old"}}
+	srv := newViewsTestServer(t, fsys, tags)
+	// The file changes without the library being told.
+	fsys["song.mp3"] = &fstest.MapFile{Data: []byte("abc"), ModTime: time.Unix(1, 0)}
+	tags["song.mp3"] = map[string]interface{}{"title": "New"}
+	fi, err := srv.stat("song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 {
+		t.Fatal(fi.Size())
+	}
+	info, err := srv.ffmpegProbe("song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := probeTag(info, "title"); got != "New" {
+		t.Fatal(got)
+	}
+}
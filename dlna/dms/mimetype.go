@@ -10,14 +10,33 @@ import (
 )
 
 func init() {
-	if err := mime.AddExtensionType(".rmvb", "application/vnd.rn-realmedia-vbr"); err != nil {
-		slog.Info("could not register MIME type", "mime_type", "application/vnd.rn-realmedia-vbr", "error", err)
-	}
-	if err := mime.AddExtensionType(".ogv", "video/ogg"); err != nil {
-		slog.Info("could not register MIME type", "mime_type", "video/ogg", "error", err)
-	}
-	if err := mime.AddExtensionType(".ogg", "audio/ogg"); err != nil {
-		slog.Info("could not register MIME type", "mime_type", "audio/ogg", "error", err)
+	for ext, mimeType := range map[string]string{
+		".rmvb": "application/vnd.rn-realmedia-vbr",
+		".ogv":  "video/ogg",
+		".ogg":  "audio/ogg",
+		// Audio that clients often can't play, and are offered transcodes
+		// of.
+		".flac": "audio/flac",
+		".m4a":  "audio/mp4",
+		".ape":  "audio/x-ape",
+		".opus": "audio/ogg",
+		".wv":   "audio/x-wavpack",
+		".dsf":  "audio/x-dsf",
+		".dff":  "audio/x-dff",
+		// Photos that are offered converted to JPEG.
+		".heic": "image/heic",
+		".heif": "image/heif",
+		".webp": "image/webp",
+		".tif":  "image/tiff",
+		".tiff": "image/tiff",
+		".dng":  "image/x-adobe-dng",
+		".cr2":  "image/x-canon-cr2",
+		".nef":  "image/x-nikon-nef",
+		".arw":  "image/x-sony-arw",
+	} {
+		if err := mime.AddExtensionType(ext, mimeType); err != nil {
+			slog.Info("could not register MIME type", "mime_type", mimeType, "error", err)
+		}
 	}
 }
 
@@ -0,0 +1,188 @@
+package dms
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Filesystem objects have short, opaque IDs, such as "@1x2kqv8r0z5m", so
+// that clients aren't shown paths, and bookmarks and playlists survive a
+// file or folder being renamed or moved. They're derived from the device and
+// inode numbers where the filesystem has them, and otherwise from the path,
+// as they are for files with hard links. The library index keeps them for
+// each entry.
+//
+// IDs are mapped back to paths by the library index. Without it, they're
+// mapped by a table that's filled as objects are listed, and by walking the
+// tree for those it doesn't have, such as IDs a client kept from before a
+// restart. The query escaped paths that were used as IDs before are still
+// accepted.
+const objectIDPrefix = "@"
+
+// The most IDs the table holds before it forgets the older half.
+const maxObjectIDs = 1 << 16
+
+// The most files and directories walked looking for an ID that isn't in the
+// table.
+const maxObjectIDWalk = 10000
+
+func isOpaqueID(id string) bool {
+	return strings.HasPrefix(id, objectIDPrefix)
+}
+
+// Maps object IDs to the paths they were last seen at. An empty path records
+// an ID that couldn't be found, so it isn't looked for again.
+type objectIDs struct {
+	mu sync.Mutex
+	// The IDs added since the table last filled, and those before.
+	paths, old map[string]string
+}
+
+func (me *objectIDs) add(id, path string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.paths == nil {
+		me.paths = make(map[string]string)
+	}
+	if len(me.paths) >= maxObjectIDs {
+		me.old = me.paths
+		me.paths = make(map[string]string)
+	}
+	me.paths[id] = path
+}
+
+func (me *objectIDs) path(id string) (p string, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	p, ok = me.paths[id]
+	if !ok {
+		p, ok = me.old[id]
+	}
+	return
+}
+
+// Derives the ID of a file or directory at a path relative to the root.
+func fileObjectID(p string, fi fs.FileInfo) string {
+	h := fnv.New64a()
+	if dev, ino, ok := fileIdentity(fi); ok {
+		fmt.Fprintf(h, "%d:%d", dev, ino)
+	} else {
+		io.WriteString(h, path.Clean(p))
+	}
+	return objectIDPrefix + strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Returns the ID of the object for a file or directory, and remembers where
+// it is if the library index doesn't.
+func (srv *Server) objectID(o object, fi fs.FileInfo) string {
+	if o.ID() == "0" {
+		return "0"
+	}
+	p := o.FilePath()
+	if srv.library != nil {
+		if e, ok := srv.library.Get(p); ok && e.ID != "" {
+			return e.ID
+		}
+	}
+	id := fileObjectID(p, fi)
+	srv.objectIDs.add(id, p)
+	return id
+}
+
+// Returns the ID of the object at a path.
+func (srv *Server) pathObjectID(o object) (string, error) {
+	if o.ID() != "0" && srv.library != nil {
+		// IDs don't change with a file's contents, so the index's needn't be
+		// current.
+		if e, ok := srv.library.Get(o.FilePath()); ok && e.ID != "" {
+			return e.ID, nil
+		}
+	}
+	fi, err := srv.stat(o.FilePath())
+	if err != nil {
+		return "", err
+	}
+	return srv.objectID(o, fi), nil
+}
+
+// Returns the ID of an object's parent.
+func (srv *Server) parentObjectID(o object) string {
+	if o.ID() == "0" {
+		return "-1"
+	}
+	parent := object{path.Dir(o.Path), o.RootObjectPath}
+	id, err := srv.pathObjectID(parent)
+	if err != nil {
+		// The parent's gone, so its ID can't be worked out.
+		return parent.ID()
+	}
+	return id
+}
+
+var errNoSuchObjectID = errors.New("no such object")
+
+// Returns the path of the file or directory with an opaque ID.
+func (srv *Server) objectIDPath(id string) (string, error) {
+	if srv.library != nil {
+		if e, ok := srv.library.ByID(id); ok {
+			return e.Path, nil
+		}
+	}
+	if p, ok := srv.objectIDs.path(id); ok {
+		if p == "" {
+			return "", errNoSuchObjectID
+		}
+		// Another file might have taken its place.
+		fi, err := srv.stat(p)
+		if err == nil && srv.objectID(object{p, srv.RootObjectPath}, fi) == id {
+			return p, nil
+		}
+	}
+	if srv.library != nil {
+		// Everything the index doesn't have has been seen since startup.
+		return "", errNoSuchObjectID
+	}
+	if p, ok := srv.findObjectID(id); ok {
+		return p, nil
+	}
+	srv.objectIDs.add(id, "")
+	return "", errNoSuchObjectID
+}
+
+// Walks the filesystem looking for the file or directory with an ID,
+// remembering the IDs of those passed on the way. It gives up after
+// maxObjectIDWalk of them.
+func (srv *Server) findObjectID(id string) (found string, ok bool) {
+	walked := 0
+	fs.WalkDir(srv.FS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return nil
+		}
+		if walked++; walked > maxObjectIDWalk {
+			return fs.SkipAll
+		}
+		if ignored, _ := srv.IgnorePath(p); ignored {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if srv.objectID(object{p, srv.RootObjectPath}, fi) == id {
+			found, ok = p, true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,80 @@
+package dms
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestObjectIDs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"Music/Queen/song.mp3": {},
+		"Music/other.mp3":      {},
+	}
+	cds := &contentDirectoryService{Server: &Server{NoProbe: true, FS: fsys}}
+	song := object{"Music/Queen/song.mp3", "./"}
+	fi, err := cds.stat(song.FilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := cds.objectID(song, fi)
+	if !isOpaqueID(id) || strings.Contains(id, "song") {
+		t.Fatal(id)
+	}
+	if parent, _ := cds.pathObjectID(object{"Music/Queen", "./"}); cds.parentObjectID(song) != parent {
+		t.Fatal(cds.parentObjectID(song), parent)
+	}
+	if cds.objectID(object{".", "./"}, fi) != "0" || cds.parentObjectID(object{".", "./"}) != "-1" {
+		t.Fatal("root IDs")
+	}
+	for _, id := range []string{id, "Music%2FQueen%2Fsong.mp3"} {
+		o, err := cds.objectFromID(id)
+		if err != nil || o.Path != song.Path {
+			t.Fatal(id, o, err)
+		}
+	}
+	// A server that hasn't handed the ID out finds it.
+	cds = &contentDirectoryService{Server: &Server{NoProbe: true, FS: fsys}}
+	if o, err := cds.objectFromID(id); err != nil || o.Path != song.Path {
+		t.Fatal(o, err)
+	}
+	if _, err := cds.objectFromID(objectIDPrefix + "nothing"); err == nil {
+		t.Fatal("found unknown ID")
+	}
+	// The miss is remembered, so the tree isn't walked for it again.
+	if p, ok := cds.objectIDs.path(objectIDPrefix + "nothing"); !ok || p != "" {
+		t.Fatal(p, ok)
+	}
+
+	// With the library index, IDs are only looked up in it.
+	srv := newViewsTestServer(t, fsys, nil)
+	srv.library.ID = fileObjectID
+	if err := srv.library.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := srv.objectIDPath(id); err != nil || p != song.Path {
+		t.Fatal(p, err)
+	}
+	if _, err := srv.objectIDPath(objectIDPrefix + "nothing"); err == nil {
+		t.Fatal("found unknown ID")
+	}
+	if _, ok := srv.objectIDs.path(id); ok {
+		t.Fatal("indexed ID added to table")
+	}
+}
+
+func TestObjectIDTableBounded(t *testing.T) {
+	var ids objectIDs
+	for i := 0; i <= maxObjectIDs; i++ {
+		ids.add(fmt.Sprint(i), "p")
+	}
+	if len(ids.paths) > maxObjectIDs || len(ids.old) != maxObjectIDs {
+		t.Fatal(len(ids.paths), len(ids.old))
+	}
+	// Older IDs are still found until the table fills again.
+	if _, ok := ids.path("0"); !ok {
+		t.Fatal("lost recent ID")
+	}
+}
@@ -0,0 +1,130 @@
+package dms
+
+import (
+	"strings"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/transcode"
+)
+
+// How a client is to be sent a media file.
+type playMethod int
+
+const (
+	// The file is served as is.
+	directPlay playMethod = iota
+	// The streams are copied into a container the client supports.
+	remux
+	// The streams are reencoded.
+	fullTranscode
+)
+
+func (m playMethod) String() string {
+	switch m {
+	case directPlay:
+		return "direct play"
+	case remux:
+		return "remux"
+	case fullTranscode:
+		return "transcode"
+	}
+	return "unknown"
+}
+
+// Reports whether the profile says anything about what the client plays.
+// Without this, there's no basis for deciding against direct play.
+func (p *DeviceProfile) knowsCapabilities() bool {
+	return len(p.Containers) != 0 || len(p.VideoCodecs) != 0 || len(p.AudioCodecs) != 0 ||
+		p.MaxWidth != 0 || p.MaxHeight != 0 || p.MaxBitrate != 0
+}
+
+// Reports whether s is in list, or list is empty.
+func supported(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether any of the comma-separated ffprobe format names are in
+// list, or list is empty.
+func supportedContainer(list []string, formatName string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, name := range strings.Split(formatName, ",") {
+		if supported(list, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decides how the client should be sent media with the given probe results.
+// Media that hasn't been probed is played directly. For remuxes, the remux
+// profile to use is returned too.
+func (p *DeviceProfile) playMethod(mt mimeType, info *ffprobe.Info) (playMethod, *transcode.Profile) {
+	if info == nil || !p.knowsCapabilities() || !(mt.IsVideo() || mt.IsAudio()) {
+		return directPlay, nil
+	}
+	streamsOK := true
+	audioSeen := false
+	for _, s := range info.Streams {
+		codec, _ := s["codec_name"].(string)
+		switch s["codec_type"] {
+		case "video":
+			if isAttachedPicture(s) {
+				continue
+			}
+			if !supported(p.VideoCodecs, codec) {
+				streamsOK = false
+			}
+			if width, err := ffprobe.AnyAsFloat64(s["width"]); err == nil && p.MaxWidth != 0 && width > float64(p.MaxWidth) {
+				streamsOK = false
+			}
+			if height, err := ffprobe.AnyAsFloat64(s["height"]); err == nil && p.MaxHeight != 0 && height > float64(p.MaxHeight) {
+				streamsOK = false
+			}
+		case "audio":
+			// Only the first audio stream is played by default.
+			if !audioSeen && !supported(p.AudioCodecs, codec) {
+				streamsOK = false
+			}
+			audioSeen = true
+		}
+	}
+	if bitrate, err := info.Bitrate(); err == nil && p.MaxBitrate != 0 && int64(bitrate) > p.MaxBitrate {
+		streamsOK = false
+	}
+	if !streamsOK {
+		return fullTranscode, nil
+	}
+	// Containers matter less for audio, where the format is usually named
+	// after the codec.
+	formatName, _ := info.Format["format_name"].(string)
+	if mt.IsAudio() || supportedContainer(p.Containers, formatName) {
+		return directPlay, nil
+	}
+	for _, container := range p.Containers {
+		if profile, ok := transcode.RemuxProfile(container); ok {
+			return remux, profile
+		}
+	}
+	return fullTranscode, nil
+}
+
+// Reports whether a video stream is cover art rather than video.
+func isAttachedPicture(s map[string]interface{}) bool {
+	disposition, _ := s["disposition"].(map[string]interface{})
+	if disposition == nil {
+		return false
+	}
+	v, err := ffprobe.AnyAsFloat64(disposition["attached_pic"])
+	return err == nil && v != 0
+}
@@ -0,0 +1,102 @@
+package dms
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+func probeInfo(format string, bitrate string, streams ...map[string]interface{}) *ffprobe.Info {
+	return &ffprobe.Info{
+		Format:  map[string]interface{}{"format_name": format, "bit_rate": bitrate},
+		Streams: streams,
+	}
+}
+
+func videoStream(codec string, width, height int) map[string]interface{} {
+	return map[string]interface{}{"codec_type": "video", "codec_name": codec, "width": json.Number(strconv.Itoa(width)), "height": json.Number(strconv.Itoa(height))}
+}
+
+func audioStream(codec string) map[string]interface{} {
+	return map[string]interface{}{"codec_type": "audio", "codec_name": codec}
+}
+
+func TestPlayMethod(t *testing.T) {
+	tv := &DeviceProfile{
+		Name:        "tv",
+		Containers:  []string{"mp4", "mpegts"},
+		VideoCodecs: []string{"h264"},
+		AudioCodecs: []string{"aac", "ac3"},
+		MaxWidth:    1920,
+		MaxHeight:   1080,
+		MaxBitrate:  20000000,
+	}
+	coverArt := videoStream("mjpeg", 3000, 3000)
+	coverArt["disposition"] = map[string]interface{}{"attached_pic": json.Number("1")}
+	for _, tc := range []struct {
+		name     string
+		profile  *DeviceProfile
+		mimeType mimeType
+		info     *ffprobe.Info
+		expected playMethod
+		remux    string
+	}{
+		{"playable", tv, "video/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "8000000", videoStream("h264", 1920, 1080), audioStream("aac")), directPlay, ""},
+		{"container", tv, "video/x-matroska", probeInfo("matroska,webm", "8000000", videoStream("h264", 1280, 720), audioStream("ac3")), remux, "remux-mp4"},
+		{"video codec", tv, "video/x-matroska", probeInfo("matroska,webm", "8000000", videoStream("hevc", 1920, 1080), audioStream("aac")), fullTranscode, ""},
+		{"audio codec", tv, "video/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "8000000", videoStream("h264", 1920, 1080), audioStream("dts")), fullTranscode, ""},
+		{"second audio stream", tv, "video/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "8000000", videoStream("h264", 1920, 1080), audioStream("aac"), audioStream("dts")), directPlay, ""},
+		{"resolution", tv, "video/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "8000000", videoStream("h264", 3840, 2160), audioStream("aac")), fullTranscode, ""},
+		{"bitrate", tv, "video/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "40000000", videoStream("h264", 1920, 1080), audioStream("aac")), fullTranscode, ""},
+		{"audio with cover art", tv, "audio/mp4", probeInfo("mov,mp4,m4a,3gp,3g2,mj2", "256000", audioStream("aac"), coverArt), directPlay, ""},
+		{"audio codec only", tv, "audio/flac", probeInfo("flac", "900000", audioStream("flac")), fullTranscode, ""},
+		{"unknown capabilities", &DefaultDeviceProfile, "video/x-matroska", probeInfo("matroska,webm", "8000000", videoStream("hevc", 3840, 2160)), directPlay, ""},
+		{"not probed", tv, "video/x-matroska", nil, directPlay, ""},
+		{"image", tv, "image/jpeg", probeInfo("image2", "", videoStream("mjpeg", 4000, 3000)), directPlay, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method, profile := tc.profile.playMethod(tc.mimeType, tc.info)
+			if method != tc.expected {
+				t.Fatalf("got %v, expected %v", method, tc.expected)
+			}
+			var name string
+			if profile != nil {
+				name = profile.Name
+			}
+			if name != tc.remux {
+				t.Fatalf("got remux profile %q, expected %q", name, tc.remux)
+			}
+		})
+	}
+}
+
+func TestAudioTranscodes(t *testing.T) {
+	srv := &Server{}
+	speaker := &DeviceProfile{Name: "speaker", AudioCodecs: []string{"pcm_s16be", "aac"}}
+	var names []string
+	for _, p := range srv.applicableTranscodeProfiles(speaker, "audio/flac") {
+		names = append(names, p.Name)
+	}
+	// Those the speaker plays first, and no video transcodes.
+	if strings.Join(names, " ") != "aac lpcm mp3 wav" {
+		t.Fatal(names)
+	}
+	names = nil
+	for _, p := range srv.applicableTranscodeProfiles(&DefaultDeviceProfile, "audio/flac") {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, " ") != "mp3 aac lpcm wav" {
+		t.Fatal(names)
+	}
+	// A forced video transcode isn't applied to audio.
+	srv = &Server{ForceTranscodeTo: "web", NoProbe: true}
+	if k := srv.forcedTranscode(&DefaultDeviceProfile, "album/01.flac"); k != "" {
+		t.Fatal(k)
+	}
+	if k := srv.forcedTranscode(&DefaultDeviceProfile, "film.mkv"); k != "web" {
+		t.Fatal(k)
+	}
+}
@@ -0,0 +1,211 @@
+package dms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Root is a named directory tree served alongside others. With Server.Roots
+// set, each is a container in the root container, and the paths of its files,
+// as used in /res and the library index, begin with its name.
+type Root struct {
+	// The title of the root's container. The base name of Path is used if
+	// it's empty.
+	Name string
+	// The directory served. FS is opened on it if that's nil. It's needed
+	// for ffmpeg and filesystem watching.
+	Path string
+	FS   fs.FS `json:"-"`
+	// Ignore rules applied beneath the root, in addition to the Server's.
+	IgnoreHidden     bool     `json:",omitempty"`
+	IgnoreUnreadable bool     `json:",omitempty"`
+	IgnorePaths      []string `json:",omitempty"`
+}
+
+// Fills in the defaults of the roots, and checks their names are usable and
+// unique.
+func initRoots(roots []Root) ([]Root, error) {
+	roots = slices.Clone(roots)
+	seen := make(map[string]bool, len(roots))
+	for i := range roots {
+		r := &roots[i]
+		if r.Name == "" {
+			r.Name = filepath.Base(r.Path)
+		}
+		if !fs.ValidPath(r.Name) || r.Name == "." || strings.Contains(r.Name, "/") {
+			return nil, fmt.Errorf("invalid root name %q", r.Name)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("duplicate root name %q", r.Name)
+		}
+		seen[r.Name] = true
+		if r.FS == nil {
+			if r.Path == "" {
+				return nil, fmt.Errorf("root %q has no path", r.Name)
+			}
+			r.FS = os.DirFS(r.Path)
+		}
+	}
+	return roots, nil
+}
+
+// Returns the root a path is beneath, and the path within it.
+func (srv *Server) root(p string) (r *Root, rel string, ok bool) {
+	name, rel, _ := strings.Cut(path.Clean(p), "/")
+	for i := range srv.Roots {
+		if srv.Roots[i].Name == name {
+			if rel == "" {
+				rel = "."
+			}
+			return &srv.Roots[i], rel, true
+		}
+	}
+	return
+}
+
+// Returns the filesystem path of a file, for external tools. It's empty for
+// the root container of several roots, and for roots without a Path.
+func (srv *Server) osPath(p string) string {
+	if len(srv.Roots) == 0 {
+		return filepath.Join(srv.rootPath, filepath.FromSlash(p))
+	}
+	r, rel, ok := srv.root(p)
+	if !ok || r.Path == "" {
+		return ""
+	}
+	return filepath.Join(r.Path, filepath.FromSlash(rel))
+}
+
+// The inverse of osPath.
+func (srv *Server) fsPath(name string) (string, bool) {
+	if len(srv.Roots) == 0 {
+		return relSlashPath(srv.rootPath, name)
+	}
+	for _, r := range srv.Roots {
+		if r.Path == "" {
+			continue
+		}
+		if rel, ok := relSlashPath(r.Path, name); ok {
+			return path.Join(r.Name, rel), true
+		}
+	}
+	return "", false
+}
+
+func relSlashPath(base, name string) (string, bool) {
+	rel, err := filepath.Rel(base, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// An fs.FS of several roots, whose top-level directories are the roots.
+type rootsFS []Root
+
+func (me rootsFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &rootsDir{roots: me}, nil
+	}
+	rootName, rel, _ := strings.Cut(name, "/")
+	if rel == "" {
+		rel = "."
+	}
+	for _, r := range me {
+		if r.Name == rootName {
+			f, err := r.FS.Open(rel)
+			if err == nil && rel == "." {
+				// The root directory is named after the root, not ".".
+				f = rootFile{f, r.Name}
+			}
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// The top-level directory of a rootsFS.
+type rootsDir struct {
+	roots  rootsFS
+	offset int
+}
+
+func (me *rootsDir) Stat() (fs.FileInfo, error) {
+	return rootsDirInfo{}, nil
+}
+
+func (me *rootsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (me *rootsDir) Close() error {
+	return nil
+}
+
+func (me *rootsDir) ReadDir(n int) (ret []fs.DirEntry, err error) {
+	for me.offset < len(me.roots) && (n <= 0 || len(ret) < n) {
+		r := me.roots[me.offset]
+		me.offset++
+		fi, err := fs.Stat(r.FS, ".")
+		if err != nil {
+			// Unavailable roots, such as an unplugged disk, are left out.
+			continue
+		}
+		ret = append(ret, fs.FileInfoToDirEntry(namedFileInfo{fi, r.Name}))
+	}
+	if n > 0 && len(ret) == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+type rootsDirInfo struct{}
+
+func (rootsDirInfo) Name() string       { return "." }
+func (rootsDirInfo) Size() int64        { return 0 }
+func (rootsDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (rootsDirInfo) ModTime() time.Time { return time.Time{} }
+func (rootsDirInfo) IsDir() bool        { return true }
+func (rootsDirInfo) Sys() interface{}   { return nil }
+
+// A root's top-level directory.
+type rootFile struct {
+	fs.File
+	name string
+}
+
+func (me rootFile) Stat() (fs.FileInfo, error) {
+	fi, err := me.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{fi, me.name}, nil
+}
+
+func (me rootFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := me.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: me.name, Err: errors.New("not implemented")}
+	}
+	return d.ReadDir(n)
+}
+
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (me namedFileInfo) Name() string {
+	return me.name
+}
@@ -0,0 +1,89 @@
+package dms
+
+import (
+	"encoding/xml"
+	"io/fs"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRoots(t *testing.T) {
+	roots, err := initRoots([]Root{
+		{Path: filepath.FromSlash("/srv/Music"), FS: fstest.MapFS{
+			"Album/01 Song.mp3": {},
+		}},
+		{Name: "Films", Path: filepath.FromSlash("/srv/video"), FS: fstest.MapFS{
+			"Film.mp4":        {},
+			"Extras/Bits.mp4": {},
+		}, IgnorePaths: []string{"Extras"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{NoProbe: true, Roots: roots, FS: rootsFS(roots)}
+	cds := &contentDirectoryService{Server: srv}
+	r := httptest.NewRequest("POST", "/ctl", nil)
+	ret, err := cds.Handle("Browse", []byte("<Browse><ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag></Browse>"), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var didl struct {
+		Containers []struct {
+			ID    string `xml:"id,attr"`
+			Title string `xml:"title"`
+		} `xml:"container"`
+	}
+	if err := xml.Unmarshal([]byte(ret[0][1]), &didl); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, c := range didl.Containers {
+		titles = append(titles, c.Title)
+	}
+	if got := strings.Join(titles, ","); got != "Films,Music" {
+		t.Fatal(got)
+	}
+	if p, err := srv.objectIDPath(didl.Containers[0].ID); err != nil || p != "Films" {
+		t.Fatal(p, err)
+	}
+
+	if _, err := fs.Stat(srv.FS, "Music/Album/01 Song.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(srv.FS, "Nothing/Film.mp4"); err == nil {
+		t.Fatal("expected error for unknown root")
+	}
+	if got := srv.osPath("Films/Film.mp4"); got != filepath.FromSlash("/srv/video/Film.mp4") {
+		t.Fatal(got)
+	}
+	if got := srv.osPath("."); got != "" {
+		t.Fatal(got)
+	}
+	if p, ok := srv.fsPath(filepath.FromSlash("/srv/Music/Album")); !ok || p != "Music/Album" {
+		t.Fatal(p, ok)
+	}
+	if _, ok := srv.fsPath(filepath.FromSlash("/srv/other")); ok {
+		t.Fatal("expected path outside the roots not to map")
+	}
+
+	// A root's ignore rules don't apply to the others.
+	if ignored, _ := srv.IgnorePath("Films/Extras/Bits.mp4"); !ignored {
+		t.Fatal("expected path ignored by its root")
+	}
+	if ignored, _ := srv.IgnorePath("Music/Album/01 Song.mp3"); ignored {
+		t.Fatal("path unexpectedly ignored")
+	}
+
+	for _, bad := range [][]Root{
+		{{Path: "/a/x"}, {Path: "/b/x"}},
+		{{Name: "a/b", Path: "/a"}},
+		{{Name: "x"}},
+	} {
+		if _, err := initRoots(bad); err == nil {
+			t.Fatal("expected error for", bad)
+		}
+	}
+}
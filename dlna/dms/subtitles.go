@@ -0,0 +1,474 @@
+package dms
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/transcode"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Subtitles are served as /subtitle?path=<video>&file=<name> for files beside
+// the video, or &stream=<index> for text streams embedded in it. A format of
+// srt or vtt converts them. Transcodes from /res render them into the video
+// when given subtitleFile=<name> or subtitleStream=<index>, for clients that
+// don't show subtitles.
+
+// The subtitle file extensions, and the formats they're in.
+var subtitleExts = map[string]string{
+	".srt": "srt",
+	".vtt": "vtt",
+	".ass": "ass",
+	".ssa": "ssa",
+	".sub": "sub",
+}
+
+var subtitleMimeTypes = map[string]string{
+	"srt": "text/srt",
+	"vtt": "text/vtt",
+	"ass": "text/x-ssa",
+	"ssa": "text/x-ssa",
+	"sub": "text/x-microdvd",
+}
+
+// The embedded subtitle codecs ffmpeg can write as text. Bitmap subtitles,
+// such as DVD and Blu-ray ones, can't be.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"ass":      true,
+	"ssa":      true,
+	"webvtt":   true,
+	"mov_text": true,
+	"text":     true,
+}
+
+// The ffmpeg muxers for the formats ffmpeg converts subtitles to.
+var subtitleMuxers = map[string]string{
+	"srt": "srt",
+	"vtt": "webvtt",
+}
+
+// Matches the language part of subtitle file names, such as "en", "eng" or
+// "pt-BR".
+var subtitleLanguageRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+// A subtitle track of a video.
+type subtitle struct {
+	// The name of the file beside the video, or "" if it's embedded.
+	file string
+	// The index of the embedded stream.
+	stream int
+	// The index of the embedded stream among the video's subtitle streams,
+	// which is how ffmpeg's subtitles filter selects it.
+	subtitleIndex int
+	// The format it's offered in by default. Embedded subtitles are
+	// extracted as SRT.
+	format   string
+	language string
+	forced   bool
+}
+
+// Parses the name of a subtitle file for the named video, such as movie.srt,
+// movie.en.srt or movie.de.forced.srt for movie.mkv.
+func parseSubtitleName(video, name string) (s subtitle, ok bool) {
+	base := strings.TrimSuffix(video, path.Ext(video))
+	rest, ok := strings.CutPrefix(name, base)
+	if !ok {
+		return
+	}
+	ext := strings.ToLower(path.Ext(rest))
+	s.format, ok = subtitleExts[ext]
+	if !ok {
+		return
+	}
+	rest = strings.TrimSuffix(rest, path.Ext(rest))
+	if rest != "" && rest[0] != '.' {
+		// Another file that starts with the video's name.
+		return subtitle{}, false
+	}
+	s.file = name
+	for _, part := range strings.Split(rest, ".")[1:] {
+		switch {
+		case strings.EqualFold(part, "forced"):
+			s.forced = true
+		case subtitleLanguageRegexp.MatchString(part):
+			s.language = part
+		}
+	}
+	return
+}
+
+// Finds the subtitles of the video: files beside it named after it, and the
+// text subtitle streams in info if ffmpeg is available to extract them.
+// Files come first, those without a language or forced flag first of all.
+// The siblings are the contents of the video's directory, which are read if
+// they're nil.
+func (srv *Server) subtitles(filePath string, siblings []fs.FileInfo, info *ffprobe.Info) (ret []subtitle) {
+	dir, video := path.Split(filePath)
+	if siblings == nil {
+		// A directory that can't be read offers no subtitle files.
+		siblings, _ = srv.readDir(object{path.Clean(dir), srv.RootObjectPath})
+	}
+	names := make(map[string]bool, len(siblings))
+	for _, fi := range siblings {
+		names[fi.Name()] = true
+	}
+	for _, fi := range siblings {
+		s, ok := parseSubtitleName(video, fi.Name())
+		if !ok || !fi.Mode().IsRegular() {
+			continue
+		}
+		if s.format == "sub" && names[strings.TrimSuffix(fi.Name(), path.Ext(fi.Name()))+".idx"] {
+			// VobSub, which is bitmaps.
+			continue
+		}
+		ret = append(ret, s)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if (a.language == "") != (b.language == "") {
+			return a.language == ""
+		}
+		if a.forced != b.forced {
+			return !a.forced
+		}
+		return a.file < b.file
+	})
+	if info == nil || !srv.tools.ffmpeg.Available() {
+		return
+	}
+	subtitleIndex := -1
+	for _, strm := range info.Streams {
+		if strm["codec_type"] != "subtitle" {
+			continue
+		}
+		subtitleIndex++
+		if codec, _ := strm["codec_name"].(string); !textSubtitleCodecs[codec] {
+			continue
+		}
+		index, err := ffprobe.AnyAsFloat64(strm["index"])
+		if err != nil {
+			continue
+		}
+		s := subtitle{stream: int(index), subtitleIndex: subtitleIndex, format: "srt"}
+		if tags, ok := strm["tags"].(map[string]interface{}); ok {
+			s.language, _ = tags["language"].(string)
+		}
+		if disposition, ok := strm["disposition"].(map[string]interface{}); ok {
+			forced, err := ffprobe.AnyAsFloat64(disposition["forced"])
+			s.forced = err == nil && forced != 0
+		}
+		ret = append(ret, s)
+	}
+	return
+}
+
+// Reports whether the subtitle can be served in the format. SRT and WebVTT
+// files are converted between each other, and anything else is converted by
+// ffmpeg.
+func (srv *Server) canServeSubtitle(s subtitle, format string) bool {
+	if s.file != "" && format == s.format {
+		return true
+	}
+	if subtitleMuxers[format] == "" {
+		return false
+	}
+	if s.file != "" && subtitleMuxers[s.format] != "" {
+		return true
+	}
+	return srv.tools.ffmpeg.Available()
+}
+
+// Returns the URL of the video's subtitle, in the given format.
+func subtitleURL(host, objectPath string, s subtitle, format string) string {
+	q := url.Values{
+		"path":   {objectPath},
+		"format": {format},
+	}
+	if s.file != "" {
+		q.Set("file", s.file)
+	} else {
+		q.Set("stream", strconv.Itoa(s.stream))
+	}
+	return (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     subtitlePath,
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// Returns the URL of the subtitle Samsung TVs are given, which must be SRT.
+// They only take one.
+func (srv *Server) captionInfoURL(host, objectPath string, subs []subtitle) (string, bool) {
+	for _, s := range subs {
+		if srv.canServeSubtitle(s, "srt") {
+			return subtitleURL(host, objectPath, s, "srt"), true
+		}
+	}
+	return "", false
+}
+
+// Adds the video's subtitles to the item, in the way the client takes them.
+func (srv *Server) addSubtitles(item *upnpav.Item, c client, objectPath string, subs []subtitle) {
+	switch c.profile.subtitleMode() {
+	case SubtitleModeNone:
+	case SubtitleModeSamsung:
+		if u, ok := srv.captionInfoURL(c.host, objectPath, subs); ok {
+			item.CaptionInfoEx = &upnpav.CaptionInfo{Type: "srt", URL: u}
+		}
+	default:
+		for _, s := range subs {
+			item.Res = append(item.Res, upnpav.Resource{
+				URL:          subtitleURL(c.host, objectPath, s, s.format),
+				ProtocolInfo: fmt.Sprintf("http-get:*:%s:*", subtitleMimeTypes[s.format]),
+			})
+		}
+	}
+}
+
+// Sets the CaptionInfo.sec header Samsung TVs ask for with
+// getCaptionInfo.sec when they play a video.
+func (srv *Server) setCaptionInfo(w http.ResponseWriter, r *http.Request, filePath string) {
+	if srv.deviceProfile(r).subtitleMode() == SubtitleModeNone {
+		return
+	}
+	var info *ffprobe.Info
+	if !srv.NoProbe {
+		info, _ = srv.ffmpegProbe(filePath)
+	}
+	if u, ok := srv.captionInfoURL(r.Host, r.URL.Query().Get("path"), srv.subtitles(filePath, nil, info)); ok {
+		w.Header().Set("CaptionInfo.sec", u)
+	}
+}
+
+func (me *Server) serveSubtitle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filePath := me.filePath(q.Get("path"))
+	if ignored, err := me.IgnorePath(filePath); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ignored {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	var info *ffprobe.Info
+	if q.Has("stream") && !me.NoProbe {
+		info, _ = me.ffmpegProbe(filePath)
+	}
+	s, ok := findSubtitle(me.subtitles(filePath, nil, info), q)
+	if !ok {
+		http.Error(w, "no such subtitle", http.StatusNotFound)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = s.format
+	}
+	if !me.canServeSubtitle(s, format) {
+		http.Error(w, fmt.Sprintf("can't serve %s subtitle as %s", s.format, format), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", subtitleMimeTypes[format]+"; charset=utf-8")
+	if err := me.writeSubtitle(r.Context(), w, filePath, s, format); err != nil {
+		me.Logger.Info("error serving subtitle", "path", filePath, "file", s.file, "stream", s.stream, "error", err)
+	}
+}
+
+// Returns the subtitle a request's file or stream parameter names, or the
+// first if there's neither, as in URLs from before there could be several.
+func findSubtitle(subs []subtitle, q url.Values) (subtitle, bool) {
+	for _, s := range subs {
+		switch {
+		case q.Has("file"):
+			if s.file != "" && s.file == q.Get("file") {
+				return s, true
+			}
+		case q.Has("stream"):
+			if s.file == "" && strconv.Itoa(s.stream) == q.Get("stream") {
+				return s, true
+			}
+		default:
+			return s, true
+		}
+	}
+	return subtitle{}, false
+}
+
+// Returns the subtitle a /res request asks to have rendered into the video
+// with its subtitleFile or subtitleStream parameter, if it asks for one.
+func (srv *Server) burnSubtitle(filePath string, q url.Values) (s subtitle, ok bool, err error) {
+	sq := url.Values{}
+	switch {
+	case q.Has("subtitleFile"):
+		sq.Set("file", q.Get("subtitleFile"))
+	case q.Has("subtitleStream"):
+		sq.Set("stream", q.Get("subtitleStream"))
+	default:
+		return
+	}
+	var info *ffprobe.Info
+	if sq.Has("stream") && !srv.NoProbe {
+		info, _ = srv.ffmpegProbe(filePath)
+	}
+	s, ok = findSubtitle(srv.subtitles(filePath, nil, info), sq)
+	if !ok {
+		err = errors.New("no such subtitle")
+	}
+	return
+}
+
+// Returns the transcode profile p with the video's subtitle rendered into
+// it.
+func (srv *Server) burnSubtitles(p *transcode.Profile, filePath string, s subtitle) transcode.Profile {
+	if s.file != "" {
+		return p.BurnSubtitles(transcode.Subtitles{
+			File:   srv.osPath(path.Join(path.Dir(filePath), s.file)),
+			Stream: -1,
+		})
+	}
+	return p.BurnSubtitles(transcode.Subtitles{Stream: s.subtitleIndex})
+}
+
+// Adds the subtitle to a /res query, to have it rendered into the video.
+func (s subtitle) setBurnQuery(q url.Values) {
+	if s.file != "" {
+		q.Set("subtitleFile", s.file)
+	} else {
+		q.Set("subtitleStream", strconv.Itoa(s.stream))
+	}
+}
+
+// Distinguishes transcodes of a video with the subtitle rendered into it.
+func (s subtitle) burnName() string {
+	if s.file != "" {
+		return "subtitles-" + s.file
+	}
+	return "subtitles-" + strconv.Itoa(s.stream)
+}
+
+// Writes the video's subtitle in the format.
+func (srv *Server) writeSubtitle(ctx context.Context, w io.Writer, filePath string, s subtitle, format string) error {
+	if s.file == "" || subtitleMuxers[s.format] == "" && format != s.format {
+		input := srv.osPath(filePath)
+		args := []string{"-v", "error"}
+		if s.file == "" {
+			args = append(args, "-i", input, "-map", fmt.Sprintf("0:%d", s.stream))
+		} else {
+			args = append(args, "-i", filepath.Join(filepath.Dir(input), s.file))
+		}
+		args = append(args, "-f", subtitleMuxers[format], "pipe:")
+		cmd := exec.CommandContext(ctx, srv.tools.ffmpeg.Path, args...)
+		cmd.Stdout = w
+		return cmd.Run()
+	}
+	f, err := srv.FS.Open(path.Join(path.Dir(filePath), s.file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch {
+	case format == s.format:
+		_, err = io.Copy(w, f)
+	case format == "vtt":
+		err = srtToVTT(w, f)
+	default:
+		err = vttToSRT(w, f)
+	}
+	return err
+}
+
+// Converts SRT to WebVTT. The cue numbers are kept as cue identifiers.
+func srtToVTT(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n\n")
+	s := bufio.NewScanner(r)
+	first := true
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		if strings.Contains(line, "-->") {
+			line = strings.ReplaceAll(line, ",", ".")
+		}
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Converts WebVTT to SRT. Cues are renumbered, their settings dropped, and
+// the header, notes, styles and regions left out.
+func vttToSRT(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	s := bufio.NewScanner(r)
+	var block []string
+	n := 0
+	writeBlock := func() {
+		defer func() { block = block[:0] }()
+		timing := -1
+		for i, line := range block {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			// The header, or a NOTE, STYLE or REGION block.
+			return
+		}
+		fields := strings.Fields(block[timing])
+		if len(fields) < 3 {
+			return
+		}
+		n++
+		fmt.Fprintf(bw, "%d\n%s --> %s\n", n, vttTimeToSRT(fields[0]), vttTimeToSRT(fields[2]))
+		for _, line := range block[timing+1:] {
+			bw.WriteString(line)
+			bw.WriteByte('\n')
+		}
+		bw.WriteByte('\n')
+	}
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" {
+			writeBlock()
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	writeBlock()
+	return bw.Flush()
+}
+
+// Converts a WebVTT timestamp, such as "01:02.500", to SRT's
+// "00:01:02,500".
+func vttTimeToSRT(t string) string {
+	if strings.Count(t, ":") == 1 {
+		t = "00:" + t
+	}
+	return strings.Replace(t, ".", ",", 1)
+}
@@ -0,0 +1,197 @@
+package dms
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/transcode"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestParseSubtitleName(t *testing.T) {
+	for name, expected := range map[string]subtitle{
+		"movie.srt":           {file: "movie.srt", format: "srt"},
+		"movie.en.vtt":        {file: "movie.en.vtt", format: "vtt", language: "en"},
+		"movie.de.forced.srt": {file: "movie.de.forced.srt", format: "srt", language: "de", forced: true},
+		"movie.pt-BR.ASS":     {file: "movie.pt-BR.ASS", format: "ass", language: "pt-BR"},
+	} {
+		if s, ok := parseSubtitleName("movie.mkv", name); !ok || s != expected {
+			t.Errorf("%s: got %+v, %v", name, s, ok)
+		}
+	}
+	for _, name := range []string{"movie.mkv", "movie2.srt", "other.srt", "movie.nfo"} {
+		if s, ok := parseSubtitleName("movie.mkv", name); ok {
+			t.Errorf("%s: got %+v", name, s)
+		}
+	}
+}
+
+func TestSubtitles(t *testing.T) {
+	srv := &Server{FS: fstest.MapFS{
+		"Movies/movie.mkv":           {},
+		"Movies/movie.en.srt":        {},
+		"Movies/movie.de.forced.srt": {},
+		"Movies/movie.srt":           {Data: []byte("1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\n")},
+		"Movies/movie.sub":           {},
+		"Movies/movie.idx":           {},
+		"Movies/other.mkv":           {},
+	}}
+	info := &ffprobe.Info{Streams: []map[string]interface{}{
+		{"index": json.Number("0"), "codec_type": "video"},
+		{"index": json.Number("2"), "codec_type": "subtitle", "codec_name": "subrip", "tags": map[string]interface{}{"language": "fre"}},
+		{"index": json.Number("3"), "codec_type": "subtitle", "codec_name": "hdmv_pgs_subtitle"},
+	}}
+	files := func(subs []subtitle) (ret []string) {
+		for _, s := range subs {
+			ret = append(ret, s.file+"#"+s.language)
+		}
+		return
+	}
+	// Without ffmpeg, embedded subtitles can't be extracted. VobSub is left
+	// out.
+	if got := strings.Join(files(srv.subtitles("Movies/movie.mkv", nil, info)), " "); got != "movie.srt# movie.en.srt#en movie.de.forced.srt#de" {
+		t.Fatal(got)
+	}
+	if subs := srv.subtitles("Movies/other.mkv", nil, info); len(subs) != 0 {
+		t.Fatal(subs)
+	}
+	// A listing of the directory given by the caller is used instead of
+	// reading it.
+	siblings, err := srv.readDir(object{"Movies", srv.RootObjectPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(files((&Server{FS: fstest.MapFS{}}).subtitles("Movies/movie.mkv", siblings, nil)), " "); got != "movie.srt# movie.en.srt#en movie.de.forced.srt#de" {
+		t.Fatal(got)
+	}
+	srv.tools.ffmpeg.Path = "ffmpeg"
+	subs := srv.subtitles("Movies/movie.mkv", nil, info)
+	if len(subs) != 4 || subs[3].file != "" || subs[3].stream != 2 || subs[3].language != "fre" {
+		t.Fatal(subs)
+	}
+
+	var b strings.Builder
+	if err := srv.writeSubtitle(t.Context(), &b, "Movies/movie.mkv", subs[0], "vtt"); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello\n" {
+		t.Fatalf("%q", b.String())
+	}
+}
+
+func TestSamsungCaptionInfo(t *testing.T) {
+	srv := &Server{FS: fstest.MapFS{
+		"movie.mkv":    {},
+		"movie.en.vtt": {},
+	}}
+	item := upnpav.Item{}
+	c := client{host: "dms:1338", profile: &DeviceProfile{SubtitleMode: SubtitleModeSamsung}}
+	srv.addSubtitles(&item, c, "movie.mkv", srv.subtitles("movie.mkv", nil, nil))
+	if len(item.Res) != 0 {
+		t.Fatal(item.Res)
+	}
+	out, err := xml.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The WebVTT file is converted, since Samsung TVs take SRT.
+	expected := `<sec:CaptionInfoEx sec:type="srt">http://dms:1338/subtitle?file=movie.en.vtt&amp;format=srt&amp;path=movie.mkv</sec:CaptionInfoEx>`
+	if !strings.Contains(string(out), expected) {
+		t.Fatal(string(out))
+	}
+	c.profile = &DeviceProfile{}
+	srv.addSubtitles(&item, c, "movie.mkv", srv.subtitles("movie.mkv", nil, nil))
+	if len(item.Res) != 1 || item.Res[0].ProtocolInfo != "http-get:*:text/vtt:*" {
+		t.Fatal(item.Res)
+	}
+}
+
+func TestVTTToSRT(t *testing.T) {
+	vtt := "WEBVTT - a film\n\n" +
+		"NOTE made by hand\n\n" +
+		"intro\n00:01.000 --> 00:02.000 align:start\nHello\nthere\n\n" +
+		"01:00:03.250 --> 01:00:04.000\nBye\n"
+	var b strings.Builder
+	if err := vttToSRT(&b, strings.NewReader(vtt)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "1\n00:00:01,000 --> 00:00:02,000\nHello\nthere\n\n" +
+		"2\n01:00:03,250 --> 01:00:04,000\nBye\n\n"
+	if b.String() != expected {
+		t.Fatalf("%q", b.String())
+	}
+}
+
+func TestBurnSubtitles(t *testing.T) {
+	srv := &Server{rootPath: "/media", FS: fstest.MapFS{
+		"Movies/movie.mkv":    {},
+		"Movies/movie.en.srt": {},
+	}}
+	srv.tools.ffmpeg.Path = "ffmpeg"
+	info := &ffprobe.Info{Streams: []map[string]interface{}{
+		{"index": json.Number("0"), "codec_type": "video"},
+		{"index": json.Number("1"), "codec_type": "subtitle", "codec_name": "hdmv_pgs_subtitle"},
+		{"index": json.Number("2"), "codec_type": "subtitle", "codec_name": "ass"},
+	}}
+	c := client{host: "dms:1338", profile: &DeviceProfile{}}
+	var burned []string
+	for _, res := range srv.transcodeResources(c, "Movies/movie.mkv", "video/x-matroska", info, srv.subtitles("Movies/movie.mkv", nil, info), "", "") {
+		if strings.Contains(res.URL, "subtitle") {
+			burned = append(burned, res.URL)
+		}
+	}
+	// One for each subtitle, in the first profile that encodes video.
+	if strings.Join(burned, " ") != "http://dms:1338/res?path=Movies%2Fmovie.mkv&subtitleFile=movie.en.srt&transcode=t "+
+		"http://dms:1338/res?path=Movies%2Fmovie.mkv&subtitleStream=2&transcode=t" {
+		t.Fatal(burned)
+	}
+	c.profile = &DeviceProfile{SubtitleMode: SubtitleModeNone}
+	for _, res := range srv.transcodeResources(c, "Movies/movie.mkv", "video/x-matroska", info, srv.subtitles("Movies/movie.mkv", nil, info), "", "") {
+		if strings.Contains(res.URL, "subtitle") {
+			t.Fatal(res.URL)
+		}
+	}
+
+	s, ok, err := srv.burnSubtitle("Movies/movie.mkv", url.Values{"subtitleFile": {"movie.en.srt"}})
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	p := srv.burnSubtitles(&transcode.DefaultProfiles[2], "Movies/movie.mkv", s)
+	if args := strings.Join(p.ExpandArgs("/media/Movies/movie.mkv", 0, 0), " "); !strings.Contains(args, "subtitles=filename=/media/Movies/movie.en.srt ") {
+		t.Fatal(args)
+	}
+	if _, _, err := srv.burnSubtitle("Movies/movie.mkv", url.Values{"subtitleFile": {"movie.de.srt"}}); err == nil {
+		t.Fatal("found missing subtitle")
+	}
+	if _, ok, err := srv.burnSubtitle("Movies/movie.mkv", url.Values{}); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	// Embedded subtitles are selected among the subtitle streams.
+	p = srv.burnSubtitles(&transcode.DefaultProfiles[2], "Movies/movie.mkv", srv.subtitles("Movies/movie.mkv", nil, info)[1])
+	if args := strings.Join(p.ExpandArgs("/media/Movies/movie.mkv", 0, 0), " "); !strings.Contains(args, "subtitles=filename=/media/Movies/movie.mkv:si=1 ") {
+		t.Fatal(args)
+	}
+}
+
+func TestServeSubtitleIgnored(t *testing.T) {
+	srv := &Server{
+		FS: fstest.MapFS{
+			"Videos/Private/film.mp4": {},
+			"Videos/Private/film.srt": {Data: []byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n")},
+		},
+		IgnorePaths: []string{"Private"},
+	}
+	w := httptest.NewRecorder()
+	srv.serveSubtitle(w, httptest.NewRequest("GET", "/subtitle?path=Videos%2FPrivate%2Ffilm.mp4", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal(w.Code)
+	}
+}
@@ -0,0 +1,537 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+	"github.com/nfnt/resize"
+
+	"github.com/anacrolix/dms/exif"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Thumbnails are served as /icon?path=<path>&pn=<profile>, in the DLNA image
+// profiles below. Images are scaled in Go, videos have a frame grabbed by
+// ffmpeg, and audio uses its embedded or folder art. They're cached on disk,
+// keyed by the source's path, modification time and size, so they're only
+// made again when it changes. Photos are also offered in the larger sizes,
+// upright and converted to JPEG, for clients that can't handle the original.
+
+// A DLNA image profile thumbnails are made in, and the largest dimensions it
+// allows.
+type thumbnailSize struct {
+	Profile       string
+	Width, Height int
+}
+
+var thumbnailSizes = []thumbnailSize{
+	{"JPEG_TN", 160, 160},
+	{"JPEG_SM", 640, 480},
+}
+
+// The sizes photos are offered in as well as their thumbnails.
+var photoSizes = []thumbnailSize{
+	{"JPEG_MED", 1024, 768},
+	{"JPEG_LRG", 4096, 4096},
+}
+
+// Changed when thumbnails are made differently, so that those already cached
+// are made again.
+const thumbnailVersion = 2
+
+// Returns the thumbnail size for the DLNA profile name. The smallest is used
+// if it's empty.
+func thumbnailSizeByProfile(pn string) (thumbnailSize, bool) {
+	if pn == "" {
+		return thumbnailSizes[0], true
+	}
+	for _, sizes := range [][]thumbnailSize{thumbnailSizes, photoSizes} {
+		for _, size := range sizes {
+			if size.Profile == pn {
+				return size, true
+			}
+		}
+	}
+	return thumbnailSize{}, false
+}
+
+// The image types clients generally show. Photos in others, such as HEIC,
+// WebP and camera raw files, are offered as JPEG first. They're also the types
+// Go decodes; the others need ffmpeg.
+var displayableImageTypes = map[mimeType]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Returned for files there's no way to make a thumbnail of.
+var errNoThumbnail = errors.New("no thumbnail for file")
+
+// DefaultThumbnailCacheSize is the disk space cached thumbnails may use if
+// Server.ThumbnailCacheSize isn't set.
+const DefaultThumbnailCacheSize = 1 << 30
+
+type thumbnailCache struct {
+	dir     string
+	maxSize int64
+	// Limits the thumbnails made at once.
+	workers chan struct{}
+
+	mu sync.Mutex
+	// Thumbnails being made, by key.
+	pending map[string]*thumbnailJob
+	// The cached thumbnails, by key.
+	files map[string]*thumbnailFile
+	// The total size of the cached thumbnails.
+	size int64
+}
+
+type thumbnailJob struct {
+	// Closed once the thumbnail is made.
+	done chan struct{}
+	err  error
+}
+
+type thumbnailFile struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// Opens the thumbnail cache in dir, taking in the thumbnails cached there
+// before, which are treated as last used when they were made.
+func newThumbnailCache(dir string, maxSize int64, workers int) (*thumbnailCache, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "dms-thumbnails")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultThumbnailCacheSize
+	}
+	tc := &thumbnailCache{
+		dir:     dir,
+		maxSize: maxSize,
+		workers: make(chan struct{}, workers),
+		pending: make(map[string]*thumbnailJob),
+		files:   make(map[string]*thumbnailFile),
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range des {
+		key, ok := strings.CutSuffix(de.Name(), ".jpg")
+		if !ok || !de.Type().IsRegular() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		tc.files[key] = &thumbnailFile{size: fi.Size(), lastUsed: fi.ModTime()}
+		tc.size += fi.Size()
+	}
+	tc.evict("")
+	return tc, nil
+}
+
+// Returns the cache key for a thumbnail in the given size, from the source
+// with the file info.
+func thumbnailKey(src thumbnailSource, fi fs.FileInfo, size thumbnailSize) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%d\x00%s\x00%d\x00%d\x00%d\x00%s", thumbnailVersion, src.path, src.stream, fi.ModTime().UnixNano(), fi.Size(), size.Profile))))
+}
+
+// Returns the file of the cached thumbnail with the key, calling create to
+// make it if it isn't cached. Concurrent calls for a key share one create.
+func (tc *thumbnailCache) get(ctx context.Context, key string, create func() ([]byte, error)) (string, error) {
+	file := filepath.Join(tc.dir, key+".jpg")
+	tc.mu.Lock()
+	job, ok := tc.pending[key]
+	if !ok {
+		if _, err := os.Stat(file); err == nil {
+			if f, ok := tc.files[key]; ok {
+				f.lastUsed = time.Now()
+			}
+			tc.mu.Unlock()
+			return file, nil
+		}
+		job = &thumbnailJob{done: make(chan struct{})}
+		tc.pending[key] = job
+		go tc.create(key, file, job, create)
+	}
+	tc.mu.Unlock()
+	select {
+	case <-job.done:
+		return file, job.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (tc *thumbnailCache) create(key, file string, job *thumbnailJob, create func() ([]byte, error)) {
+	tc.workers <- struct{}{}
+	b, err := create()
+	<-tc.workers
+	if err == nil {
+		err = writeFileAtomic(file, b)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.pending, key)
+	if err == nil {
+		if f, ok := tc.files[key]; ok {
+			// The file was removed from beneath the cache.
+			tc.size -= f.size
+		}
+		tc.files[key] = &thumbnailFile{size: int64(len(b)), lastUsed: time.Now()}
+		tc.size += int64(len(b))
+		tc.evict(key)
+	}
+	job.err = err
+	close(job.done)
+}
+
+// Removes the least recently used thumbnails, other than the one with the
+// key to keep, until the cache is within its size limit. tc.mu must be held.
+func (tc *thumbnailCache) evict(keep string) {
+	for tc.size > tc.maxSize {
+		var (
+			oldest    *thumbnailFile
+			oldestKey string
+		)
+		for key, f := range tc.files {
+			if key == keep {
+				continue
+			}
+			if oldest == nil || f.lastUsed.Before(oldest.lastUsed) {
+				oldest, oldestKey = f, key
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(tc.files, oldestKey)
+		tc.size -= oldest.size
+		os.Remove(filepath.Join(tc.dir, oldestKey+".jpg"))
+	}
+}
+
+// Writes the file through a temporary file, so it's never seen partially
+// written.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "partial-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// What a thumbnail is made from.
+type thumbnailSource struct {
+	// The file, relative to the media root.
+	path     string
+	mimeType mimeType
+	// The index of the embedded art stream in an audio file, or -1.
+	stream int
+}
+
+// Finds what a thumbnail of the file can be made from: images themselves, a
+// frame of videos, and the embedded art of audio, or the art of its folder.
+// Videos and embedded art need ffmpeg. The siblings are the contents of the
+// file's directory, which are read if they're nil.
+func (srv *Server) thumbnailSource(filePath string, mt mimeType, info *ffprobe.Info, siblings []fs.FileInfo) (src thumbnailSource, ok bool) {
+	src = thumbnailSource{path: filePath, mimeType: mt, stream: -1}
+	switch {
+	case mt.IsImage():
+		return src, srv.canDecodeImage(mt)
+	case mt.IsVideo():
+		return src, srv.tools.ffmpeg.Available()
+	case mt.IsAudio():
+		if stream, ok := embeddedArtStream(info); ok && srv.tools.ffmpeg.Available() {
+			src.stream = stream
+			return src, true
+		}
+		dir := path.Dir(filePath)
+		if siblings == nil {
+			siblings, _ = srv.readDir(object{dir, srv.RootObjectPath})
+		}
+		if name, ok := folderArt(siblings); ok {
+			artPath := path.Join(dir, name)
+			artType, err := srv.mimeTypeByPath(artPath)
+			return thumbnailSource{path: artPath, mimeType: artType, stream: -1}, err == nil && srv.canDecodeImage(artType)
+		}
+	}
+	return src, false
+}
+
+// Reports whether thumbnails can be made of images of the type.
+func (srv *Server) canDecodeImage(mt mimeType) bool {
+	return displayableImageTypes[mt] || srv.tools.ffmpeg.Available()
+}
+
+// Returns the URL of the object's thumbnail in the given size.
+func thumbnailURL(host, objectPath string, size thumbnailSize) string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   host,
+		Path:   iconPath,
+		RawQuery: url.Values{
+			"path": {objectPath},
+			"pn":   {size.Profile},
+		}.Encode(),
+	}).String()
+}
+
+func thumbnailResource(host, objectPath string, size thumbnailSize) upnpav.Resource {
+	return upnpav.Resource{
+		URL:          thumbnailURL(host, objectPath, size),
+		ProtocolInfo: "http-get:*:image/jpeg:DLNA.ORG_PN=" + size.Profile,
+		ProfileID:    size.Profile,
+	}
+}
+
+// Returns the resources of a photo in each of the photoSizes.
+func photoResources(host, objectPath string) (ret []upnpav.Resource) {
+	for _, size := range photoSizes {
+		ret = append(ret, thumbnailResource(host, objectPath, size))
+	}
+	return
+}
+
+func (me *Server) serveIcon(w http.ResponseWriter, r *http.Request) {
+	filePath := me.filePath(r.URL.Query().Get("path"))
+	if ignored, err := me.IgnorePath(filePath); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ignored {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	size, ok := thumbnailSizeByProfile(r.URL.Query().Get("pn"))
+	if !ok {
+		http.Error(w, "unknown thumbnail profile", http.StatusBadRequest)
+		return
+	}
+	file, err := me.thumbnail(r.Context(), filePath, size)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if !errors.Is(err, errNoThumbnail) {
+			me.Logger.Info("error making thumbnail", "path", filePath, "error", err)
+		}
+		// serve 1st Icon if there's no thumbnail
+		w.Header().Set("Content-Type", me.Icons[0].Mimetype)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(me.Icons[0].Bytes))
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, file)
+}
+
+// Returns the file of the thumbnail of the media file in the given size,
+// making it if it isn't cached.
+func (srv *Server) thumbnail(ctx context.Context, filePath string, size thumbnailSize) (string, error) {
+	mt, err := srv.mimeTypeByPath(filePath)
+	if err != nil {
+		return "", err
+	}
+	var info *ffprobe.Info
+	if mt.IsAudio() && !srv.NoProbe {
+		// Only needed to find embedded art.
+		info, _ = srv.ffmpegProbe(filePath)
+	}
+	src, ok := srv.thumbnailSource(filePath, mt, info, nil)
+	if !ok {
+		return "", errNoThumbnail
+	}
+	fi, err := srv.stat(src.path)
+	if err != nil {
+		return "", err
+	}
+	return srv.thumbnails.get(ctx, thumbnailKey(src, fi, size), func() ([]byte, error) {
+		return srv.makeThumbnail(src, size)
+	})
+}
+
+// Makes a JPEG thumbnail from the source that fits in the given size, the
+// right way up.
+func (srv *Server) makeThumbnail(src thumbnailSource, size thumbnailSize) ([]byte, error) {
+	img, err := srv.thumbnailImage(src, size)
+	if err != nil {
+		return nil, err
+	}
+	// It's scaled before it's turned, as that's much cheaper for large
+	// photos.
+	orientation := srv.imageOrientation(src)
+	width, height := size.Width, size.Height
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	img = orient(resize.Thumbnail(uint(width), uint(height), img, resize.Lanczos3), orientation)
+	var b bytes.Buffer
+	err = jpeg.Encode(&b, img, &jpeg.Options{Quality: 85})
+	return b.Bytes(), err
+}
+
+// Returns the image a thumbnail is made from.
+func (srv *Server) thumbnailImage(src thumbnailSource, size thumbnailSize) (image.Image, error) {
+	input := srv.osPath(src.path)
+	switch {
+	case src.mimeType.IsImage():
+		img, err := srv.decodeImage(src.path)
+		if !errors.Is(err, image.ErrFormat) || !srv.tools.ffmpeg.Available() {
+			return img, err
+		}
+		// Go can't decode it, but ffmpeg might.
+		return grabFrame(srv.tools.ffmpeg.Path, input, 0, -1, size)
+	case src.stream >= 0:
+		return grabFrame(srv.tools.ffmpeg.Path, input, 0, src.stream, size)
+	}
+	return grabFrame(srv.tools.ffmpeg.Path, input, srv.thumbnailTime(src.path), -1, size)
+}
+
+func (srv *Server) decodeImage(filePath string) (image.Image, error) {
+	f, err := srv.FS.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// Returns the EXIF orientation of the source, if it's a JPEG that has one.
+func (srv *Server) imageOrientation(src thumbnailSource) int {
+	if src.mimeType != "image/jpeg" {
+		return 1
+	}
+	f, err := srv.FS.Open(src.path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 1
+	}
+	return x.Orientation
+}
+
+// Transforms the image as the EXIF orientation says to, so that it's
+// upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored.
+				dx, dy = w-1-x, y
+			case 3: // Upside down.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Upside down and mirrored.
+				dx, dy = x, h-1-y
+			case 5: // Transposed.
+				dx, dy = y, x
+			case 6: // Turned anticlockwise, so it's turned clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Transversed.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Turned clockwise.
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// Returns when in a video to grab the thumbnail frame: a tenth of the way
+// in, or at random if DMS_THUMBNAIL_RANDOM is set.
+func (srv *Server) thumbnailTime(filePath string) time.Duration {
+	info, err := srv.ffmpegProbe(filePath)
+	if err != nil || info == nil {
+		return 0
+	}
+	duration, err := info.Duration()
+	if err != nil || duration <= 0 {
+		return 0
+	}
+	if _, ok := os.LookupEnv("DMS_THUMBNAIL_RANDOM"); ok {
+		return time.Duration(rand.Int63n(int64(duration)))
+	}
+	return duration / 10
+}
+
+// Has ffmpeg decode a frame of the input at the given time, scaled to fit
+// the size. The frame is from the stream with the given index, or the best
+// video stream if it's negative.
+func grabFrame(ffmpeg, input string, at time.Duration, stream int, size thumbnailSize) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	args := []string{
+		"-v", "error",
+		"-ss", strconv.FormatFloat(at.Seconds(), 'f', 3, 64),
+		"-i", input,
+	}
+	if stream >= 0 {
+		args = append(args, "-map", fmt.Sprintf("0:%d", stream))
+	}
+	args = append(args,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size.Width, size.Height),
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"pipe:")
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if lines := strings.Split(strings.TrimSpace(stderr.String()), "\n"); lines[len(lines)-1] != "" {
+			err = fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
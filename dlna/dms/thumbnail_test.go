@@ -0,0 +1,245 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+func TestThumbnailCache(t *testing.T) {
+	tc, err := newThumbnailCache(t.TempDir(), 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu      sync.Mutex
+		creates int
+	)
+	create := func() ([]byte, error) {
+		mu.Lock()
+		creates++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return []byte("jpeg"), nil
+	}
+	// Concurrent requests share one create, and later ones hit the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tc.get(context.Background(), "a", create); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	file, err := tc.get(context.Background(), "a", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(file); string(b) != "jpeg" || creates != 1 {
+		t.Fatal(string(b), creates)
+	}
+	// Failures aren't cached.
+	fail := errors.New("no frame")
+	for i := 0; i < 2; i++ {
+		if _, err := tc.get(context.Background(), "b", func() ([]byte, error) {
+			creates++
+			return nil, fail
+		}); err != fail {
+			t.Fatal(err)
+		}
+	}
+	if creates != 3 {
+		t.Fatal(creates)
+	}
+}
+
+func TestThumbnailCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	tc, err := newThumbnailCache(dir, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creates := 0
+	get := func(key string) {
+		t.Helper()
+		if _, err := tc.get(context.Background(), key, func() ([]byte, error) {
+			creates++
+			return []byte("jpeg"), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("a")
+	get("b")
+	get("a")
+	// The third exceeds the size limit, so the least recently used is
+	// removed and has to be made again.
+	get("c")
+	get("a")
+	get("b")
+	if creates != 4 || tc.size != 8 {
+		t.Fatal(creates, tc.size)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.jpg")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Thumbnails cached before count toward the limit.
+	tc, err = newThumbnailCache(dir, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tc.files) != 1 || tc.size != 4 {
+		t.Fatal(len(tc.files), tc.size)
+	}
+}
+
+func TestImageThumbnail(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{FS: fstest.MapFS{"wide.png": {Data: b.Bytes()}}}
+	for pn, expected := range map[string]image.Point{
+		"JPEG_TN":  {160, 80},
+		"JPEG_SM":  {640, 320},
+		"JPEG_MED": {1000, 500},
+		// Photos aren't made any larger.
+		"JPEG_LRG": {1000, 500},
+	} {
+		size, ok := thumbnailSizeByProfile(pn)
+		if !ok {
+			t.Fatal(pn)
+		}
+		out, err := srv.makeThumbnail(thumbnailSource{path: "wide.png", mimeType: "image/png", stream: -1}, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Size() != expected {
+			t.Errorf("%s: got %v", pn, img.Bounds().Size())
+		}
+	}
+	if _, ok := thumbnailSizeByProfile("JPEG_HUGE"); ok {
+		t.Fatal("unknown profile accepted")
+	}
+}
+
+func TestThumbnailSource(t *testing.T) {
+	srv := &Server{FS: fstest.MapFS{
+		"Music/Album/01.mp3":     {},
+		"Music/Album/Cover.JPG":  {},
+		"Music/Album/folder.jpg": {},
+		"Music/Single/01.mp3":    {},
+		"Videos/film.mp4":        {},
+		"Videos/poster.jpg":      {},
+	}}
+	src, ok := srv.thumbnailSource("Music/Album/01.mp3", "audio/mpeg", nil, nil)
+	if !ok || src.path != "Music/Album/Cover.JPG" || !src.mimeType.IsImage() {
+		t.Fatal(src, ok)
+	}
+	// Embedded art needs ffmpeg to extract it.
+	embedded := &ffprobe.Info{Streams: []map[string]interface{}{
+		{"index": json.Number("0"), "codec_type": "audio"},
+		{"index": json.Number("1"), "codec_type": "video", "disposition": map[string]interface{}{"attached_pic": json.Number("1")}},
+	}}
+	if stream, ok := embeddedArtStream(embedded); !ok || stream != 1 {
+		t.Fatal(stream, ok)
+	}
+	if src, ok := srv.thumbnailSource("Music/Single/01.mp3", "audio/mpeg", embedded, nil); ok {
+		t.Fatal(src)
+	}
+	// So do images Go can't decode.
+	if src, ok := srv.thumbnailSource("Photos/a.heic", "image/heic", nil, nil); ok {
+		t.Fatal(src)
+	}
+	srv.tools.ffmpeg.Path = "ffmpeg"
+	if _, ok := srv.thumbnailSource("Photos/a.heic", "image/heic", nil, nil); !ok {
+		t.Fatal("no thumbnail of HEIC with ffmpeg")
+	}
+	if src, ok := srv.thumbnailSource("Music/Single/01.mp3", "audio/mpeg", embedded, nil); !ok || src.path != "Music/Single/01.mp3" || src.stream != 1 {
+		t.Fatal(src, ok)
+	}
+	if src, ok := srv.thumbnailSource("Videos/film.mp4", "video/mp4", nil, nil); !ok || src.stream != -1 {
+		t.Fatal(src, ok)
+	}
+	album, err := srv.readDir(object{"Music/Album", srv.RootObjectPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := folderArt(album); !ok || name != "Cover.JPG" {
+		t.Fatal(name, ok)
+	}
+	videos, err := srv.readDir(object{"Videos", srv.RootObjectPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := folderArt(videos); ok {
+		t.Fatal("found art")
+	}
+	// A listing of the directory given by the caller is used instead of
+	// reading it.
+	if src, ok := (&Server{FS: fstest.MapFS{}}).thumbnailSource("Music/Album/01.mp3", "audio/mpeg", nil, album); !ok || src.path != "Music/Album/Cover.JPG" {
+		t.Fatal(src, ok)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	corner := color.RGBA{255, 0, 0, 255}
+	img.Set(0, 0, corner)
+	for orientation, expected := range map[int]image.Point{
+		1: {0, 0},
+		2: {2, 0},
+		3: {2, 1},
+		4: {0, 1},
+		5: {0, 0},
+		6: {1, 0},
+		7: {1, 2},
+		8: {0, 2},
+	} {
+		out := orient(img, orientation)
+		size := image.Point{3, 2}
+		if orientation >= 5 {
+			size = image.Point{2, 3}
+		}
+		if out.Bounds().Size() != size {
+			t.Errorf("%d: got size %v", orientation, out.Bounds().Size())
+		}
+		if out.At(expected.X, expected.Y) != color.Color(corner) {
+			t.Errorf("%d: corner isn't at %v", orientation, expected)
+		}
+	}
+}
+
+func TestServeIconIgnored(t *testing.T) {
+	srv := &Server{
+		FS:          fstest.MapFS{"Photos/Private/a.jpg": {}},
+		IgnorePaths: []string{"Private"},
+	}
+	w := httptest.NewRecorder()
+	srv.serveIcon(w, httptest.NewRequest("GET", "/icon?path=Photos%2FPrivate%2Fa.jpg&pn=JPEG_LRG", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal(w.Code)
+	}
+}
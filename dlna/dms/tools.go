@@ -0,0 +1,102 @@
+package dms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExternalTool is an external program the server runs, as resolved by Init.
+type ExternalTool struct {
+	// The program's name, such as "ffmpeg".
+	Name string
+	// Where it was found, or "" if it's unavailable.
+	Path string
+	// The version it reports, if it could be determined.
+	Version string
+	// Why it's unavailable.
+	Err error
+	// The features that don't work without it.
+	Features []string
+}
+
+func (t *ExternalTool) Available() bool {
+	return t.Path != ""
+}
+
+// The external programs the server runs.
+type externalTools struct {
+	ffmpeg  ExternalTool
+	ffprobe ExternalTool
+}
+
+// Finds the tool at the configured path, or by name on PATH if none is
+// configured, and asks it for its version.
+func resolveTool(name, configured string, versionArgs []string, features ...string) (t ExternalTool) {
+	t = ExternalTool{Name: name, Features: features}
+	exe := configured
+	if exe == "" {
+		exe = name
+	}
+	path, err := exec.LookPath(exe)
+	if errors.Is(err, exec.ErrDot) {
+		err = nil
+	}
+	if err != nil {
+		t.Err = err
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, versionArgs...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		// It couldn't be run at all.
+		t.Err = err
+		return
+	}
+	t.Path = path
+	t.Version = parseToolVersion(out)
+	return
+}
+
+// Gets the version from the first line of version output, such as "ffmpeg
+// version 6.1.1 Copyright ...".
+func parseToolVersion(out []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	if !s.Scan() {
+		return ""
+	}
+	fields := strings.Fields(s.Text())
+	for i, f := range fields {
+		if strings.TrimSuffix(f, ":") == "version" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// Resolves the external tools, and logs what they are, or what can't be done
+// without them.
+func (srv *Server) initTools() {
+	srv.tools = externalTools{
+		ffmpeg:  resolveTool("ffmpeg", srv.FFmpegPath, []string{"-version"}, "transcoding", "HLS", "video thumbnails"),
+		ffprobe: resolveTool("ffprobe", srv.FFprobePath, []string{"-version"}, "probing"),
+	}
+	for _, t := range []*ExternalTool{&srv.tools.ffmpeg, &srv.tools.ffprobe} {
+		if t.Available() {
+			srv.Logger.Info("found external tool", "tool", t.Name, "path", t.Path, "version", t.Version)
+		} else {
+			srv.Logger.Warn("external tool unavailable", "tool", t.Name, "error", t.Err, "disabled", strings.Join(t.Features, ", "))
+		}
+	}
+}
+
+// Reports whether transcodes can be served, which needs ffmpeg.
+func (srv *Server) transcodingEnabled() bool {
+	return !srv.NoTranscode && srv.tools.ffmpeg.Available()
+}
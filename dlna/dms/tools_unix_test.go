@@ -0,0 +1,114 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package dms
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+// A stand-in for ffprobe that reports its version, and probes any input as a
+// one minute file.
+const fakeFFprobe = `#!/bin/sh
+case "$1" in
+-version)
+	echo "ffprobe version 6.1.1 Copyright (c) 2007-2023 the FFmpeg developers"
+	;;
+*)
+	echo '{"format": {"duration": "60.000000", "bit_rate": "1000"}, "streams": [{"codec_type": "video", "width": 1920}]}'
+	;;
+esac
+`
+
+func TestResolveTool(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(exe, []byte(fakeFFprobe), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tool := resolveTool("ffprobe", exe, []string{"-version"}, "probing")
+	if !tool.Available() || tool.Path != exe || tool.Version != "6.1.1" {
+		t.Fatal(tool)
+	}
+	info, err := runFFprobe(tool.Path, "in.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := info.Duration(); err != nil || d.Seconds() != 60 {
+		t.Fatal(d, err)
+	}
+	if w, err := ffprobe.AnyAsFloat64(info.Streams[0]["width"]); err != nil || w != 1920 {
+		t.Fatal(w, err)
+	}
+
+	t.Setenv("PATH", dir)
+	tool = resolveTool("ffmpeg", "", []string{"-version"}, "transcoding")
+	if tool.Available() || tool.Err == nil {
+		t.Fatal(tool)
+	}
+	srv := &Server{
+		FS:           fstest.MapFS{"in.mkv": {}},
+		FFProbeCache: dummyFFProbeCache{},
+		tools:        externalTools{ffprobe: tool},
+	}
+	if _, err := srv.probeFile("in.mkv"); err != ffprobe.ExeNotFound {
+		t.Fatal(err)
+	}
+}
+
+// A Cache that remembers what's set in it.
+type mapCache map[interface{}]interface{}
+
+func (c mapCache) Set(key, value interface{}) { c[key] = value }
+
+func (c mapCache) Get(key interface{}) (interface{}, bool) {
+	value, ok := c[key]
+	return value, ok
+}
+
+func TestFailedProbe(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "ffprobe")
+	// Output that's cut short by a failure.
+	if err := os.WriteFile(exe, []byte("#!/bin/sh\necho '{\"format\": {'\necho 'connection refused' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := runFFprobe(exe, "in.mkv")
+	if info != nil || err == nil {
+		t.Fatal(info, err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cache := mapCache{}
+	srv := &Server{
+		HTTPConn:     l,
+		FS:           fstest.MapFS{"in.mkv": {}},
+		FFProbeCache: cache,
+		tools:        externalTools{ffprobe: ExternalTool{Path: exe}},
+	}
+	// The failure is tried again next time, rather than cached as no info.
+	if info, err := srv.probeFile("in.mkv"); info != nil || err == nil || len(cache) != 0 {
+		t.Fatal(info, err, cache)
+	}
+}
+
+func TestParseToolVersion(t *testing.T) {
+	for out, expected := range map[string]string{
+		"ffmpeg version n7.0 Copyright (c) 2000-2024 the FFmpeg developers\nbuilt with gcc\n": "n7.0",
+		"ffmpegthumbnailer version: 2.2.2\n":                                                  "2.2.2",
+		"usage: thing\n":                                                                      "",
+		"":                                                                                    "",
+	} {
+		if v := parseToolVersion([]byte(out)); v != expected {
+			t.Errorf("%q: got %q", out, v)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package dms
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Requests for a transcode that's produced no more than this can share
+	// it. TVs often open several connections to a resource at once.
+	transcodeShareWindow = 4 << 20
+	// The most output buffered for a transcode's slowest client. Clients
+	// that fall further behind than this while others are waiting are
+	// disconnected.
+	transcodeBufferSize = 8 << 20
+)
+
+var (
+	errTooManyTranscodes  = errors.New("too many transcodes")
+	errTranscodeReaderLag = errors.New("fell too far behind the transcode")
+	errTranscodeClosed    = errors.New("transcode reader closed")
+)
+
+// Identifies identical transcodes.
+type transcodeKey struct {
+	path, profile string
+	start, length time.Duration
+}
+
+// TranscodeSession describes a running transcode.
+type TranscodeSession struct {
+	ID      int
+	Path    string
+	Profile string
+	// The offset into the source the transcode started at, and the length
+	// requested, or zero if it runs to the end.
+	Start, Length time.Duration
+	// The requests reading the transcode.
+	Clients int
+	// The bytes of output produced so far.
+	Bytes   int64
+	Started time.Time
+}
+
+// Runs transcodes, shares them between identical requests, and limits how
+// many run at once.
+type transcodeManager struct {
+	// Holds a value for each running transcode, if limited.
+	slots        chan struct{}
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[*transcodeSession]struct{}
+	nextID   int
+}
+
+// max of zero or less means no limit. Requests wait up to queueTimeout for
+// a transcode to finish when the limit is reached.
+func newTranscodeManager(max int, queueTimeout time.Duration) *transcodeManager {
+	m := &transcodeManager{
+		queueTimeout: queueTimeout,
+		sessions:     make(map[*transcodeSession]struct{}),
+	}
+	if max > 0 {
+		m.slots = make(chan struct{}, max)
+	}
+	return m
+}
+
+// A transcode and the output not yet read by all its readers.
+type transcodeSession struct {
+	m       *transcodeManager
+	id      int
+	key     transcodeKey
+	started time.Time
+	output  io.ReadCloser
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// Output from offset bufStart onwards.
+	buf      []byte
+	bufStart int64
+	// The output has ended, with err.
+	done bool
+	err  error
+	// All readers have closed, so the transcode was stopped.
+	abandoned bool
+	readers   map[*transcodeReader]struct{}
+}
+
+// Reads a transcode session's output from the start.
+type transcodeReader struct {
+	s      *transcodeSession
+	off    int64
+	err    error
+	closed bool
+}
+
+// Returns a reader of the transcode with the given key. Running transcodes
+// are joined if they haven't gone too far, and otherwise one is started
+// with start once there's room.
+func (m *transcodeManager) open(ctx context.Context, key transcodeKey, start func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	m.mu.Lock()
+	for s := range m.sessions {
+		if s.key == key {
+			if r := s.join(); r != nil {
+				m.mu.Unlock()
+				return r, nil
+			}
+		}
+	}
+	m.mu.Unlock()
+	if err := m.acquire(ctx); err != nil {
+		return nil, err
+	}
+	output, err := start()
+	if err != nil {
+		m.release()
+		return nil, err
+	}
+	s := &transcodeSession{
+		m:       m,
+		key:     key,
+		started: time.Now(),
+		output:  output,
+		readers: make(map[*transcodeReader]struct{}),
+	}
+	s.cond.L = &s.mu
+	r := s.join()
+	m.mu.Lock()
+	m.nextID++
+	s.id = m.nextID
+	m.sessions[s] = struct{}{}
+	m.mu.Unlock()
+	go s.pump()
+	return r, nil
+}
+
+// Waits for room to start a transcode.
+func (m *transcodeManager) acquire(ctx context.Context) error {
+	if m.slots == nil {
+		return nil
+	}
+	select {
+	case m.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if m.queueTimeout <= 0 {
+		return errTooManyTranscodes
+	}
+	t := time.NewTimer(m.queueTimeout)
+	defer t.Stop()
+	select {
+	case m.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errTooManyTranscodes
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *transcodeManager) release() {
+	if m.slots != nil {
+		<-m.slots
+	}
+}
+
+// Returns the running transcodes, oldest first.
+func (m *transcodeManager) list() (ret []TranscodeSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret = make([]TranscodeSession, 0, len(m.sessions))
+	for s := range m.sessions {
+		s.mu.Lock()
+		ret = append(ret, TranscodeSession{
+			ID:      s.id,
+			Path:    s.key.path,
+			Profile: s.key.profile,
+			Start:   s.key.start,
+			Length:  s.key.length,
+			Clients: len(s.readers),
+			Bytes:   s.bufStart + int64(len(s.buf)),
+			Started: s.started,
+		})
+		s.mu.Unlock()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return
+}
+
+// Adds a reader if the session's output is still available from the start.
+func (s *transcodeSession) join() *transcodeReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.abandoned || s.bufStart != 0 || len(s.buf) > transcodeShareWindow {
+		return nil
+	}
+	r := &transcodeReader{s: s}
+	s.readers[r] = struct{}{}
+	return r
+}
+
+// Copies the transcode output into the buffer until it ends or is
+// abandoned.
+func (s *transcodeSession) pump() {
+	defer func() {
+		s.output.Close()
+		s.m.mu.Lock()
+		delete(s.m.sessions, s)
+		s.m.mu.Unlock()
+		s.m.release()
+	}()
+	b := make([]byte, 32<<10)
+	for {
+		s.mu.Lock()
+		s.waitForRoom()
+		abandoned := s.abandoned
+		s.mu.Unlock()
+		if abandoned {
+			return
+		}
+		n, err := s.output.Read(b)
+		s.mu.Lock()
+		s.buf = append(s.buf, b[:n]...)
+		if err != nil {
+			s.done = true
+			if err != io.EOF && !s.abandoned {
+				s.err = err
+			}
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Waits until the buffer has room, disconnecting readers that have fallen
+// too far behind others. s.mu must be held.
+func (s *transcodeSession) waitForRoom() {
+	for !s.abandoned && len(s.buf) >= transcodeBufferSize {
+		s.trim()
+		if len(s.buf) < transcodeBufferSize {
+			return
+		}
+		end := s.bufStart + int64(len(s.buf))
+		waiting := false
+		for r := range s.readers {
+			if r.off == end {
+				waiting = true
+			}
+		}
+		if waiting {
+			for r := range s.readers {
+				if r.off == s.bufStart {
+					r.err = errTranscodeReaderLag
+					s.removeReader(r)
+				}
+			}
+			continue
+		}
+		s.cond.Wait()
+	}
+}
+
+// Drops the output every reader has read. s.mu must be held.
+func (s *transcodeSession) trim() {
+	if s.bufStart == 0 && len(s.buf) <= transcodeShareWindow {
+		// Keep it for readers that might join.
+		return
+	}
+	oldest := s.bufStart + int64(len(s.buf))
+	for r := range s.readers {
+		if r.off < oldest {
+			oldest = r.off
+		}
+	}
+	s.buf = s.buf[oldest-s.bufStart:]
+	s.bufStart = oldest
+}
+
+// s.mu must be held.
+func (s *transcodeSession) removeReader(r *transcodeReader) {
+	delete(s.readers, r)
+	s.cond.Broadcast()
+	if len(s.readers) == 0 && !s.done {
+		s.abandoned = true
+		// Stop the transcode promptly, rather than when it next writes.
+		go s.output.Close()
+	}
+}
+
+func (r *transcodeReader) Read(p []byte) (n int, err error) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if i := r.off - s.bufStart; i < int64(len(s.buf)) {
+			n = copy(p, s.buf[i:])
+			r.off += int64(n)
+			s.cond.Broadcast()
+			return
+		}
+		if s.done {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+}
+
+// Close stops reading. The transcode is stopped if no readers remain.
+func (r *transcodeReader) Close() error {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.err == nil {
+		r.err = errTranscodeClosed
+	}
+	if _, ok := s.readers[r]; ok {
+		s.removeReader(r)
+	}
+	return nil
+}
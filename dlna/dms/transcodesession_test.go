@@ -0,0 +1,138 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transcode output fed by the test.
+type fakeTranscode struct {
+	*io.PipeReader
+	w      *io.PipeWriter
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeTranscode() *fakeTranscode {
+	r, w := io.Pipe()
+	return &fakeTranscode{PipeReader: r, w: w, closed: make(chan struct{})}
+}
+
+func (f *fakeTranscode) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return f.PipeReader.Close()
+}
+
+func TestTranscodeSharing(t *testing.T) {
+	m := newTranscodeManager(0, 0)
+	key := transcodeKey{"in.mkv", "t", 0, 0}
+	starts := 0
+	f := newFakeTranscode()
+	start := func() (io.ReadCloser, error) {
+		starts++
+		return f, nil
+	}
+	a, err := m.open(context.Background(), key, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.w.Write([]byte("hello "))
+	b := make([]byte, 6)
+	if _, err := io.ReadFull(a, b); err != nil || string(b) != "hello " {
+		t.Fatal(string(b), err)
+	}
+	// A second request joins, and gets the output from the start.
+	c, err := m.open(context.Background(), key, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if starts != 1 {
+		t.Fatal(starts)
+	}
+	if sessions := m.list(); len(sessions) != 1 || sessions[0].Clients != 2 {
+		t.Fatal(sessions)
+	}
+	go func() {
+		f.w.Write([]byte("world"))
+		f.w.Close()
+	}()
+	for _, r := range []io.Reader{io.MultiReader(bytes.NewReader(b), a), c} {
+		all, err := io.ReadAll(r)
+		if err != nil || string(all) != "hello world" {
+			t.Fatal(string(all), err)
+		}
+	}
+	a.Close()
+	c.Close()
+	<-f.closed
+}
+
+func TestTranscodeLimit(t *testing.T) {
+	m := newTranscodeManager(1, 0)
+	f := newFakeTranscode()
+	a, err := m.open(context.Background(), transcodeKey{"a.mkv", "t", 0, 0}, func() (io.ReadCloser, error) {
+		return f, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := func() (io.ReadCloser, error) {
+		return newFakeTranscode(), nil
+	}
+	if _, err := m.open(context.Background(), transcodeKey{"b.mkv", "t", 0, 0}, other); err != errTooManyTranscodes {
+		t.Fatal(err)
+	}
+	// Queued requests start when a transcode stops.
+	m.queueTimeout = time.Minute
+	opened := make(chan error)
+	go func() {
+		_, err := m.open(context.Background(), transcodeKey{"b.mkv", "t", 0, 0}, other)
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatal(err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The client going away stops the transcode promptly.
+	a.Close()
+	select {
+	case <-f.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transcode not stopped")
+	}
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTranscodeSlowReader(t *testing.T) {
+	m := newTranscodeManager(0, 0)
+	f := newFakeTranscode()
+	start := func() (io.ReadCloser, error) {
+		return f, nil
+	}
+	key := transcodeKey{"in.mkv", "t", 0, 0}
+	fast, _ := m.open(context.Background(), key, start)
+	slow, _ := m.open(context.Background(), key, start)
+	go func() {
+		chunk := make([]byte, 1<<20)
+		for i := 0; i < 2*transcodeBufferSize/len(chunk); i++ {
+			if _, err := f.w.Write(chunk); err != nil {
+				return
+			}
+		}
+		f.w.Close()
+	}()
+	n, err := io.Copy(io.Discard, fast)
+	if err != nil || n != 2*transcodeBufferSize {
+		t.Fatal(n, err)
+	}
+	if _, err := io.Copy(io.Discard, slow); err != errTranscodeReaderLag {
+		t.Fatal(err)
+	}
+}
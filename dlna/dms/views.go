@@ -0,0 +1,585 @@
+package dms
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/library"
+	"github.com/anacrolix/dms/misc"
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Views are virtual containers that present the library by metadata rather
+// than by directory: music by artist, album and genre, videos, and photos by
+// the date they were taken. They're listed ahead of the directories in the
+// root container.
+//
+// Virtual object IDs are virtualIDPrefix followed by slash-separated, query
+// escaped keys, such as "$music/artists/Queen". Filesystem object IDs are
+// opaque IDs starting with objectIDPrefix, or query escaped paths, so they
+// never start with virtualIDPrefix. Items in views have IDs of their own,
+// their container's ID and the file's ID joined by a slash, such as
+// "$music/tracks/@1x2kqv8r0z5m", so each has one parent. Their refID is the
+// file's ID.
+const virtualIDPrefix = "$"
+
+// The number of videos in the recently added view.
+const recentlyAddedCount = 50
+
+func isVirtualID(id string) bool {
+	return strings.HasPrefix(id, virtualIDPrefix)
+}
+
+// Splits a virtual object ID into its keys.
+func parseVirtualID(id string) (keys []string, err error) {
+	if !isVirtualID(id) {
+		err = errors.New("not a virtual object id")
+		return
+	}
+	for _, s := range strings.Split(strings.TrimPrefix(id, virtualIDPrefix), "/") {
+		var key string
+		key, err = url.QueryUnescape(s)
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// A virtual container. Its children are other virtual containers followed by
+// library items.
+type viewNode struct {
+	key, id, parentID string
+	title, class      string
+	// The artist of an album.
+	artist   string
+	children []*viewNode
+	items    []*library.Entry
+	// The date of the most recent item beneath the node.
+	latest time.Time
+}
+
+func (n *viewNode) child(key, title, class string) *viewNode {
+	for _, c := range n.children {
+		if c.key == key {
+			return c
+		}
+	}
+	c := &viewNode{
+		key:      key,
+		id:       n.id + "/" + url.QueryEscape(key),
+		parentID: n.id,
+		title:    title,
+		class:    class,
+	}
+	n.children = append(n.children, c)
+	return c
+}
+
+func (n *viewNode) childCount() int {
+	return len(n.children) + len(n.items)
+}
+
+// Calls f for the node and everything beneath it.
+func (n *viewNode) walk(f func(*viewNode)) {
+	f(n)
+	for _, c := range n.children {
+		c.walk(f)
+	}
+}
+
+func (srv *Server) viewsEnabled() bool {
+	return !srv.NoViews && srv.library != nil
+}
+
+// The keys of the top-level views, in the order they're listed.
+var viewKeys = []string{"music", "videos", "photos"}
+
+// Returns the top-level view that holds files of the given MIME type, if
+// any.
+func viewKeyForMimeType(mt mimeType) (key string, ok bool) {
+	switch {
+	case mt.IsAudio():
+		return "music", true
+	case mt.IsVideo():
+		return "videos", true
+	case mt.IsImage():
+		return "photos", true
+	}
+	return
+}
+
+// Holds the top-level views built from the library, until it changes.
+type viewCache struct {
+	mu         sync.Mutex
+	generation uint64
+	views      map[string]*viewNode
+}
+
+// Returns the named top-level view, building it if the library has changed
+// since it was last built. Views are shared, and mustn't be modified.
+func (srv *Server) view(key string) *viewNode {
+	gen := srv.library.Generation()
+	srv.views.mu.Lock()
+	defer srv.views.mu.Unlock()
+	if srv.views.views == nil || srv.views.generation != gen {
+		srv.views.views = make(map[string]*viewNode)
+		srv.views.generation = gen
+	}
+	n, ok := srv.views.views[key]
+	if !ok {
+		n = srv.buildView(key)
+		srv.views.views[key] = n
+	}
+	return n
+}
+
+// Builds the named top-level view from the library.
+func (srv *Server) buildView(key string) *viewNode {
+	root := &viewNode{
+		key:      key,
+		id:       virtualIDPrefix + key,
+		parentID: "0",
+		class:    "object.container",
+	}
+	var entries []*library.Entry
+	srv.library.Entries(func(e *library.Entry) bool {
+		if k, ok := viewKeyForMimeType(mimeType(e.MimeType)); ok && k == key && e.Mode.IsRegular() {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	sortEntriesByName(entries)
+	switch key {
+	case "music":
+		root.title = "Music"
+		buildMusicView(root, entries)
+	case "videos":
+		root.title = "Videos"
+		buildVideosView(root, entries)
+	case "photos":
+		root.title = "Photos"
+		buildPhotosView(root, entries)
+	}
+	root.setLatest()
+	return root
+}
+
+func buildMusicView(root *viewNode, entries []*library.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	artists := root.child("artists", "Artists", "object.container")
+	albums := root.child("albums", "Albums", "object.container")
+	genres := root.child("genres", "Genres", "object.container")
+	tracks := root.child("tracks", "All Tracks", "object.container")
+	for _, e := range entries {
+		artist := entryTag(e, "album_artist")
+		if artist == "" {
+			artist = entryTag(e, "artist")
+		}
+		album := entryTag(e, "album")
+		genre := entryTag(e, "genre")
+		artistNode := artists.child(artist, orUnknown(artist, "Artist"), "object.container.person.musicArtist")
+		artistAlbum := artistNode.child(album, orUnknown(album, "Album"), "object.container.album.musicAlbum")
+		artistAlbum.artist = artist
+		artistAlbum.items = append(artistAlbum.items, e)
+		// Albums of the same name by different artists are kept apart.
+		albumNode := albums.child(artist+"\x00"+album, orUnknown(album, "Album"), "object.container.album.musicAlbum")
+		albumNode.artist = artist
+		albumNode.items = append(albumNode.items, e)
+		genreNode := genres.child(genre, orUnknown(genre, "Genre"), "object.container.genre.musicGenre")
+		genreNode.items = append(genreNode.items, e)
+		tracks.items = append(tracks.items, e)
+	}
+	sortNodesByTitle(artists.children)
+	sortNodesByTitle(albums.children)
+	sortNodesByTitle(genres.children)
+	root.walk(func(n *viewNode) {
+		if n.class == "object.container.album.musicAlbum" {
+			sortTracks(n.items)
+		}
+		if n.class == "object.container.person.musicArtist" {
+			sortNodesByTitle(n.children)
+		}
+	})
+}
+
+func buildVideosView(root *viewNode, entries []*library.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	all := root.child("all", "All Videos", "object.container")
+	all.items = entries
+	recent := root.child("recent", "Recently Added", "object.container")
+	recent.items = append([]*library.Entry(nil), entries...)
+	sort.SliceStable(recent.items, func(i, j int) bool {
+		return recent.items[i].ModTime.After(recent.items[j].ModTime)
+	})
+	if len(recent.items) > recentlyAddedCount {
+		recent.items = recent.items[:recentlyAddedCount]
+	}
+}
+
+func buildPhotosView(root *viewNode, entries []*library.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entryDate(entries[i]).Before(entryDate(entries[j]))
+	})
+	for _, e := range entries {
+		date := entryDate(e)
+		year := root.child(strconv.Itoa(date.Year()), strconv.Itoa(date.Year()), "object.container")
+		month := year.child(fmt.Sprintf("%02d", int(date.Month())), date.Month().String(), "object.container.album.photoAlbum")
+		month.items = append(month.items, e)
+	}
+	// Most recent years first.
+	sort.SliceStable(root.children, func(i, j int) bool {
+		return root.children[i].key > root.children[j].key
+	})
+}
+
+// Returns when the entry's media was created, falling back on its
+// modification time.
+func entryDate(e *library.Entry) time.Time {
+	if !e.Date.IsZero() {
+		return e.Date
+	}
+	return e.ModTime
+}
+
+func entryTag(e *library.Entry, name string) string {
+	if e.Probe == nil {
+		return ""
+	}
+	return strings.TrimSpace(probeTag(e.Probe, name))
+}
+
+func orUnknown(s, what string) string {
+	if s == "" {
+		return "Unknown " + what
+	}
+	return s
+}
+
+func sortEntriesByName(entries []*library.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return upnpav.CompareNatural(path.Base(entries[i].Path), path.Base(entries[j].Path)) < 0
+	})
+}
+
+func sortNodesByTitle(nodes []*viewNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return upnpav.CompareNatural(nodes[i].title, nodes[j].title) < 0
+	})
+}
+
+// Parses a track or disc number tag, such as "3" or "3/12".
+func parseNumberTag(s string) int {
+	s, _, _ = strings.Cut(s, "/")
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
+// Orders an album's tracks by disc and track number.
+func sortTracks(entries []*library.Entry) {
+	type trackKey struct{ disc, track int }
+	keys := make(map[*library.Entry]trackKey, len(entries))
+	for _, e := range entries {
+		keys[e] = trackKey{parseNumberTag(entryTag(e, "disc")), parseNumberTag(entryTag(e, "track"))}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ki, kj := keys[entries[i]], keys[entries[j]]
+		if ki.disc != kj.disc {
+			return ki.disc < kj.disc
+		}
+		return ki.track < kj.track
+	})
+}
+
+// Returns the ID of the view item for a file with the given ID.
+func (n *viewNode) itemID(fileID string) string {
+	return n.id + "/" + fileID
+}
+
+// Splits the ID of an item in a view into the ID of its view node and the ID
+// of the file. ok is false for the IDs of view nodes, whose keys are query
+// escaped, so they never start with objectIDPrefix.
+func splitViewItemID(id string) (nodeID, fileID string, ok bool) {
+	i := strings.LastIndex(id, "/")
+	if i < 0 || !isVirtualID(id) || !isOpaqueID(id[i+1:]) {
+		return
+	}
+	return id[:i], id[i+1:], true
+}
+
+// Returns the view node and library entry of the item in a view with the ID.
+func (me *contentDirectoryService) viewItem(id string) (*viewNode, *library.Entry, error) {
+	nodeID, fileID, ok := splitViewItemID(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a view item: %q", id)
+	}
+	n, err := me.viewNode(nodeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range n.items {
+		if me.entryObjectID(e) == fileID {
+			return n, e, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no such view item: %q", id)
+}
+
+// Returns the object ID of the file of a library entry.
+func (srv *Server) entryObjectID(e *library.Entry) string {
+	return srv.objectID(object{e.Path, srv.RootObjectPath}, e.FileInfo())
+}
+
+// Returns the view node for a virtual object ID.
+func (srv *Server) viewNode(id string) (*viewNode, error) {
+	keys, err := parseVirtualID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.viewsEnabled() || !isViewKey(keys[0]) {
+		return nil, fmt.Errorf("no such view: %q", id)
+	}
+	n := srv.view(keys[0])
+	for _, key := range keys[1:] {
+		var next *viewNode
+		for _, c := range n.children {
+			if c.key == key {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("no such view: %q", id)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+func isViewKey(key string) bool {
+	for _, k := range viewKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the top-level views that have content.
+func (me *contentDirectoryService) viewRoots() (ret []*viewNode) {
+	if !me.viewsEnabled() {
+		return
+	}
+	for _, key := range viewKeys {
+		n := me.view(key)
+		if n.childCount() != 0 {
+			ret = append(ret, n)
+		}
+	}
+	return
+}
+
+// Returns the top-level views that have content, as containers.
+func (me *contentDirectoryService) viewContainers(c client) (ret []interface{}) {
+	for _, n := range me.viewRoots() {
+		ret = append(ret, n.container(c))
+	}
+	return
+}
+
+// Sets the dates of the most recent items beneath the node and its
+// descendants.
+func (n *viewNode) setLatest() time.Time {
+	for _, c := range n.children {
+		if date := c.setLatest(); date.After(n.latest) {
+			n.latest = date
+		}
+	}
+	for _, e := range n.items {
+		if date := entryDate(e); date.After(n.latest) {
+			n.latest = date
+		}
+	}
+	return n.latest
+}
+
+func (n *viewNode) container(c client) upnpav.Container {
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         n.id,
+			ParentID:   n.parentID,
+			Restricted: 1,
+			Title:      n.title,
+			Class:      n.class,
+			Artist:     n.artist,
+			Date:       c.timestamp(n.latest),
+			Searchable: 1,
+		},
+		ChildCount: n.childCount(),
+	}
+}
+
+// Returns the children of a view node. Items are stand-ins with only the
+// properties that can be sorted on, which are cheap to get from the library,
+// so that children can be sorted and paged before the items returned are
+// fully described by viewItems. entries maps the stand-ins to their library
+// entries. They're keyed by the stand-in rather than its ID, which needn't be
+// unique, such as when a file reuses the inode of a deleted one the index
+// still has.
+func (me *contentDirectoryService) viewChildren(n *viewNode, c client) (ret []interface{}, entries map[*upnpav.Item]*library.Entry) {
+	entries = make(map[*upnpav.Item]*library.Entry, len(n.items))
+	for _, child := range n.children {
+		ret = append(ret, child.container(c))
+	}
+	for _, e := range n.items {
+		item := me.viewItemStandIn(n, e, c)
+		entries[item] = e
+		ret = append(ret, item)
+	}
+	return
+}
+
+// Returns an item with the properties of a library entry that can be sorted
+// on.
+func (me *contentDirectoryService) viewItemStandIn(n *viewNode, e *library.Entry, c client) *upnpav.Item {
+	fileID := me.entryObjectID(e)
+	obj := upnpav.Object{
+		ID:         n.itemID(fileID),
+		ParentID:   n.id,
+		Restricted: 1,
+		Title:      e.FileInfo().Name(),
+		Class:      "object.item." + mimeType(e.MimeType).Type() + "Item",
+		Date:       c.timestamp(entryDate(e)),
+	}
+	res := upnpav.Resource{
+		ProtocolInfo: originalProtocolInfo(mimeType(e.MimeType)),
+		Size:         uint64(e.Size),
+		Resolution:   videoResolution(e.Probe),
+	}
+	if e.Probe != nil {
+		itemExtra(&obj, e.Probe)
+		res.Bitrate, _ = e.Probe.Bitrate()
+		if d, err := e.Probe.Duration(); err == nil {
+			res.Duration = misc.FormatDurationSexagesimal(d)
+		}
+	}
+	return &upnpav.Item{Object: obj, RefID: fileID, Res: []upnpav.Resource{res}}
+}
+
+// Replaces the stand-in items from viewChildren with full descriptions.
+// Items that can't be described are left out.
+func (me *contentDirectoryService) viewItems(n *viewNode, objs []interface{}, entries map[*upnpav.Item]*library.Entry, c client) (ret []interface{}) {
+	ret = make([]interface{}, 0, len(objs))
+	for _, obj := range objs {
+		standIn, ok := obj.(*upnpav.Item)
+		if !ok {
+			ret = append(ret, obj)
+			continue
+		}
+		e := entries[standIn]
+		full, err := me.cdsObjectToUpnpavObject(object{e.Path, me.RootObjectPath}, e.FileInfo(), nil, c)
+		if err != nil {
+			me.Logger.Info("error with object", "path", e.Path, "error", err)
+			continue
+		}
+		item, ok := full.(upnpav.Item)
+		if !ok {
+			continue
+		}
+		item.ID = standIn.ID
+		item.ParentID = n.id
+		item.RefID = standIn.RefID
+		ret = append(ret, item)
+	}
+	return
+}
+
+// Handles Browse for a virtual object, ordering children by the sort
+// criteria. Only the page of children returned is fully described.
+func (me *contentDirectoryService) browseView(browse browse, sortCriteria upnpav.SortCriteria, c client) ([][2]string, error) {
+	if _, _, ok := splitViewItemID(browse.ObjectID); ok {
+		return me.browseViewItem(browse, c)
+	}
+	n, err := me.viewNode(browse.ObjectID)
+	if err != nil {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%s", err.Error())
+	}
+	switch browse.BrowseFlag {
+	case "BrowseDirectChildren":
+		objs, entries := me.viewChildren(n, c)
+		sortCriteria.Sort(objs)
+		page, total := objectsPage(objs, browse.StartingIndex, browse.RequestedCount)
+		return me.objectsPageResult(me.viewItems(n, page, entries, c), total, upnpav.ParseFilter(browse.Filter), me.containerUpdateIDString(n.id))
+	case "BrowseMetadata":
+		return me.objectsResult([]interface{}{n.container(c)}, upnpav.ParseFilter(browse.Filter), 0, 0, me.updateIDString())
+	default:
+		return nil, upnp.Errorf(
+			upnp.ArgumentValueInvalidErrorCode,
+			"unhandled browse flag: %v",
+			browse.BrowseFlag,
+		)
+	}
+}
+
+// Handles Browse for an item in a view, which has no children.
+func (me *contentDirectoryService) browseViewItem(browse browse, c client) ([][2]string, error) {
+	n, e, err := me.viewItem(browse.ObjectID)
+	if err != nil {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%s", err.Error())
+	}
+	switch browse.BrowseFlag {
+	case "BrowseDirectChildren":
+		return nil, upnp.Errorf(upnpav.NoSuchContainerErrorCode, "not a container: %q", browse.ObjectID)
+	case "BrowseMetadata":
+		standIn := me.viewItemStandIn(n, e, c)
+		objs := me.viewItems(n, []interface{}{standIn}, map[*upnpav.Item]*library.Entry{standIn: e}, c)
+		if len(objs) == 0 {
+			return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such view item: %q", browse.ObjectID)
+		}
+		return me.objectsResult(objs, upnpav.ParseFilter(browse.Filter), 0, 0, me.updateIDString())
+	default:
+		return nil, upnp.Errorf(
+			upnp.ArgumentValueInvalidErrorCode,
+			"unhandled browse flag: %v",
+			browse.BrowseFlag,
+		)
+	}
+}
+
+// Returns the objects beneath a view node that satisfy the search criteria.
+// Items are only included once, however many containers hold them.
+func (me *contentDirectoryService) searchView(n *viewNode, criteria upnpav.SearchCriteria, c client) (ret []interface{}) {
+	seen := make(map[string]struct{})
+	n.walk(func(node *viewNode) {
+		objs, entries := me.viewChildren(node, c)
+		unseen := objs[:0]
+		for _, obj := range objs {
+			if item, ok := obj.(*upnpav.Item); ok {
+				if _, ok := seen[entries[item].Path]; ok {
+					continue
+				}
+				seen[entries[item].Path] = struct{}{}
+			}
+			unseen = append(unseen, obj)
+		}
+		for _, obj := range me.viewItems(node, unseen, entries, c) {
+			if criteria.Match(obj) {
+				ret = append(ret, obj)
+			}
+		}
+	})
+	return
+}
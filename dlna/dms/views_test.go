@@ -0,0 +1,289 @@
+package dms
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/library"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func newViewsTestServer(t *testing.T, fsys fstest.MapFS, tags map[string]map[string]interface{}) *Server {
+	srv := &Server{FS: fsys}
+	srv.library = &library.Library{
+		FS: fsys,
+		MimeType: func(p string) (string, error) {
+			mt, err := MimeTypeByPath(fsys, p)
+			return string(mt), err
+		},
+		Probe: func(e *library.Entry) (*ffprobe.Info, error) {
+			if tags[e.Path] == nil {
+				return nil, nil
+			}
+			return &ffprobe.Info{Format: map[string]interface{}{"tags": tags[e.Path]}}, nil
+		},
+		Date: func(e *library.Entry) (time.Time, error) {
+			if e.Path == "photos/b.jpg" {
+				return time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), nil
+			}
+			return time.Time{}, nil
+		},
+	}
+	if err := srv.library.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// Describes a view node's children as "title(child count)".
+func viewChildTitles(n *viewNode) string {
+	var ss []string
+	for _, c := range n.children {
+		ss = append(ss, fmt.Sprintf("%s(%d)", c.title, c.childCount()))
+	}
+	return strings.Join(ss, ",")
+}
+
+func TestViews(t *testing.T) {
+	fsys := fstest.MapFS{
+		"music/1.mp3":  {},
+		"music/2.mp3":  {},
+		"music/3.mp3":  {},
+		"music/4.mp3":  {},
+		"photos/a.jpg": {ModTime: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		"photos/b.jpg": {ModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	srv := newViewsTestServer(t, fsys, map[string]map[string]interface{}{
+		"music/1.mp3": {"ARTIST": "Queen", "album": "Innuendo", "genre": "Rock", "track": "2/12"},
+		"music/2.mp3": {"artist": "Queen", "album": "Innuendo", "genre": "Rock", "track": "1/12"},
+		"music/3.mp3": {"artist": "ABBA", "album": "Arrival"},
+		"music/4.mp3": {"artist": "ABBA", "album": "Innuendo"},
+	})
+	music := srv.buildView("music")
+	// Albums of the same name by different artists are kept apart.
+	if got := viewChildTitles(music); got != "Artists(2),Albums(3),Genres(2),All Tracks(4)" {
+		t.Fatal(got)
+	}
+	if got := viewChildTitles(music.children[0]); got != "ABBA(2),Queen(1)" {
+		t.Fatal(got)
+	}
+	if got := viewChildTitles(music.children[1]); got != "Arrival(1),Innuendo(2),Innuendo(1)" {
+		t.Fatal(got)
+	}
+	if got := viewChildTitles(music.children[2]); got != "Rock(2),Unknown Genre(2)" {
+		t.Fatal(got)
+	}
+	n, err := srv.viewNode("$music/artists/Queen/Innuendo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.items[0].Path != "music/2.mp3" || n.items[1].Path != "music/1.mp3" {
+		t.Fatalf("tracks out of order: %q, %q", n.items[0].Path, n.items[1].Path)
+	}
+	if n.parentID != "$music/artists/Queen" {
+		t.Fatal(n.parentID)
+	}
+
+	photos := srv.buildView("photos")
+	if got := viewChildTitles(photos); got != "2020(1),2019(1)" {
+		t.Fatal(got)
+	}
+	if got := viewChildTitles(photos.children[1]); got != "July(1)" {
+		t.Fatal(got)
+	}
+	// Containers are dated by their most recent item.
+	if date := photos.container(client{profile: &DeviceProfile{}}).Date; !date.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal(date)
+	}
+
+	if videos := srv.buildView("videos"); videos.childCount() != 0 {
+		t.Fatal(videos.childCount())
+	}
+	if _, err := srv.viewNode("$music/artists/Nobody"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Views are built once, until the library changes.
+	if srv.view("music") != srv.view("music") {
+		t.Fatal("view rebuilt without changes")
+	}
+	before := srv.view("music")
+	delete(fsys, "music/4.mp3")
+	if err := srv.library.Update("music/4.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if after := srv.view("music"); after == before || after.children[3].childCount() != 3 {
+		t.Fatal("view not rebuilt after change")
+	}
+}
+
+func TestBrowseViewPage(t *testing.T) {
+	fsys := fstest.MapFS{
+		"music/1.mp3": {},
+		"music/2.mp3": {},
+		"music/3.mp3": {},
+	}
+	srv := newViewsTestServer(t, fsys, nil)
+	srv.NoProbe = true
+	cds := &contentDirectoryService{Server: srv}
+	c := client{profile: &DeviceProfile{}}
+	sortCriteria, err := upnpav.ParseSortCriteria("-dc:title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := cds.browseView(browse{
+		ObjectID:       "$music/tracks",
+		BrowseFlag:     "BrowseDirectChildren",
+		StartingIndex:  1,
+		RequestedCount: 1,
+	}, sortCriteria, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret[1][1] != "1" || ret[2][1] != "3" {
+		t.Fatalf("returned %s of %s", ret[1][1], ret[2][1])
+	}
+	if !strings.Contains(ret[0][1], "2.mp3") {
+		t.Fatal(ret[0][1])
+	}
+}
+
+func TestViewItemIDs(t *testing.T) {
+	srv := newViewsTestServer(t, fstest.MapFS{"music/1.mp3": {}}, map[string]map[string]interface{}{
+		"music/1.mp3": {"genre": "Rock"},
+	})
+	srv.NoProbe = true
+	cds := &contentDirectoryService{Server: srv}
+	c := client{profile: &DeviceProfile{}}
+	e, ok := srv.library.Get("music/1.mp3")
+	if !ok {
+		t.Fatal("not indexed")
+	}
+	fileID := srv.entryObjectID(e)
+	type didl struct {
+		Items []struct {
+			ID       string `xml:"id,attr"`
+			ParentID string `xml:"parentID,attr"`
+			RefID    string `xml:"refID,attr"`
+		} `xml:"item"`
+	}
+	browseItem := func(id, flag string) (ret didl, err error) {
+		t.Helper()
+		args, err := cds.browseView(browse{ObjectID: id, BrowseFlag: flag, Filter: "*"}, nil, c)
+		if err != nil {
+			return
+		}
+		err = xml.Unmarshal([]byte(args[0][1]), &ret)
+		return
+	}
+	// The file is in two views, and has a different ID in each, referring
+	// to the file's.
+	for _, nodeID := range []string{"$music/tracks", "$music/genres/Rock"} {
+		d, err := browseItem(nodeID, "BrowseDirectChildren")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d.Items) != 1 || d.Items[0].ID != nodeID+"/"+fileID || d.Items[0].RefID != fileID {
+			t.Fatal(nodeID, d.Items)
+		}
+		// Its metadata gives the view it was found in as its parent.
+		d, err = browseItem(d.Items[0].ID, "BrowseMetadata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d.Items) != 1 || d.Items[0].ParentID != nodeID {
+			t.Fatal(d.Items)
+		}
+	}
+	if _, err := browseItem("$music/tracks/"+fileID, "BrowseDirectChildren"); err == nil {
+		t.Fatal("expected error browsing an item's children")
+	}
+	if _, err := browseItem("$music/tracks/@nothing", "BrowseMetadata"); err == nil {
+		t.Fatal("expected error for unknown item")
+	}
+}
+
+func TestParseVirtualID(t *testing.T) {
+	id := virtualIDPrefix + "music/artists/" + "AC%2FDC"
+	keys, err := parseVirtualID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, "|") != "music|artists|AC/DC" {
+		t.Fatal(keys)
+	}
+	if isVirtualID((object{Path: "$music"}).ID()) {
+		t.Fatal("filesystem object id looks virtual")
+	}
+}
+
+func TestViewItemsSharingAnID(t *testing.T) {
+	fsys := fstest.MapFS{"music/1.mp3": {}, "music/2.mp3": {}}
+	srv := &Server{FS: fsys, NoProbe: true}
+	srv.library = &library.Library{
+		FS: fsys,
+		MimeType: func(p string) (string, error) {
+			mt, err := MimeTypeByPath(fsys, p)
+			return string(mt), err
+		},
+		ID: func(string, fs.FileInfo) string { return "@same" },
+	}
+	if err := srv.library.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cds := &contentDirectoryService{Server: srv}
+	ret, err := cds.browseView(browse{ObjectID: "$music/tracks", BrowseFlag: "BrowseDirectChildren", Filter: "*"}, nil, client{profile: &DeviceProfile{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each item is still described by its own file.
+	if !strings.Contains(ret[0][1], "1.mp3") || !strings.Contains(ret[0][1], "2.mp3") {
+		t.Fatal(ret[0][1])
+	}
+}
+
+func TestBrowseViewSortByResolution(t *testing.T) {
+	fsys := fstest.MapFS{"videos/a.mp4": {}, "videos/b.mp4": {}}
+	widths := map[string]int{"videos/a.mp4": 1920, "videos/b.mp4": 640}
+	srv := &Server{FS: fsys, NoProbe: true}
+	srv.library = &library.Library{
+		FS: fsys,
+		MimeType: func(p string) (string, error) {
+			mt, err := MimeTypeByPath(fsys, p)
+			return string(mt), err
+		},
+		Probe: func(e *library.Entry) (*ffprobe.Info, error) {
+			return &ffprobe.Info{Streams: []map[string]interface{}{{
+				"codec_type": "video",
+				"width":      json.Number(fmt.Sprint(widths[e.Path])),
+				"height":     json.Number(fmt.Sprint(widths[e.Path] * 9 / 16)),
+			}}}, nil
+		},
+	}
+	if err := srv.library.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cds := &contentDirectoryService{Server: srv}
+	sortCriteria, err := upnpav.ParseSortCriteria("+res@resolution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := cds.browseView(browse{ObjectID: "$videos/all", BrowseFlag: "BrowseDirectChildren", RequestedCount: 1}, sortCriteria, client{profile: &DeviceProfile{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Items are sorted before they're fully described, so the stand-ins
+	// need the resolution too.
+	if !strings.Contains(ret[0][1], "b.mp4") {
+		t.Fatal(ret[0][1])
+	}
+}
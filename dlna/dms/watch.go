@@ -0,0 +1,132 @@
+package dms
+
+import (
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes are collected for this long before being applied and evented. The
+// ContentDirectory spec limits ContainerUpdateIDs events to one every 2
+// seconds.
+const watchModerationInterval = 2 * time.Second
+
+// Watches the filesystem under the root until the server is closed, updating
+// the library index and notifying event subscribers of changed containers.
+func (srv *Server) watch() {
+	logger := srv.Logger.With("subsystem", "watch")
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Info("error creating filesystem watcher", "error", err)
+		return
+	}
+	defer w.Close()
+	srv.addWatches(w, ".")
+	changed := make(map[string]struct{})
+	timer := time.NewTimer(watchModerationInterval)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-srv.closed:
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			p, ok := srv.fsPath(ev.Name)
+			if !ok {
+				continue
+			}
+			if ignored, err := srv.IgnorePath(p); err == nil && ignored {
+				continue
+			}
+			logger.Debug("filesystem event", "path", p, "op", ev.Op)
+			if ev.Has(fsnotify.Create) {
+				if fi, err := fs.Stat(srv.FS, p); err == nil && fi.IsDir() {
+					srv.addWatches(w, p)
+				}
+			}
+			if len(changed) == 0 {
+				timer.Reset(watchModerationInterval)
+			}
+			changed[p] = struct{}{}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logger.Info("filesystem watcher error", "error", err)
+		case <-timer.C:
+			srv.pathsChanged(changed)
+			changed = make(map[string]struct{})
+		}
+	}
+}
+
+// Watches the directory and every directory beneath it that isn't ignored.
+func (srv *Server) addWatches(w *fsnotify.Watcher, dir string) {
+	err := fs.WalkDir(srv.FS, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != "." {
+			if ignored, err := srv.IgnorePath(p); err != nil || ignored {
+				return fs.SkipDir
+			}
+		}
+		name := srv.osPath(p)
+		if name == "" {
+			// The root container of several roots, or a root that isn't
+			// on the filesystem.
+			return nil
+		}
+		if err := w.Add(name); err != nil {
+			// Most likely the limit on watches has been reached.
+			srv.Logger.Info("error watching directory", "path", p, "error", err)
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		srv.Logger.Info("error walking directory to watch", "path", dir, "error", err)
+	}
+}
+
+// Applies changes to the given paths to the library index, and bumps the
+// update IDs of the containers that hold them.
+func (srv *Server) pathsChanged(paths map[string]struct{}) {
+	containers := make(map[string]struct{})
+	// Views affected by the changes. Only the top of each view is bumped, as
+	// working out which virtual containers changed would mean rebuilding
+	// the view before and after.
+	views := make(map[string]struct{})
+	for p := range paths {
+		if srv.library != nil {
+			if err := srv.library.Update(p); err != nil {
+				srv.Logger.Info("error updating library", "path", p, "error", err)
+			}
+		}
+		containers[path.Dir(p)] = struct{}{}
+		if key, ok := viewKeyForMimeType(mimeTypeByBaseName(path.Base(p))); ok && srv.viewsEnabled() {
+			views[key] = struct{}{}
+		}
+	}
+	ids := make([]string, 0, len(containers)+len(views))
+	for dir := range containers {
+		id, err := srv.pathObjectID(object{Path: dir, RootObjectPath: srv.RootObjectPath})
+		if err != nil {
+			// The container itself has gone, and its parent is evented.
+			continue
+		}
+		ids = append(ids, id)
+	}
+	for key := range views {
+		ids = append(ids, virtualIDPrefix+key)
+	}
+	srv.contentDirectory.containersChanged(ids)
+}
@@ -0,0 +1,241 @@
+// Package exif reads the few EXIF tags needed to present photos: when they
+// were taken, and how they should be rotated. Only JPEG files are supported.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNoExif = errors.New("no exif data")
+
+// Exif holds the tags of interest from a file's EXIF data.
+type Exif struct {
+	// The EXIF orientation, from 1 to 8. 1, the default, means no
+	// transformation is needed.
+	Orientation int
+	// When the photo was taken. Zero if unknown.
+	DateTimeOriginal time.Time
+	// When the file was last changed. Zero if unknown.
+	DateTime time.Time
+}
+
+// Date returns the best known date for the photo.
+func (me *Exif) Date() time.Time {
+	if !me.DateTimeOriginal.IsZero() {
+		return me.DateTimeOriginal
+	}
+	return me.DateTime
+}
+
+const (
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagOffsetTime         = 0x9010
+)
+
+const dateTimeLayout = "2006:01:02 15:04:05"
+
+// Decode reads the EXIF data from a JPEG file. ErrNoExif is returned if the
+// file doesn't have any.
+func Decode(r io.Reader) (*Exif, error) {
+	tiff, err := findTIFF(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return parseTIFF(tiff)
+}
+
+// Returns the TIFF structure from the JPEG's APP1 Exif segment.
+func findTIFF(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return nil, errors.New("not a jpeg")
+	}
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xff {
+			return nil, errors.New("bad jpeg marker")
+		}
+		switch {
+		case marker[1] == 0xff:
+			// Fill byte.
+			r.UnreadByte()
+			continue
+		case marker[1] == 0xda || marker[1] == 0xd9:
+			// Start of scan, or end of image. Metadata comes before these.
+			return nil, ErrNoExif
+		case marker[1] >= 0xd0 && marker[1] <= 0xd7 || marker[1] == 0x01:
+			// Markers without a length.
+			continue
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errors.New("bad jpeg segment length")
+		}
+		if marker[1] != 0xe1 {
+			if _, err := r.Discard(int(length) - 2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		// APP1 is also used for XMP, so keep looking if this isn't EXIF.
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return tiff, nil
+		}
+	}
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	// The value if it fits in 4 bytes, otherwise the offset of the value.
+	value []byte
+}
+
+func parseTIFF(data []byte) (*Exif, error) {
+	if len(data) < 8 {
+		return nil, errors.New("short tiff header")
+	}
+	tr := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return nil, errors.New("bad tiff byte order")
+	}
+	if tr.order.Uint16(data[2:]) != 42 {
+		return nil, errors.New("bad tiff magic")
+	}
+	ifd0, err := tr.ifd(tr.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+	ret := &Exif{Orientation: 1}
+	var offsetTime, offsetTimeOriginal string
+	var dateTime, dateTimeOriginal string
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagOrientation:
+			if o := int(tr.short(e)); o >= 1 && o <= 8 {
+				ret.Orientation = o
+			}
+		case tagDateTime:
+			dateTime = tr.ascii(e)
+		case tagExifIFD:
+			exifIFD, err := tr.ifd(tr.order.Uint32(e.value))
+			if err != nil {
+				// Keep what we have from IFD0.
+				break
+			}
+			for _, e := range exifIFD {
+				switch e.tag {
+				case tagDateTimeOriginal:
+					dateTimeOriginal = tr.ascii(e)
+				case tagOffsetTimeOriginal:
+					offsetTimeOriginal = tr.ascii(e)
+				case tagOffsetTime:
+					offsetTime = tr.ascii(e)
+				}
+			}
+		}
+	}
+	ret.DateTime = parseDateTime(dateTime, offsetTime)
+	ret.DateTimeOriginal = parseDateTime(dateTimeOriginal, offsetTimeOriginal)
+	return ret, nil
+}
+
+// Reads the entries of the IFD at the given offset.
+func (tr tiffReader) ifd(offset uint32) ([]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(tr.data)) {
+		return nil, errors.New("ifd offset out of range")
+	}
+	n := int(tr.order.Uint16(tr.data[offset:]))
+	start := int(offset) + 2
+	if start+12*n > len(tr.data) {
+		return nil, errors.New("ifd overruns data")
+	}
+	entries := make([]ifdEntry, 0, n)
+	for i := 0; i < n; i++ {
+		b := tr.data[start+12*i:]
+		entries = append(entries, ifdEntry{
+			tag:   tr.order.Uint16(b),
+			typ:   tr.order.Uint16(b[2:]),
+			count: tr.order.Uint32(b[4:]),
+			value: b[8:12],
+		})
+	}
+	return entries, nil
+}
+
+func (tr tiffReader) short(e ifdEntry) uint16 {
+	const typeShort = 3
+	if e.typ != typeShort {
+		return 0
+	}
+	return tr.order.Uint16(e.value)
+}
+
+func (tr tiffReader) ascii(e ifdEntry) string {
+	const typeASCII = 2
+	if e.typ != typeASCII {
+		return ""
+	}
+	var b []byte
+	if e.count <= 4 {
+		b = e.value[:e.count]
+	} else {
+		offset := uint64(tr.order.Uint32(e.value))
+		if offset+uint64(e.count) > uint64(len(tr.data)) {
+			return ""
+		}
+		b = tr.data[offset : offset+uint64(e.count)]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+// Parses an EXIF date and time, in the zone given by an offset tag if there
+// is one. Without one they have no zone, and are taken to be local time.
+func parseDateTime(s, offset string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse(dateTimeLayout+"-07:00", s+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.ParseInLocation(dateTimeLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
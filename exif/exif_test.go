@@ -0,0 +1,110 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// Builds a JPEG with an EXIF segment holding IFD0 and an Exif IFD.
+func testJPEG(order binary.ByteOrder, ifd0, exifIFD []testEntry) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	ifdSize := func(entries []testEntry) int { return 2 + 12*len(entries) + 4 }
+	exifOffset := 8 + ifdSize(ifd0)
+	dataOffset := exifOffset + ifdSize(exifIFD)
+	var data bytes.Buffer
+	writeIFD := func(entries []testEntry) {
+		binary.Write(&tiff, order, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&tiff, order, e.tag)
+			binary.Write(&tiff, order, e.typ)
+			binary.Write(&tiff, order, e.count)
+			if e.tag == tagExifIFD {
+				binary.Write(&tiff, order, uint32(exifOffset))
+			} else if len(e.value) <= 4 {
+				var v [4]byte
+				copy(v[:], e.value)
+				tiff.Write(v[:])
+			} else {
+				binary.Write(&tiff, order, uint32(dataOffset+data.Len()))
+				data.Write(e.value)
+			}
+		}
+		binary.Write(&tiff, order, uint32(0))
+	}
+	writeIFD(ifd0)
+	writeIFD(exifIFD)
+	tiff.Write(data.Bytes())
+
+	var jpeg bytes.Buffer
+	jpeg.Write([]byte{0xff, 0xd8})
+	// An unrelated segment before the EXIF.
+	jpeg.Write([]byte{0xff, 0xe0, 0, 4, 'J', 'F'})
+	jpeg.Write([]byte{0xff, 0xe1})
+	binary.Write(&jpeg, binary.BigEndian, uint16(2+6+tiff.Len()))
+	jpeg.WriteString("Exif\x00\x00")
+	jpeg.Write(tiff.Bytes())
+	jpeg.Write([]byte{0xff, 0xda})
+	return jpeg.Bytes()
+}
+
+func asciiEntry(tag uint16, s string) testEntry {
+	return testEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func TestDecode(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		orientation := make([]byte, 2)
+		order.PutUint16(orientation, 6)
+		data := testJPEG(order,
+			[]testEntry{
+				{tagOrientation, 3, 1, orientation},
+				asciiEntry(tagDateTime, "2021:05:06 07:08:09"),
+				{tagExifIFD, 4, 1, nil},
+			},
+			[]testEntry{
+				asciiEntry(tagDateTimeOriginal, "2020:01:02 03:04:05"),
+				asciiEntry(tagOffsetTimeOriginal, "+02:00"),
+			},
+		)
+		x, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.Orientation != 6 {
+			t.Errorf("%v: orientation %d", order, x.Orientation)
+		}
+		expected := time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC)
+		if !x.Date().Equal(expected) {
+			t.Errorf("%v: date %v, expected %v", order, x.Date(), expected)
+		}
+		if x.DateTime.Year() != 2021 {
+			t.Errorf("%v: date time %v", order, x.DateTime)
+		}
+	}
+}
+
+func TestDecodeNoExif(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 'J', 'F', 0xff, 0xda}))
+	if !errors.Is(err, ErrNoExif) {
+		t.Fatal(err)
+	}
+	if _, err := Decode(bytes.NewReader([]byte("GIF89a"))); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/anacrolix/ffprobe v1.1.0
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	golang.org/x/net v0.50.0
 	golang.org/x/sys v0.41.0
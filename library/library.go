@@ -0,0 +1,526 @@
+// Package library maintains an index of the files under a filesystem root,
+// holding the metadata, MIME types and probe results needed to answer
+// ContentDirectory requests without touching every file on each request. The
+// index is filled by a background scan and can be persisted between runs.
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+// Bumped when the on-disk format, or how entries are filled, changes
+// incompatibly. Indexes with another version are discarded on load.
+const fileVersion = 5
+
+// Entry is the indexed metadata for a file or directory.
+type Entry struct {
+	// Slash-separated path relative to the library root. The root is ".".
+	Path     string
+	Size     int64
+	Mode     fs.FileMode
+	ModTime  time.Time
+	MimeType string        `json:",omitempty"`
+	Probe    *ffprobe.Info `json:",omitempty"`
+	// When the media was created, according to its metadata. Zero if
+	// unknown.
+	Date time.Time `json:",omitzero"`
+	// Names of a directory's children that weren't ignored, in directory
+	// order.
+	Children []string `json:",omitempty"`
+	// From Library.ID, if it's set.
+	ID string `json:",omitempty"`
+
+	// The Library's generation when the entry was set.
+	generation uint64
+}
+
+func (e *Entry) IsDir() bool {
+	return e.Mode.IsDir()
+}
+
+// FileInfo returns an fs.FileInfo for the entry as it was when indexed.
+func (e *Entry) FileInfo() fs.FileInfo {
+	return fileInfo{e}
+}
+
+type fileInfo struct {
+	e *Entry
+}
+
+func (fi fileInfo) Name() string       { return path.Base(fi.e.Path) }
+func (fi fileInfo) Size() int64        { return fi.e.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.e.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.e.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+// Returns true if the entry still describes the file.
+func (e *Entry) current(fi fs.FileInfo) bool {
+	return e.ModTime.Equal(fi.ModTime()) && e.Size == fi.Size() && e.Mode == fi.Mode()
+}
+
+type Library struct {
+	FS fs.FS
+	// Where the index is persisted by Save and Load. Optional.
+	Path string
+	// Identifies what's indexed, such as the root directory's path. Load
+	// discards an index persisted for another root.
+	Root string
+	// Determines the MIME type of a regular file.
+	MimeType func(path string) (string, error)
+	// Probes a file. The entry has its MIME type set. Return a nil Info to
+	// skip probing. Optional.
+	Probe func(e *Entry) (*ffprobe.Info, error)
+	// Determines when a file's media was created. The entry has its MIME
+	// type and probe results set. Optional.
+	Date func(e *Entry) (time.Time, error)
+	// Reports whether a path should be left out of the index. Optional.
+	Ignore func(path string) (bool, error)
+	// Returns an identifier for a file or directory, kept in its entry.
+	// Optional.
+	ID     func(path string, fi fs.FileInfo) string
+	Logger *slog.Logger
+
+	mu      sync.RWMutex
+	entries map[string]*Entry
+	// Entry IDs to their paths.
+	ids map[string]string
+	// Incremented whenever entries change.
+	generation uint64
+}
+
+func (l *Library) logger() *slog.Logger {
+	if l.Logger == nil {
+		return slog.Default()
+	}
+	return l.Logger
+}
+
+// Get returns the indexed entry for the path, if there is one.
+func (l *Library) Get(p string) (e *Entry, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok = l.entries[path.Clean(p)]
+	return
+}
+
+// ByID returns the entry with the given ID, if there is one.
+func (l *Library) ByID(id string) (e *Entry, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	p, ok := l.ids[id]
+	if !ok {
+		return
+	}
+	e, ok = l.entries[p]
+	return
+}
+
+// GetCurrent returns the indexed entry for the path, reindexing it first if
+// the file has changed since it was indexed. ok is false if the path isn't
+// indexed, or can't be reindexed.
+func (l *Library) GetCurrent(p string) (e *Entry, ok bool) {
+	p = path.Clean(p)
+	if _, ok := l.Get(p); !ok {
+		return nil, false
+	}
+	fi, err := fs.Stat(l.FS, p)
+	if err != nil {
+		return nil, false
+	}
+	return l.GetCurrentInfo(p, fi)
+}
+
+// GetCurrentInfo is like GetCurrent, but takes the file's info from the
+// caller, such as from a directory listing, rather than statting it again.
+func (l *Library) GetCurrentInfo(p string, fi fs.FileInfo) (e *Entry, ok bool) {
+	p = path.Clean(p)
+	e, ok = l.Get(p)
+	if !ok || e.current(fi) {
+		return
+	}
+	if err := l.Update(p); err != nil {
+		l.logger().Info("error reindexing", "path", p, "error", err)
+		return nil, false
+	}
+	return l.Get(p)
+}
+
+// Len returns the number of indexed entries.
+func (l *Library) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// Generation returns a number that changes whenever the index does, so that
+// things derived from it can tell when they need rebuilding.
+func (l *Library) Generation() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.generation
+}
+
+// Entries calls f for every indexed entry, in no particular order, until it
+// returns false.
+func (l *Library) Entries(f func(*Entry) bool) {
+	l.mu.RLock()
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	l.mu.RUnlock()
+	for _, e := range entries {
+		if !f(e) {
+			return
+		}
+	}
+}
+
+// Children returns the indexed children of a directory. The directory is
+// reindexed first if it has changed on disk since it was indexed. ok is false
+// if the directory hasn't been indexed, in which case the caller should read
+// the filesystem itself.
+func (l *Library) Children(dir string) (children []*Entry, ok bool) {
+	dir = path.Clean(dir)
+	e, ok := l.GetCurrent(dir)
+	if !ok || !e.IsDir() {
+		return nil, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	children = make([]*Entry, 0, len(e.Children))
+	for _, name := range e.Children {
+		if child, ok := l.entries[path.Join(dir, name)]; ok {
+			children = append(children, child)
+		}
+	}
+	return children, true
+}
+
+// Scan indexes everything under the root, reusing existing entries for files
+// that haven't changed. Entries for files that no longer exist are removed if
+// the scan completes. Entries set since the scan started, including by
+// Update, are kept.
+func (l *Library) Scan(ctx context.Context) error {
+	started := l.Generation()
+	if err := l.scan(ctx, ".", true); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p, e := range l.entries {
+		if e.generation <= started {
+			l.deleteLocked(p)
+		}
+	}
+	return nil
+}
+
+// Update reindexes a single path. Directories have their list of children
+// refreshed, and any new subdirectories are indexed recursively. Paths that
+// no longer exist are removed along with anything beneath them.
+func (l *Library) Update(p string) error {
+	p = path.Clean(p)
+	if _, err := fs.Stat(l.FS, p); errors.Is(err, fs.ErrNotExist) {
+		l.remove(p)
+		return nil
+	}
+	if p != "." {
+		// A path the parent doesn't know about needs the parent's children
+		// updated too.
+		if parent, ok := l.Get(path.Dir(p)); ok && !parent.hasChild(path.Base(p)) {
+			p = parent.Path
+		}
+	}
+	return l.scan(context.Background(), p, false)
+}
+
+func (e *Entry) hasChild(name string) bool {
+	for _, c := range e.Children {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the entry for the path, and everything beneath it.
+func (l *Library) remove(p string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removeLocked(p)
+	if p == "." {
+		return
+	}
+	if parent, ok := l.entries[path.Dir(p)]; ok {
+		name := path.Base(p)
+		children := make([]string, 0, len(parent.Children))
+		for _, c := range parent.Children {
+			if c != name {
+				children = append(children, c)
+			}
+		}
+		l.generation++
+		updated := *parent
+		updated.Children = children
+		updated.generation = l.generation
+		l.entries[parent.Path] = &updated
+	}
+}
+
+func (l *Library) removeLocked(p string) {
+	e, ok := l.entries[p]
+	if !ok {
+		return
+	}
+	l.deleteLocked(p)
+	for _, c := range e.Children {
+		l.removeLocked(path.Join(p, c))
+	}
+}
+
+// Indexes p, descending into subdirectories if recursive is set or they
+// haven't been indexed before.
+func (l *Library) scan(ctx context.Context, p string, recursive bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fi, err := fs.Stat(l.FS, p)
+	if err != nil {
+		return err
+	}
+	e := l.index(p, fi)
+	if !e.IsDir() {
+		l.set(e)
+		return nil
+	}
+	listed := l.Generation()
+	dirEntries, err := fs.ReadDir(l.FS, p)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirEntries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		childPath := path.Join(p, de.Name())
+		if l.Ignore != nil {
+			ignored, err := l.Ignore(childPath)
+			if err != nil {
+				l.logger().Info("error checking ignored", "path", childPath, "error", err)
+				continue
+			}
+			if ignored {
+				continue
+			}
+		}
+		childFi, err := de.Info()
+		if err != nil {
+			l.logger().Info("error getting file info", "path", childPath, "error", err)
+			continue
+		}
+		e.Children = append(e.Children, de.Name())
+		if childFi.IsDir() {
+			// Existing directories are assumed to be unchanged beneath, unless
+			// the scan is recursive.
+			if _, indexed := l.Get(childPath); recursive || !indexed {
+				if err := l.scan(ctx, childPath, recursive); err != nil {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						return ctxErr
+					}
+					l.logger().Info("error indexing directory", "path", childPath, "error", err)
+				}
+			}
+			continue
+		}
+		l.set(l.index(childPath, childFi))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.entries[p]; ok {
+		for _, c := range old.Children {
+			if e.hasChild(c) {
+				continue
+			}
+			// Children set since the directory was read, such as by an
+			// Update while scanning, are newer than the listing.
+			if child, ok := l.entries[path.Join(p, c)]; ok && child.generation > listed {
+				e.Children = append(e.Children, c)
+				continue
+			}
+			l.removeLocked(path.Join(p, c))
+		}
+	}
+	l.setLocked(e)
+	return nil
+}
+
+func (l *Library) set(e *Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(e)
+}
+
+func (l *Library) setLocked(e *Entry) {
+	if l.entries == nil {
+		l.entries = make(map[string]*Entry)
+		l.ids = make(map[string]string)
+	}
+	if old, ok := l.entries[e.Path]; ok && old.ID != e.ID {
+		l.forgetIDLocked(old)
+	}
+	l.generation++
+	e.generation = l.generation
+	l.entries[e.Path] = e
+	if e.ID != "" {
+		l.ids[e.ID] = e.Path
+	}
+}
+
+// Removes the entry for a path, but not those beneath it.
+func (l *Library) deleteLocked(p string) {
+	if e, ok := l.entries[p]; ok {
+		l.forgetIDLocked(e)
+	}
+	delete(l.entries, p)
+	l.generation++
+}
+
+func (l *Library) forgetIDLocked(e *Entry) {
+	// Another entry might have taken the ID, such as a file that was moved.
+	if l.ids[e.ID] == e.Path {
+		delete(l.ids, e.ID)
+	}
+}
+
+// Returns a new entry for the file, reusing the MIME type and probe results
+// of an existing entry if the file hasn't changed. Directory children are
+// left for the caller to fill.
+func (l *Library) index(p string, fi fs.FileInfo) *Entry {
+	e := &Entry{
+		Path:    p,
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	if l.ID != nil {
+		e.ID = l.ID(p, fi)
+	}
+	if fi.IsDir() || !fi.Mode().IsRegular() {
+		return e
+	}
+	if old, ok := l.Get(p); ok && old.current(fi) {
+		e.MimeType = old.MimeType
+		e.Probe = old.Probe
+		e.Date = old.Date
+		return e
+	}
+	if l.MimeType != nil {
+		mimeType, err := l.MimeType(p)
+		if err != nil {
+			l.logger().Info("error determining mime type", "path", p, "error", err)
+		}
+		e.MimeType = mimeType
+	}
+	if l.Probe != nil {
+		info, err := l.Probe(e)
+		if err != nil {
+			l.logger().Info("error probing", "path", p, "error", err)
+		} else {
+			e.Probe = info
+		}
+	}
+	if l.Date != nil {
+		date, err := l.Date(e)
+		if err != nil {
+			l.logger().Info("error determining date", "path", p, "error", err)
+		}
+		e.Date = date
+	}
+	return e
+}
+
+type indexFile struct {
+	Version int
+	Root    string
+	Entries []*Entry
+}
+
+// Load replaces the index with the one persisted at Path.
+func (l *Library) Load() error {
+	f, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var file indexFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+	if file.Version != fileVersion {
+		return errors.New("index has unsupported version")
+	}
+	if file.Root != l.Root {
+		return fmt.Errorf("index is of another root: %q", file.Root)
+	}
+	entries := make(map[string]*Entry, len(file.Entries))
+	ids := make(map[string]string, len(file.Entries))
+	for _, e := range file.Entries {
+		entries[e.Path] = e
+		if e.ID != "" {
+			ids[e.ID] = e.Path
+		}
+	}
+	l.mu.Lock()
+	l.entries = entries
+	l.ids = ids
+	l.generation++
+	l.mu.Unlock()
+	return nil
+}
+
+// Save persists the index to Path, replacing any previous index atomically.
+func (l *Library) Save() error {
+	file := indexFile{Version: fileVersion, Root: l.Root}
+	l.Entries(func(e *Entry) bool {
+		file.Entries = append(file.Entries, e)
+		return true
+	})
+	f, err := os.CreateTemp(filepath.Dir(l.Path), filepath.Base(l.Path))
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(file)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		err = os.Remove(l.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), l.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
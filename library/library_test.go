@@ -0,0 +1,250 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+func newTestLibrary(fsys fstest.MapFS, probes *int) *Library {
+	return &Library{
+		FS: fsys,
+		MimeType: func(p string) (string, error) {
+			if strings.HasSuffix(p, ".mp4") {
+				return "video/mp4", nil
+			}
+			return "text/plain", nil
+		},
+		Probe: func(e *Entry) (*ffprobe.Info, error) {
+			if e.MimeType != "video/mp4" {
+				return nil, nil
+			}
+			*probes++
+			return &ffprobe.Info{Format: map[string]interface{}{"duration": "1.5"}}, nil
+		},
+		Ignore: func(p string) (bool, error) {
+			return strings.HasPrefix(path.Base(p), "."), nil
+		},
+	}
+}
+
+func childNames(t *testing.T, l *Library, dir string) (ret []string) {
+	children, ok := l.Children(dir)
+	if !ok {
+		t.Fatalf("%q not indexed", dir)
+	}
+	for _, c := range children {
+		ret = append(ret, c.FileInfo().Name())
+	}
+	return
+}
+
+func TestScanAndUpdate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"movies/a.mp4":   {Data: []byte("a")},
+		"movies/b.txt":   {Data: []byte("b")},
+		"movies/.hidden": {Data: []byte("h")},
+		"c.mp4":          {Data: []byte("c")},
+	}
+	var probes int
+	l := newTestLibrary(fsys, &probes)
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(childNames(t, l, "."), ","); got != "c.mp4,movies" {
+		t.Fatal(got)
+	}
+	if got := strings.Join(childNames(t, l, "movies"), ","); got != "a.mp4,b.txt" {
+		t.Fatal(got)
+	}
+	if probes != 2 {
+		t.Fatalf("probed %d times", probes)
+	}
+	e, ok := l.Get("movies/a.mp4")
+	if !ok || e.MimeType != "video/mp4" || e.Probe == nil {
+		t.Fatalf("%#v", e)
+	}
+
+	// Unchanged files aren't probed again.
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if probes != 2 {
+		t.Fatalf("probed %d times", probes)
+	}
+
+	// Changing a directory's modification time causes it to be reindexed
+	// when its children are requested.
+	fsys["movies/d.mp4"] = &fstest.MapFile{Data: []byte("d")}
+	delete(fsys, "movies/b.txt")
+	fsys["movies"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: time.Unix(1, 0)}
+	if got := strings.Join(childNames(t, l, "movies"), ","); got != "a.mp4,d.mp4" {
+		t.Fatal(got)
+	}
+	if _, ok := l.Get("movies/b.txt"); ok {
+		t.Fatal("removed file still indexed")
+	}
+	if probes != 3 {
+		t.Fatalf("probed %d times", probes)
+	}
+
+	// Removed directories take their descendants with them.
+	gen := l.Generation()
+	for name := range fsys {
+		if strings.HasPrefix(name, "movies") {
+			delete(fsys, name)
+		}
+	}
+	if err := l.Update("movies"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Get("movies/a.mp4"); ok {
+		t.Fatal("file in removed directory still indexed")
+	}
+	if l.Generation() == gen {
+		t.Fatal("generation unchanged by update")
+	}
+	if got := strings.Join(childNames(t, l, "."), ","); got != "c.mp4" {
+		t.Fatal(got)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.mp4": {Data: []byte("a")},
+	}
+	var probes int
+	l := newTestLibrary(fsys, &probes)
+	l.Path = filepath.Join(t.TempDir(), "index")
+	l.ID = func(p string, fi fs.FileInfo) string { return "id:" + p }
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestLibrary(fsys, &probes)
+	loaded.Path = l.Path
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != l.Len() {
+		t.Fatalf("loaded %d entries, expected %d", loaded.Len(), l.Len())
+	}
+	if e, ok := loaded.ByID("id:a.mp4"); !ok || e.Path != "a.mp4" {
+		t.Fatal("entry not found by ID")
+	}
+	if _, ok := loaded.ByID("id:b.mp4"); ok {
+		t.Fatal("found entry by unknown ID")
+	}
+	if err := loaded.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if probes != 1 {
+		t.Fatalf("probed %d times", probes)
+	}
+}
+
+func TestLoadOtherRoot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.mp4": {Data: []byte("a")},
+	}
+	var probes int
+	l := newTestLibrary(fsys, &probes)
+	l.Path = filepath.Join(t.TempDir(), "index")
+	l.Root = "/media/a"
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestLibrary(fsys, &probes)
+	other.Path = l.Path
+	other.Root = "/media/b"
+	if err := other.Load(); err == nil {
+		t.Fatal("loaded index of another root")
+	}
+	if other.Len() != 0 {
+		t.Fatal(other.Len())
+	}
+}
+
+func TestFailedProbeNotIndexed(t *testing.T) {
+	var probes int
+	l := newTestLibrary(fstest.MapFS{"a.mp4": {Data: []byte("a")}}, &probes)
+	l.Probe = func(e *Entry) (*ffprobe.Info, error) {
+		return &ffprobe.Info{}, errors.New("ffprobe failed")
+	}
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := l.Get("a.mp4"); !ok || e.Probe != nil {
+		t.Fatalf("%#v", e)
+	}
+}
+
+func TestUpdateDuringScan(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.mp4": {Data: []byte("a")},
+		"b.mp4": {Data: []byte("b")},
+	}
+	var probes int
+	l := newTestLibrary(fsys, &probes)
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ignore := l.Ignore
+	l.Ignore = func(p string) (bool, error) {
+		// A file turns up after a rescan has read the root, and the watcher
+		// updates it.
+		if p == "b.mp4" && fsys["new.mp4"] == nil {
+			fsys["new.mp4"] = &fstest.MapFile{Data: []byte("new")}
+			if err := l.Update("new.mp4"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ignore(p)
+	}
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Get("new.mp4"); !ok {
+		t.Fatal("entry from update removed by scan")
+	}
+	if got := strings.Join(childNames(t, l, "."), ","); got != "a.mp4,b.mp4,new.mp4" {
+		t.Fatal(got)
+	}
+}
+
+func TestGetCurrentInfo(t *testing.T) {
+	fsys := fstest.MapFS{"a.mp4": {Data: []byte("a")}}
+	var probes int
+	l := newTestLibrary(fsys, &probes)
+	if err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The info given is trusted, so the file isn't statted.
+	e, _ := l.Get("a.mp4")
+	delete(fsys, "a.mp4")
+	if got, ok := l.GetCurrentInfo("a.mp4", e.FileInfo()); !ok || got != e {
+		t.Fatal(got, ok)
+	}
+	// Info that differs from the entry's has the file reindexed.
+	fsys["a.mp4"] = &fstest.MapFile{Data: []byte("changed")}
+	fi, err := fs.Stat(fsys, "a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := l.GetCurrentInfo("a.mp4", fi); !ok || got.Size != 7 || probes != 2 {
+		t.Fatal(got, ok, probes)
+	}
+}
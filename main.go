@@ -27,6 +27,7 @@ import (
 
 	"github.com/anacrolix/dms/dlna/dms"
 	"github.com/anacrolix/dms/rrcache"
+	"github.com/anacrolix/dms/transcode"
 )
 
 //go:embed "data/VGC Sonic.png"
@@ -53,6 +54,62 @@ type dmsConfig struct {
 	AllowedIpNets       []*net.IPNet `json:"-"` // Parsed IP networks, not directly from JSON
 	AllowDynamicStreams bool
 	TranscodeLogPattern string
+	NoIndex             bool
+	IndexPath           string
+	NoWatch             bool
+	NoViews             bool
+	// Transcode profiles added to, or replacing by name, the defaults.
+	TranscodeProfiles []transcode.Profile
+	// JSON file of transcode profiles, applied after TranscodeProfiles.
+	TranscodeProfilesPath string
+	// Device profiles tried before the builtin ones.
+	DeviceProfiles []dms.DeviceProfile
+	// JSON file of device profiles, tried before DeviceProfiles.
+	DeviceProfilesPath string
+	HLSCachePath       string
+	HLSCacheSize       int64
+	HLSWorkers         int
+	// The most /res transcodes run at once. Zero means no limit.
+	MaxTranscodes         int
+	TranscodeQueueTimeout time.Duration
+	// Paths to external tools. They're looked up on PATH if empty.
+	FFmpegPath  string
+	FFprobePath string
+	// Where thumbnails of images and videos are cached.
+	ThumbnailCachePath string
+	ThumbnailCacheSize int64
+	// Audio languages transcodes use if a video has several, most preferred
+	// first.
+	PreferredAudioLanguages []string
+	// Named directories to serve, each as a container in the root container,
+	// instead of Path.
+	Roots []dms.Root
+}
+
+// The -path flag. It can be given several times, and a value can be named
+// with "name=" before the directory, to serve several roots.
+type pathFlag []dms.Root
+
+func (me *pathFlag) String() string {
+	paths := make([]string, 0, len(*me))
+	for _, r := range *me {
+		paths = append(paths, r.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (me *pathFlag) Set(s string) error {
+	var r dms.Root
+	if name, dir, ok := strings.Cut(s, "="); ok {
+		r.Name, r.Path = name, dir
+	} else {
+		r.Path = s
+	}
+	if r.Path == "" {
+		return fmt.Errorf("no directory in %q", s)
+	}
+	*me = append(*me, r)
+	return nil
 }
 
 func (config *dmsConfig) load(configPath string) {
@@ -72,15 +129,17 @@ func (config *dmsConfig) load(configPath string) {
 
 // default config
 var config = &dmsConfig{
-	Path:             "",
-	IfName:           "",
-	Http:             ":1338",
-	FriendlyName:     "",
-	DeviceIcon:       "",
-	DeviceIconSizes:  []string{"48,128"},
-	LogHeaders:       false,
-	FFprobeCachePath: getDefaultFFprobeCachePath(),
-	ForceTranscodeTo: "",
+	Path:               "",
+	IfName:             "",
+	Http:               ":1338",
+	FriendlyName:       "",
+	DeviceIcon:         "",
+	DeviceIconSizes:    []string{"48,128"},
+	LogHeaders:         false,
+	FFprobeCachePath:   getDefaultFFprobeCachePath(),
+	ForceTranscodeTo:   "",
+	IndexPath:          getDefaultIndexPath(),
+	ThumbnailCachePath: getDefaultThumbnailCachePath(),
 }
 
 func getDefaultFFprobeCachePath() (path string) {
@@ -93,6 +152,26 @@ func getDefaultFFprobeCachePath() (path string) {
 	return
 }
 
+func getDefaultIndexPath() (path string) {
+	_user, err := user.Current()
+	if err != nil {
+		slog.Info("error getting current user", "error", err)
+		return
+	}
+	path = filepath.Join(_user.HomeDir, ".dms-library")
+	return
+}
+
+func getDefaultThumbnailCachePath() (path string) {
+	_user, err := user.Current()
+	if err != nil {
+		slog.Info("error getting current user", "error", err)
+		return
+	}
+	path = filepath.Join(_user.HomeDir, ".dms-thumbnails")
+	return
+}
+
 type fFprobeCache struct {
 	c *rrcache.RRCache
 	sync.Mutex
@@ -128,7 +207,8 @@ func main() {
 }
 
 func mainErr() error {
-	path := flag.String("path", config.Path, "browse root path")
+	var paths pathFlag
+	flag.Var(&paths, "path", "browse root path. Give it more than once, optionally as name=path, to serve several roots")
 	ifName := flag.String("ifname", config.IfName, "specific SSDP network interface")
 	http := flag.String("http", config.Http, "http server port")
 	friendlyName := flag.String("friendlyName", config.FriendlyName, "server friendly name")
@@ -138,7 +218,7 @@ func mainErr() error {
 	fFprobeCachePath := flag.String("fFprobeCachePath", config.FFprobeCachePath, "path to FFprobe cache file")
 	configFilePath := flag.String("config", "", "json configuration file")
 	allowedIps := flag.String("allowedIps", "", "allowed ip of clients, separated by comma")
-	forceTranscodeTo := flag.String("forceTranscodeTo", config.ForceTranscodeTo, "force transcoding to certain format, supported: 'chromecast', 'vp8', 'web'")
+	forceTranscodeTo := flag.String("forceTranscodeTo", config.ForceTranscodeTo, "force transcoding with the named transcode profile, such as 'chromecast', 'vp8' or 'web'")
 	transcodeLogPattern := flag.String("transcodeLogPattern", "", "pattern where to write transcode logs to. The [tsname] placeholder is replaced with the name of the item currently being played. The default is $HOME/.dms/log/[tsname]")
 	flag.BoolVar(&config.NoTranscode, "noTranscode", false, "disable transcoding")
 	flag.BoolVar(&config.NoProbe, "noProbe", false, "disable media probing with ffprobe")
@@ -148,6 +228,22 @@ func mainErr() error {
 	flag.BoolVar(&config.IgnoreUnreadable, "ignoreUnreadable", false, "ignore unreadable files and directories")
 	ignorePaths := flag.String("ignore", "", "comma separated list of directories to ignore (i.e. thumbnails,thumbs)")
 	flag.BoolVar(&config.AllowDynamicStreams, "allowDynamicStreams", false, "activate support for dynamic streams described via .dms.json metadata files")
+	flag.BoolVar(&config.NoIndex, "noIndex", false, "disable the media library index and walk the filesystem on every browse")
+	indexPath := flag.String("indexPath", config.IndexPath, "path to the media library index file")
+	flag.BoolVar(&config.NoWatch, "noWatch", false, "don't watch the filesystem for changes to notify clients of")
+	flag.BoolVar(&config.NoViews, "noViews", false, "don't list the Music, Videos and Photos views in the root container")
+	flag.StringVar(&config.TranscodeProfilesPath, "transcodeProfiles", "", "json file of transcode profiles to add to or replace the defaults")
+	flag.StringVar(&config.DeviceProfilesPath, "deviceProfiles", "", "json file of device profiles to try before the builtin ones")
+	flag.StringVar(&config.HLSCachePath, "hlsCachePath", "", "directory beneath which to cache HLS segments. The default is the system temporary directory")
+	flag.Int64Var(&config.HLSCacheSize, "hlsCacheSize", dms.DefaultHLSCacheSize, "most bytes of HLS segments to cache")
+	flag.IntVar(&config.HLSWorkers, "hlsWorkers", 0, "most HLS segments to transcode at once. The default is the number of CPUs")
+	flag.IntVar(&config.MaxTranscodes, "maxTranscodes", runtime.NumCPU(), "most transcodes to run at once, or 0 for no limit. Identical requests share a transcode")
+	flag.DurationVar(&config.TranscodeQueueTimeout, "transcodeQueueTimeout", 10*time.Second, "how long a request waits for a transcode to finish when -maxTranscodes are running, before it's rejected")
+	flag.StringVar(&config.FFmpegPath, "ffmpegPath", "", "path to ffmpeg, used for transcoding and video thumbnails. The default is to look it up on PATH")
+	flag.StringVar(&config.FFprobePath, "ffprobePath", "", "path to ffprobe, used for probing media. The default is to look it up on PATH")
+	flag.StringVar(&config.ThumbnailCachePath, "thumbnailCachePath", config.ThumbnailCachePath, "directory to cache thumbnails in")
+	flag.Int64Var(&config.ThumbnailCacheSize, "thumbnailCacheSize", dms.DefaultThumbnailCacheSize, "most bytes of thumbnails to cache")
+	audioLanguages := flag.String("audioLanguages", "", "comma separated list of audio languages transcodes prefer for videos with several, as in their language tags (i.e. ger,deu,eng)")
 
 	flag.Parse()
 	if flag.NArg() != 0 {
@@ -157,7 +253,12 @@ func mainErr() error {
 
 	logger := slog.Default()
 
-	config.Path, _ = filepath.Abs(*path)
+	if len(paths) == 1 && paths[0].Name == "" {
+		config.Path = paths[0].Path
+	} else if len(paths) != 0 {
+		config.Roots = paths
+	}
+	config.Path, _ = filepath.Abs(config.Path)
 	config.IfName = *ifName
 	config.Http = *http
 	config.FriendlyName = *friendlyName
@@ -170,6 +271,10 @@ func mainErr() error {
 	config.ForceTranscodeTo = *forceTranscodeTo
 	config.IgnorePaths = strings.Split(*ignorePaths, ",")
 	config.TranscodeLogPattern = *transcodeLogPattern
+	config.IndexPath = *indexPath
+	if *audioLanguages != "" {
+		config.PreferredAudioLanguages = strings.Split(*audioLanguages, ",")
+	}
 
 	if config.TranscodeLogPattern == "" {
 		u, err := user.Current()
@@ -187,9 +292,43 @@ func mainErr() error {
 		}
 	}
 
+	for i := range config.Roots {
+		if config.Roots[i].Path != "" {
+			config.Roots[i].Path, _ = filepath.Abs(config.Roots[i].Path)
+		}
+	}
+
+	for i := range config.TranscodeProfiles {
+		if err := config.TranscodeProfiles[i].Validate(); err != nil {
+			return fmt.Errorf("transcode profile %q: %w", config.TranscodeProfiles[i].Name, err)
+		}
+	}
+	transcodeProfiles := transcode.MergeProfiles(transcode.DefaultProfiles, config.TranscodeProfiles)
+	if config.TranscodeProfilesPath != "" {
+		profiles, err := transcode.LoadProfilesFile(config.TranscodeProfilesPath)
+		if err != nil {
+			return fmt.Errorf("loading transcode profiles: %w", err)
+		}
+		transcodeProfiles = transcode.MergeProfiles(transcodeProfiles, profiles)
+	}
+	deviceProfiles := config.DeviceProfiles
+	if config.DeviceProfilesPath != "" {
+		profiles, err := dms.LoadDeviceProfilesFile(config.DeviceProfilesPath)
+		if err != nil {
+			return fmt.Errorf("loading device profiles: %w", err)
+		}
+		deviceProfiles = append(profiles, deviceProfiles...)
+	}
+
 	logger.Info("device icon sizes", "sizes", config.DeviceIconSizes)
 	logger.Info("allowed ip nets", "nets", config.AllowedIpNets)
-	logger.Info("serving folder", "path", config.Path)
+	if len(config.Roots) != 0 {
+		for _, r := range config.Roots {
+			logger.Info("serving folder", "path", r.Path)
+		}
+	} else {
+		logger.Info("serving folder", "path", config.Path)
+	}
 	if config.AllowDynamicStreams {
 		logger.Info("dynamic streams ARE allowed")
 	}
@@ -251,11 +390,14 @@ func mainErr() error {
 		}(),
 		FriendlyName:        config.FriendlyName,
 		RootObjectPath:      filepath.Clean(config.Path),
+		Roots:               config.Roots,
 		FFProbeCache:        cache,
 		LogHeaders:          config.LogHeaders,
 		NoTranscode:         config.NoTranscode,
 		AllowDynamicStreams: config.AllowDynamicStreams,
 		ForceTranscodeTo:    config.ForceTranscodeTo,
+		TranscodeProfiles:   transcodeProfiles,
+		DeviceProfiles:      deviceProfiles,
 		TranscodeLogPattern: config.TranscodeLogPattern,
 		NoProbe:             config.NoProbe,
 		Icons: func() []dms.Icon {
@@ -290,12 +432,26 @@ func mainErr() error {
 			}
 			return icons
 		}(),
-		StallEventSubscribe: config.StallEventSubscribe,
-		NotifyInterval:      config.NotifyInterval,
-		IgnoreHidden:        config.IgnoreHidden,
-		IgnoreUnreadable:    config.IgnoreUnreadable,
-		IgnorePaths:         config.IgnorePaths,
-		AllowedIpNets:       config.AllowedIpNets,
+		StallEventSubscribe:     config.StallEventSubscribe,
+		NotifyInterval:          config.NotifyInterval,
+		IgnoreHidden:            config.IgnoreHidden,
+		IgnoreUnreadable:        config.IgnoreUnreadable,
+		IgnorePaths:             config.IgnorePaths,
+		AllowedIpNets:           config.AllowedIpNets,
+		NoIndex:                 config.NoIndex,
+		IndexPath:               config.IndexPath,
+		NoWatch:                 config.NoWatch,
+		NoViews:                 config.NoViews,
+		HLSCachePath:            config.HLSCachePath,
+		HLSCacheSize:            config.HLSCacheSize,
+		HLSWorkers:              config.HLSWorkers,
+		MaxTranscodes:           config.MaxTranscodes,
+		TranscodeQueueTimeout:   config.TranscodeQueueTimeout,
+		FFmpegPath:              config.FFmpegPath,
+		FFprobePath:             config.FFprobePath,
+		ThumbnailCachePath:      config.ThumbnailCachePath,
+		ThumbnailCacheSize:      config.ThumbnailCacheSize,
+		PreferredAudioLanguages: config.PreferredAudioLanguages,
 	}
 	if err := dmsServer.Init(); err != nil {
 		slog.Error("error initing dms server", "error", err)
@@ -0,0 +1,203 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Encoder is an ffmpeg video encoder, and the arguments needed to use it.
+type Encoder struct {
+	// The ffmpeg encoder name, such as "libx264" or "h264_vaapi".
+	Name string
+	// The codec it produces, as named by ffprobe, such as "h264".
+	Codec string
+	// The ffmpeg -hwaccels method the encoder needs, or "" for software
+	// encoders.
+	HWAccel string
+	// Arguments given ahead of all others, such as to open a device.
+	GlobalArgs []string
+	// Filters applied after the profile's VideoFilter, such as to upload
+	// frames to a device.
+	Filter string
+	// Arguments following "-c:v Name".
+	Args []string
+}
+
+// Encoders are the video encoders dms knows how to use, hardware encoders
+// first, in order of preference for each codec.
+var Encoders = []Encoder{
+	{Name: "h264_nvenc", Codec: "h264", HWAccel: "cuda", Args: []string{"-preset", "p1", "-pix_fmt", "yuv420p"}},
+	{Name: "h264_qsv", Codec: "h264", HWAccel: "qsv", Args: []string{"-preset", "veryfast", "-pix_fmt", "nv12"}},
+	{Name: "h264_vaapi", Codec: "h264", HWAccel: "vaapi", GlobalArgs: vaapiGlobalArgs, Filter: vaapiFilter},
+	{Name: "h264_videotoolbox", Codec: "h264", HWAccel: "videotoolbox", Args: []string{"-realtime", "1", "-pix_fmt", "yuv420p"}},
+	{Name: "libx264", Codec: "h264", Args: []string{"-preset", "ultrafast", "-pix_fmt", "yuv420p"}},
+	{Name: "libopenh264", Codec: "h264", Args: []string{"-pix_fmt", "yuv420p"}},
+
+	{Name: "hevc_nvenc", Codec: "hevc", HWAccel: "cuda", Args: []string{"-preset", "p1", "-pix_fmt", "yuv420p"}},
+	{Name: "hevc_qsv", Codec: "hevc", HWAccel: "qsv", Args: []string{"-preset", "veryfast", "-pix_fmt", "nv12"}},
+	{Name: "hevc_vaapi", Codec: "hevc", HWAccel: "vaapi", GlobalArgs: vaapiGlobalArgs, Filter: vaapiFilter},
+	{Name: "hevc_videotoolbox", Codec: "hevc", HWAccel: "videotoolbox", Args: []string{"-realtime", "1", "-pix_fmt", "yuv420p"}},
+	{Name: "libx265", Codec: "hevc", Args: []string{"-preset", "ultrafast", "-pix_fmt", "yuv420p"}},
+
+	{Name: "vp8_vaapi", Codec: "vp8", HWAccel: "vaapi", GlobalArgs: vaapiGlobalArgs, Filter: vaapiFilter},
+	{Name: "libvpx", Codec: "vp8", Args: []string{"-deadline", "realtime", "-cpu-used", "8", "-b:v", "2M"}},
+
+	{Name: "vp9_qsv", Codec: "vp9", HWAccel: "qsv", Args: []string{"-pix_fmt", "nv12"}},
+	{Name: "vp9_vaapi", Codec: "vp9", HWAccel: "vaapi", GlobalArgs: vaapiGlobalArgs, Filter: vaapiFilter},
+	{Name: "libvpx-vp9", Codec: "vp9", Args: []string{"-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1", "-b:v", "2M"}},
+
+	{Name: "mpeg2_qsv", Codec: "mpeg2video", HWAccel: "qsv", Args: []string{"-pix_fmt", "nv12"}},
+	{Name: "mpeg2_vaapi", Codec: "mpeg2video", HWAccel: "vaapi", GlobalArgs: vaapiGlobalArgs, Filter: vaapiFilter},
+	{Name: "mpeg2video", Codec: "mpeg2video", Args: []string{"-pix_fmt", "yuv420p"}},
+}
+
+var (
+	vaapiGlobalArgs = []string{"-vaapi_device", "/dev/dri/renderD128"}
+	vaapiFilter     = "format=nv12,hwupload"
+)
+
+// SoftwareEncoder returns the preferred software encoder for the codec.
+func SoftwareEncoder(codec string) (*Encoder, bool) {
+	for i := range Encoders {
+		if e := &Encoders[i]; e.Codec == codec && e.HWAccel == "" {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Capabilities are what an ffmpeg binary supports.
+type Capabilities struct {
+	// Names of the available encoders.
+	Encoders map[string]bool
+	// Names of the available -hwaccels methods.
+	HWAccels map[string]bool
+}
+
+// ProbeCapabilities runs ffmpeg to find the encoders and hardware
+// acceleration methods it supports.
+func ProbeCapabilities(ffmpeg string) (ret Capabilities, err error) {
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return
+	}
+	ret.Encoders = parseEncoders(bytes.NewReader(out))
+	out, err = exec.Command(ffmpeg, "-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		return
+	}
+	ret.HWAccels = parseHWAccels(bytes.NewReader(out))
+	return
+}
+
+// Parses the output of ffmpeg -encoders, which lists encoders after a
+// legend ending in a line of dashes.
+func parseEncoders(r io.Reader) map[string]bool {
+	ret := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	listing := false
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if !listing {
+			listing = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			ret[fields[1]] = true
+		}
+	}
+	return ret
+}
+
+// Parses the output of ffmpeg -hwaccels, which lists one method per line
+// after a heading.
+func parseHWAccels(r io.Reader) map[string]bool {
+	ret := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		ret[line] = true
+	}
+	return ret
+}
+
+// Transcoder runs transcode profiles with an ffmpeg binary, using the best
+// encoders it has.
+type Transcoder struct {
+	FFmpeg string
+	// The encoder chosen for each codec.
+	encoders map[string]*Encoder
+}
+
+// NewTranscoder probes ffmpeg and chooses an encoder for each codec.
+// Hardware encoders are preferred if ffmpeg has them and a test encode with
+// them succeeds, and otherwise it falls back to software. If ffmpeg can't be
+// probed, software encoders are used.
+func NewTranscoder(ffmpeg string, logger *slog.Logger) *Transcoder {
+	t := &Transcoder{
+		FFmpeg:   ffmpeg,
+		encoders: make(map[string]*Encoder),
+	}
+	caps, err := ProbeCapabilities(ffmpeg)
+	if err != nil {
+		logger.Info("couldn't probe ffmpeg capabilities, using software encoders", "ffmpeg", ffmpeg, "error", err)
+		return t
+	}
+	for i := range Encoders {
+		e := &Encoders[i]
+		if t.encoders[e.Codec] != nil || !caps.Encoders[e.Name] {
+			continue
+		}
+		if e.HWAccel != "" {
+			if !caps.HWAccels[e.HWAccel] {
+				continue
+			}
+			if err := testEncoder(ffmpeg, e); err != nil {
+				logger.Info("hardware encoder unusable, falling back", "encoder", e.Name, "error", err)
+				continue
+			}
+		}
+		t.encoders[e.Codec] = e
+	}
+	return t
+}
+
+// Encodes a frame with the encoder, to check that the hardware it needs is
+// present.
+func testEncoder(ffmpeg string, e *Encoder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	args := append([]string{"-hide_banner", "-v", "error"}, e.GlobalArgs...)
+	args = append(args, "-f", "lavfi", "-i", "color=c=black:s=256x256:d=0.1")
+	if e.Filter != "" {
+		args = append(args, "-vf", e.Filter)
+	}
+	args = append(args, "-c:v", e.Name)
+	args = append(args, e.Args...)
+	args = append(args, "-frames:v", "1", "-f", "null", "-")
+	return exec.CommandContext(ctx, ffmpeg, args...).Run()
+}
+
+// Encoder returns the encoder to use for the codec.
+func (t *Transcoder) Encoder(codec string) (*Encoder, bool) {
+	if e, ok := t.encoders[codec]; ok {
+		return e, true
+	}
+	return SoftwareEncoder(codec)
+}
+
+// Transcode starts ffmpeg on the input with the profile's arguments, and
+// returns its output.
+func (t *Transcoder) Transcode(p *Profile, input string, start, length time.Duration, stderr io.Writer) (io.ReadCloser, error) {
+	e, _ := t.Encoder(p.VideoCodec)
+	return transcodePipe(append([]string{t.FFmpeg}, p.expandArgs(e, input, start, length)...), stderr)
+}
@@ -0,0 +1,98 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package transcode
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stand-in for ffmpeg that has VAAPI and NVENC encoders, but only a VAAPI
+// device. Transcodes print their arguments.
+const fakeFFmpeg = `#!/bin/sh
+case "$*" in
+*-encoders*)
+	cat <<EOF
+Encoders:
+ V..... = Video
+ ------
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ V....D h264_vaapi           H.264/AVC (VAAPI) (codec h264)
+ V....D hevc_vaapi           H.265/HEVC (VAAPI) (codec hevc)
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D libx265              libx265 H.265 / HEVC (codec hevc)
+ V....D mpeg2video           MPEG-2 video
+ A....D aac                  AAC (Advanced Audio Coding)
+EOF
+	;;
+*-hwaccels*)
+	printf 'Hardware acceleration methods:\nvaapi\n\n'
+	;;
+*"-c:v hevc_vaapi"*"-f null"*)
+	echo "no hevc profile on this device" >&2
+	exit 1
+	;;
+*"-f null"*)
+	;;
+*)
+	echo "$*"
+	;;
+esac
+`
+
+func TestTranscoderEncoders(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(fakeFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	var logs strings.Builder
+	tr := NewTranscoder("ffmpeg", slog.New(slog.NewTextHandler(&logs, nil)))
+	for codec, expected := range map[string]string{
+		// There's no CUDA for NVENC.
+		"h264": "h264_vaapi",
+		// The test encode fails, so it falls back to software.
+		"hevc":       "libx265",
+		"mpeg2video": "mpeg2video",
+		// Not in ffmpeg, so the software encoder is tried anyway.
+		"vp8": "libvpx",
+	} {
+		if e, ok := tr.Encoder(codec); !ok || e.Name != expected {
+			t.Errorf("%s: got %v", codec, e)
+		}
+	}
+	if !strings.Contains(logs.String(), "encoder=hevc_vaapi") {
+		t.Errorf("fallback not logged: %s", logs.String())
+	}
+
+	p := Profile{
+		Name:        "test",
+		VideoCodec:  "h264",
+		VideoFilter: "scale=-2:720",
+		Args:        []string{"-ss", StartPlaceholder, "-i", InputPlaceholder, VideoEncoderPlaceholder, "-f", "mp4", "pipe:"},
+	}
+	r, err := tr.Transcode(&p, "in.mkv", time.Minute, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, _ := io.ReadAll(r)
+	expected := "-vaapi_device /dev/dri/renderD128 -ss 0:01:00 -i in.mkv -vf scale=-2:720,format=nv12,hwupload -c:v h264_vaapi -f mp4 pipe:\n"
+	if string(out) != expected {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestTranscoderWithoutFFmpeg(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	tr := NewTranscoder("ffmpeg", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if e, ok := tr.Encoder("h264"); !ok || e.Name != "libx264" {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,475 @@
+package transcode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	. "github.com/anacrolix/dms/misc"
+)
+
+// Placeholders substituted in Profile.Args.
+const (
+	// The path of the file being transcoded.
+	InputPlaceholder = "{input}"
+	// The offset to start transcoding from.
+	StartPlaceholder = "{start}"
+	// The length to transcode. If the length isn't known, an argument
+	// containing this placeholder is dropped along with the option
+	// preceding it.
+	DurationPlaceholder = "{duration}"
+	// Replaced with the arguments that select the encoder for the profile's
+	// VideoCodec, and filter the video for it. It must be an argument on its
+	// own.
+	VideoEncoderPlaceholder = "{videoencoder}"
+)
+
+// Profile describes a transcode to a particular format, and the ffmpeg
+// arguments that produce it.
+type Profile struct {
+	// Identifies the profile in resource URLs and to -forceTranscodeTo.
+	Name string
+	// The MIME type of the output, such as "video/mp4".
+	MimeType string
+	// (optional) DLNA profile name of the output, such as "MPEG_PS_PAL".
+	DLNAProfileName string `json:",omitempty"`
+	// (optional) DLNA.ORG_FLAGS, if the default isn't suitable.
+	DLNAFlags string `json:",omitempty"`
+	// The arguments to ffmpeg, not including the executable. The output
+	// must be written to stdout, such as with "pipe:".
+	Args []string
+	// MIME types of the sources the profile applies to, such as "video/*"
+	// or "audio/flac". If empty, the profile applies to all video.
+	Sources []string `json:",omitempty"`
+	// (optional) The video codec the profile encodes, as named by ffprobe,
+	// such as "h264". The best encoder available for it is chosen at
+	// startup, and selected where Args has VideoEncoderPlaceholder.
+	VideoCodec string `json:",omitempty"`
+	// (optional) An ffmpeg filter graph applied to the video before it's
+	// encoded, such as "scale=-2:720".
+	VideoFilter string `json:",omitempty"`
+	// (optional) The audio codec of the output, as named by ffprobe, such as
+	// "mp3". Audio transcodes in codecs a client plays are offered to it
+	// first.
+	AudioCodec string `json:",omitempty"`
+
+	// Rendered into the video after VideoFilter, if set by BurnSubtitles.
+	subtitles *Subtitles
+	// The index of the only audio stream to transcode, if set by
+	// SelectAudio.
+	audioStream *int
+}
+
+// DefaultProfiles are the profiles available if none are configured.
+//
+// Profiles give the start and duration as input options, ahead of -i, so
+// that ffmpeg seeks in the input and the output's timestamps start at zero.
+var DefaultProfiles = []Profile{
+	{
+		Name:            "t",
+		MimeType:        "video/mpeg",
+		DLNAProfileName: "MPEG_PS_PAL",
+		VideoCodec:      "mpeg2video",
+		VideoFilter:     "scale=720:576",
+		Args: []string{
+			"-async", "1",
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:V:0", "-map", "0:a:0?",
+			VideoEncoderPlaceholder,
+			"-r", "25", "-b:v", "6000k", "-maxrate", "9000k", "-bufsize", "1835k",
+			"-c:a", "ac3", "-b:a", "224k", "-ac", "2", "-ar", "48000",
+			"-f", "mpegts",
+			"pipe:",
+		},
+	},
+	{
+		Name:       "vp8",
+		MimeType:   "video/webm",
+		VideoCodec: "vp8",
+		Args: []string{
+			"-async", "1",
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			VideoEncoderPlaceholder,
+			"-f", "webm",
+			"pipe:",
+		},
+	},
+	{
+		Name:       "chromecast",
+		MimeType:   "video/mp4",
+		VideoCodec: "h264",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			VideoEncoderPlaceholder,
+			"-profile:v", "high",
+			"-movflags", "+faststart+frag_keyframe+empty_moov",
+			"-f", "mp4",
+			"pipe:",
+		},
+	},
+	{
+		Name:       "web",
+		MimeType:   "video/mp4",
+		VideoCodec: "h264",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			VideoEncoderPlaceholder,
+			"-c:a", "mp3", "-ab", "128k", "-ar", "44100",
+			"-movflags", "+faststart+frag_keyframe+empty_moov",
+			"-f", "mp4",
+			"pipe:",
+		},
+	},
+	{
+		Name:            "mp3",
+		MimeType:        "audio/mpeg",
+		DLNAProfileName: "MP3",
+		Sources:         []string{"audio/*"},
+		AudioCodec:      "mp3",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:a:0",
+			"-c:a", "libmp3lame", "-b:a", "320k",
+			"-f", "mp3",
+			"pipe:",
+		},
+	},
+	{
+		Name:            "aac",
+		MimeType:        "audio/vnd.dlna.adts",
+		DLNAProfileName: "AAC_ADTS_320",
+		Sources:         []string{"audio/*"},
+		AudioCodec:      "aac",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:a:0",
+			"-c:a", "aac", "-b:a", "256k", "-ac", "2",
+			"-f", "adts",
+			"pipe:",
+		},
+	},
+	{
+		// DLNA's LPCM is 16-bit big-endian PCM, at 44.1 or 48kHz.
+		Name:            "lpcm",
+		MimeType:        "audio/L16;rate=44100;channels=2",
+		DLNAProfileName: "LPCM",
+		Sources:         []string{"audio/*"},
+		AudioCodec:      "pcm_s16be",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:a:0",
+			"-c:a", "pcm_s16be", "-ar", "44100", "-ac", "2",
+			"-f", "s16be",
+			"pipe:",
+		},
+	},
+	{
+		Name:       "wav",
+		MimeType:   "audio/wav",
+		Sources:    []string{"audio/*"},
+		AudioCodec: "pcm_s16le",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:a:0",
+			"-c:a", "pcm_s16le", "-ar", "48000", "-ac", "2",
+			"-f", "wav",
+			"pipe:",
+		},
+	},
+}
+
+// RemuxProfiles copy the source streams into another container without
+// reencoding, for clients that play the codecs but not the container. Each
+// is named "remux-" followed by the ffprobe format name of the container it
+// writes.
+var RemuxProfiles = []Profile{
+	{
+		Name:     "remux-mpegts",
+		MimeType: "video/mp2t",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:V:0", "-map", "0:a:0?",
+			"-c", "copy",
+			"-f", "mpegts",
+			"pipe:",
+		},
+	},
+	{
+		Name:     "remux-matroska",
+		MimeType: "video/x-matroska",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:V:0", "-map", "0:a?", "-map", "0:s?",
+			"-c", "copy",
+			"-f", "matroska",
+			"pipe:",
+		},
+	},
+	{
+		Name:     "remux-mp4",
+		MimeType: "video/mp4",
+		Args: []string{
+			"-ss", StartPlaceholder,
+			"-t", DurationPlaceholder,
+			"-i", InputPlaceholder,
+			"-map", "0:V:0", "-map", "0:a?",
+			"-c", "copy",
+			"-movflags", "+frag_keyframe+empty_moov",
+			"-f", "mp4",
+			"pipe:",
+		},
+	},
+}
+
+// HLSProfile transcodes one segment of an HLS stream. Segments are
+// transcoded independently, so their timestamps are offset to where each
+// starts in the source.
+var HLSProfile = Profile{
+	Name:       "hls",
+	MimeType:   "video/mp2t",
+	VideoCodec: "h264",
+	Args: []string{
+		"-ss", StartPlaceholder,
+		"-t", DurationPlaceholder,
+		"-i", InputPlaceholder,
+		"-map", "0:V:0", "-map", "0:a:0?",
+		VideoEncoderPlaceholder,
+		"-c:a", "aac", "-ac", "2", "-b:a", "160k",
+		"-output_ts_offset", StartPlaceholder,
+		"-f", "mpegts",
+		"pipe:",
+	},
+}
+
+// RemuxProfile returns the remux profile that writes the given container,
+// an ffprobe format name such as "matroska".
+func RemuxProfile(container string) (*Profile, bool) {
+	for i := range RemuxProfiles {
+		if RemuxProfiles[i].Name == "remux-"+container {
+			return &RemuxProfiles[i], true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks that the profile has what's needed to transcode.
+func (p *Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("missing name")
+	}
+	if p.MimeType == "" {
+		return errors.New("missing mime type")
+	}
+	hasInput, hasEncoder := false, false
+	for _, arg := range p.Args {
+		hasInput = hasInput || strings.Contains(arg, InputPlaceholder)
+		hasEncoder = hasEncoder || arg == VideoEncoderPlaceholder
+	}
+	if !hasInput {
+		return fmt.Errorf("args don't contain %s", InputPlaceholder)
+	}
+	if p.VideoCodec != "" {
+		if _, ok := SoftwareEncoder(p.VideoCodec); !ok {
+			return fmt.Errorf("no encoder for video codec %q", p.VideoCodec)
+		}
+	}
+	if hasEncoder != (p.VideoCodec != "") {
+		return fmt.Errorf("%s must be given with a video codec", VideoEncoderPlaceholder)
+	}
+	return nil
+}
+
+// AppliesTo reports whether the profile can transcode a source of the given
+// MIME type.
+func (p *Profile) AppliesTo(mimeType string) bool {
+	if len(p.Sources) == 0 {
+		return strings.HasPrefix(mimeType, "video/")
+	}
+	for _, pattern := range p.Sources {
+		if ok, _ := path.Match(pattern, mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandArgs returns the profile's arguments with the placeholders replaced,
+// using the software encoder for the video. A length of zero or less means
+// the rest of the input.
+func (p *Profile) ExpandArgs(input string, start, length time.Duration) []string {
+	e, _ := SoftwareEncoder(p.VideoCodec)
+	return p.expandArgs(e, input, start, length)
+}
+
+func (p *Profile) expandArgs(e *Encoder, input string, start, length time.Duration) (ret []string) {
+	if e != nil {
+		ret = append(ret, e.GlobalArgs...)
+	}
+	for _, arg := range p.args() {
+		if arg == VideoEncoderPlaceholder {
+			if e != nil {
+				ret = append(ret, e.args(p.videoFilter(input, start))...)
+			}
+			continue
+		}
+		if strings.Contains(arg, DurationPlaceholder) && length <= 0 {
+			if len(ret) != 0 && strings.HasPrefix(ret[len(ret)-1], "-") {
+				ret = ret[:len(ret)-1]
+			}
+			continue
+		}
+		arg = strings.ReplaceAll(arg, InputPlaceholder, input)
+		arg = strings.ReplaceAll(arg, StartPlaceholder, FormatDurationSexagesimal(start))
+		arg = strings.ReplaceAll(arg, DurationPlaceholder, FormatDurationSexagesimal(length))
+		ret = append(ret, arg)
+	}
+	return
+}
+
+// SelectAudio returns a copy of the profile that transcodes only the audio
+// stream with the given index, rather than those the profile chooses.
+func (p Profile) SelectAudio(stream int) Profile {
+	p.audioStream = &stream
+	return p
+}
+
+// Returns Args with the audio maps replaced by a map of the selected audio
+// stream. Profiles that don't map any streams get the video and the selected
+// audio mapped after the input, since ffmpeg maps nothing else once any
+// stream is. Those that map only video are left silent.
+func (p *Profile) args() []string {
+	if p.audioStream == nil {
+		return p.Args
+	}
+	audioMap := fmt.Sprintf("0:%d", *p.audioStream)
+	if !slices.Contains(p.Args, "-map") {
+		var ret []string
+		for _, arg := range p.Args {
+			ret = append(ret, arg)
+			if strings.Contains(arg, InputPlaceholder) {
+				ret = append(ret, "-map", "0:V:0?", "-map", audioMap)
+			}
+		}
+		return ret
+	}
+	var ret []string
+	mapped := false
+	for i := 0; i < len(p.Args); i++ {
+		if p.Args[i] == "-map" && i+1 < len(p.Args) && strings.HasPrefix(p.Args[i+1], "0:a") {
+			if !mapped {
+				ret = append(ret, "-map", audioMap)
+				mapped = true
+			}
+			i++
+			continue
+		}
+		ret = append(ret, p.Args[i])
+	}
+	return ret
+}
+
+// Returns the filter graph applied to the video before it's encoded.
+func (p *Profile) videoFilter(input string, start time.Duration) string {
+	if p.subtitles == nil {
+		return p.VideoFilter
+	}
+	filter := p.subtitles.filter(input, start)
+	if p.VideoFilter == "" {
+		return filter
+	}
+	return p.VideoFilter + "," + filter
+}
+
+// Returns the output arguments that encode with e, after applying filter.
+func (e *Encoder) args(filter string) (ret []string) {
+	var filters []string
+	for _, f := range []string{filter, e.Filter} {
+		if f != "" {
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) != 0 {
+		ret = append(ret, "-vf", strings.Join(filters, ","))
+	}
+	ret = append(ret, "-c:v", e.Name)
+	return append(ret, e.Args...)
+}
+
+// Transcode starts ffmpeg on the input with the profile's arguments, and
+// returns its output. The video is encoded in software.
+func (p *Profile) Transcode(ffmpeg, input string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	return transcodePipe(append([]string{ffmpeg}, p.ExpandArgs(input, start, length)...), stderr)
+}
+
+// LoadProfiles reads a JSON array of profiles.
+func LoadProfiles(r io.Reader) (ret []Profile, err error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err = d.Decode(&ret); err != nil {
+		return
+	}
+	for i := range ret {
+		if err = ret[i].Validate(); err != nil {
+			err = fmt.Errorf("profile %d (%q): %w", i, ret[i].Name, err)
+			return
+		}
+	}
+	return
+}
+
+// LoadProfilesFile reads a JSON array of profiles from a file.
+func LoadProfilesFile(name string) ([]Profile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadProfiles(f)
+}
+
+// MergeProfiles returns the base profiles with the overrides applied. An
+// override replaces the base profile with the same name, or is appended if
+// there isn't one.
+func MergeProfiles(base, overrides []Profile) []Profile {
+	ret := append([]Profile(nil), base...)
+	for _, o := range overrides {
+		replaced := false
+		for i := range ret {
+			if ret[i].Name == o.Name {
+				ret[i] = o
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,128 @@
+package transcode
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandArgs(t *testing.T) {
+	p := Profile{Args: []string{"-ss", StartPlaceholder, "-i", InputPlaceholder, "-t", DurationPlaceholder, "pipe:"}}
+	got := strings.Join(p.ExpandArgs("in.mkv", 90*time.Second, 30*time.Second), " ")
+	if got != "-ss 0:01:30 -i in.mkv -t 0:00:30 pipe:" {
+		t.Fatal(got)
+	}
+	// An unknown length drops the duration option entirely.
+	got = strings.Join(p.ExpandArgs("in.mkv", 0, -1), " ")
+	if got != "-ss 0:00:00 -i in.mkv pipe:" {
+		t.Fatal(got)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	profiles, err := LoadProfiles(strings.NewReader(`[
+		{"Name": "flac", "MimeType": "audio/flac", "Args": ["-i", "{input}", "-f", "flac", "pipe:"], "Sources": ["audio/*"]},
+		{"Name": "web", "MimeType": "video/webm", "Args": ["-i", "{input}", "pipe:"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !profiles[0].AppliesTo("audio/x-wav") || profiles[0].AppliesTo("video/mp4") {
+		t.Fatal("flac profile sources")
+	}
+	if !profiles[1].AppliesTo("video/mp4") {
+		t.Fatal("default sources should be video")
+	}
+	merged := MergeProfiles(DefaultProfiles, profiles)
+	if len(merged) != len(DefaultProfiles)+1 {
+		t.Fatal(len(merged))
+	}
+	for _, p := range merged {
+		if p.Name == "web" && p.MimeType != "video/webm" {
+			t.Fatal("web profile not replaced")
+		}
+	}
+
+	for _, bad := range []string{
+		`[{"MimeType": "video/mp4", "Args": ["{input}"]}]`,
+		`[{"Name": "x", "MimeType": "video/mp4", "Args": ["pipe:"]}]`,
+		`[{"Name": "x", "MimeType": "video/mp4", "Args": ["{input}"], "Bogus": 1}]`,
+		`[{"Name": "x", "MimeType": "video/mp4", "Args": ["{input}", "{videoencoder}"]}]`,
+		`[{"Name": "x", "MimeType": "video/mp4", "Args": ["{input}", "{videoencoder}"], "VideoCodec": "theora"}]`,
+	} {
+		if _, err := LoadProfiles(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error loading %s", bad)
+		}
+	}
+}
+
+func TestDefaultProfilesValid(t *testing.T) {
+	for _, p := range DefaultProfiles {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s: %v", p.Name, err)
+		}
+	}
+}
+
+// Seeks must start and stop the input where requested for every profile.
+func TestProfileSeekArgs(t *testing.T) {
+	for _, tc := range []struct {
+		profile, expected string
+	}{
+		{"t", "-async 1 -ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:V:0 -map 0:a:0? -vf scale=720:576 -c:v mpeg2video -pix_fmt yuv420p -r 25 -b:v 6000k -maxrate 9000k -bufsize 1835k -c:a ac3 -b:a 224k -ac 2 -ar 48000 -f mpegts pipe:"},
+		{"vp8", "-async 1 -ss 0:01:30.5 -t 0:00:30 -i in.mkv -c:v libvpx -deadline realtime -cpu-used 8 -b:v 2M -f webm pipe:"},
+		{"chromecast", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -c:v libx264 -preset ultrafast -pix_fmt yuv420p -profile:v high -movflags +faststart+frag_keyframe+empty_moov -f mp4 pipe:"},
+		{"web", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -c:v libx264 -preset ultrafast -pix_fmt yuv420p -c:a mp3 -ab 128k -ar 44100 -movflags +faststart+frag_keyframe+empty_moov -f mp4 pipe:"},
+		{"mp3", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:a:0 -c:a libmp3lame -b:a 320k -f mp3 pipe:"},
+		{"aac", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:a:0 -c:a aac -b:a 256k -ac 2 -f adts pipe:"},
+		{"lpcm", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:a:0 -c:a pcm_s16be -ar 44100 -ac 2 -f s16be pipe:"},
+		{"wav", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:a:0 -c:a pcm_s16le -ar 48000 -ac 2 -f wav pipe:"},
+		{"remux-mpegts", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:V:0 -map 0:a:0? -c copy -f mpegts pipe:"},
+		{"remux-matroska", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:V:0 -map 0:a? -map 0:s? -c copy -f matroska pipe:"},
+		{"remux-mp4", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:V:0 -map 0:a? -c copy -movflags +frag_keyframe+empty_moov -f mp4 pipe:"},
+		{"hls", "-ss 0:01:30.5 -t 0:00:30 -i in.mkv -map 0:V:0 -map 0:a:0? -c:v libx264 -preset ultrafast -pix_fmt yuv420p -c:a aac -ac 2 -b:a 160k -output_ts_offset 0:01:30.5 -f mpegts pipe:"},
+	} {
+		var p *Profile
+		for _, profiles := range [][]Profile{DefaultProfiles, RemuxProfiles, {HLSProfile}} {
+			for i := range profiles {
+				if profiles[i].Name == tc.profile {
+					p = &profiles[i]
+				}
+			}
+		}
+		if p == nil {
+			t.Errorf("no profile %q", tc.profile)
+			continue
+		}
+		got := strings.Join(p.ExpandArgs("in.mkv", 90*time.Second+500*time.Millisecond, 30*time.Second), " ")
+		if got != tc.expected {
+			t.Errorf("%s: got %q", tc.profile, got)
+		}
+		// Open-ended ranges run to the end of the input.
+		got = strings.Join(p.ExpandArgs("in.mkv", 90*time.Second+500*time.Millisecond, 0), " ")
+		if expected := strings.Replace(tc.expected, " -t 0:00:30", "", 1); got != expected {
+			t.Errorf("%s: got %q", tc.profile, got)
+		}
+	}
+}
+
+func TestSelectAudio(t *testing.T) {
+	for _, tc := range []struct {
+		profile  Profile
+		expected string
+	}{
+		// Audio maps are replaced.
+		{DefaultProfiles[0], "-i in.mkv -map 0:V:0 -map 0:2 -vf"},
+		{RemuxProfiles[1], "-i in.mkv -map 0:V:0 -map 0:2 -map 0:s? -c copy"},
+		// Profiles without maps get the video too.
+		{DefaultProfiles[2], "-i in.mkv -map 0:V:0? -map 0:2 -c:v libx264"},
+	} {
+		p := tc.profile.SelectAudio(2)
+		if got := strings.Join(p.ExpandArgs("in.mkv", 0, 0), " "); !strings.Contains(got, tc.expected) {
+			t.Errorf("%s: got %q", p.Name, got)
+		}
+	}
+	if got := strings.Join(DefaultProfiles[0].ExpandArgs("in.mkv", 0, 0), " "); !strings.Contains(got, "-map 0:a:0?") {
+		t.Fatal(got)
+	}
+}
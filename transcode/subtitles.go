@@ -0,0 +1,68 @@
+package transcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subtitles to render into the video with ffmpeg's subtitles filter, for
+// clients that don't show subtitles themselves.
+type Subtitles struct {
+	// The file the subtitles are read from, or "" for the input.
+	File string
+	// The index of the stream among the file's subtitle streams, or -1 for
+	// the first.
+	Stream int
+}
+
+// BurnSubtitles returns a copy of the profile that renders the subtitles
+// into the video before it's encoded. The profile must have a VideoCodec,
+// since copied video can't be filtered.
+func (p Profile) BurnSubtitles(s Subtitles) Profile {
+	p.subtitles = &s
+	return p
+}
+
+// CanBurnSubtitles reports whether the profile encodes video, and so can
+// have subtitles rendered into it.
+func (p *Profile) CanBurnSubtitles() bool {
+	return p.VideoCodec != ""
+}
+
+// Returns the filter that renders the subtitles, for a transcode of input
+// from start. The subtitles filter goes by the timestamps of the frames,
+// which begin at zero when the input is seeked, so they're moved back to
+// where they are in the source while it renders.
+func (s *Subtitles) filter(input string, start time.Duration) string {
+	file := s.File
+	if file == "" {
+		file = input
+	}
+	f := "subtitles=filename=" + escapeFilterValue(file)
+	if s.Stream >= 0 {
+		f += ":si=" + strconv.Itoa(s.Stream)
+	}
+	if start <= 0 {
+		return f
+	}
+	return fmt.Sprintf("setpts=PTS+%s/TB,%s,setpts=PTS-STARTPTS", strconv.FormatFloat(start.Seconds(), 'f', 3, 64), f)
+}
+
+// Escapes a filter option value for use in a filter graph, such as a path
+// that might contain colons or quotes. It's escaped once for the option, and
+// again for the graph.
+func escapeFilterValue(s string) string {
+	escape := func(s, special string) string {
+		var b strings.Builder
+		for _, r := range s {
+			if strings.ContainsRune(special, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	return escape(escape(s, `\':`), `\'[],;`)
+}
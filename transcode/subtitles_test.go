@@ -0,0 +1,27 @@
+package transcode
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurnSubtitles(t *testing.T) {
+	p := DefaultProfiles[0].BurnSubtitles(Subtitles{File: "/media/it's: a [film].en.srt", Stream: -1})
+	got := strings.Join(p.ExpandArgs("in.mkv", 0, 0), " ")
+	if !strings.Contains(got, ` -vf scale=720:576,subtitles=filename=/media/it\\\'s\\: a \[film\].en.srt -c:v mpeg2video `) {
+		t.Fatal(got)
+	}
+	if DefaultProfiles[0].subtitles != nil {
+		t.Fatal("profile modified")
+	}
+	// Seeked transcodes render the subtitles from where they start.
+	p = DefaultProfiles[2].BurnSubtitles(Subtitles{Stream: 1})
+	got = strings.Join(p.ExpandArgs("in.mkv", 90*time.Second+500*time.Millisecond, 0), " ")
+	if !strings.Contains(got, " -vf setpts=PTS+90.500/TB,subtitles=filename=in.mkv:si=1,setpts=PTS-STARTPTS -c:v libx264 ") {
+		t.Fatal(got)
+	}
+	if RemuxProfiles[0].CanBurnSubtitles() || !p.CanBurnSubtitles() {
+		t.Fatal("CanBurnSubtitles")
+	}
+}
@@ -6,28 +6,29 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"os/exec"
-	"runtime"
-	"strconv"
 	"time"
-
-	"github.com/anacrolix/ffprobe"
-
-	. "github.com/anacrolix/dms/misc"
 )
 
 // Invokes an external command and returns a reader from its stdout. The
-// command is waited on asynchronously.
+// command is waited on asynchronously. Closing the reader kills the command
+// if it's still running.
 func transcodePipe(args []string, stderr io.Writer) (r io.ReadCloser, err error) {
 	slog.Info("transcode command", "args", args)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stderr = stderr
-	r, err = cmd.StdoutPipe()
+	// Cmd.StdoutPipe is closed by Wait, which would lose output not yet
+	// read when the command exits.
+	pr, pw, err := os.Pipe()
 	if err != nil {
 		return
 	}
+	cmd.Stdout = pw
 	err = cmd.Start()
+	pw.Close()
 	if err != nil {
+		pr.Close()
 		return
 	}
 	go func() {
@@ -36,134 +37,19 @@ func transcodePipe(args []string, stderr io.Writer) (r io.ReadCloser, err error)
 			slog.Info("command failed", "args", args, "error", err)
 		}
 	}()
+	r = cmdOutput{pr, cmd}
 	return
 }
 
-// Return a series of ffmpeg arguments that pick specific codecs for specific
-// streams. This requires use of the -map flag.
-func streamArgs(s map[string]interface{}) (ret []string) {
-	defer func() {
-		if len(ret) != 0 {
-			ret = append(ret, []string{
-				"-map", "0:" + strconv.Itoa(int(s["index"].(float64))),
-			}...)
-		}
-	}()
-	switch s["codec_type"] {
-	case "video":
-		/*
-			if s["codec_name"] == "h264" {
-				if i, _ := strconv.ParseInt(s["is_avc"], 0, 0); i != 0 {
-					return []string{"-vcodec", "copy", "-sameq", "-vbsf", "h264_mp4toannexb"}
-				}
-			}
-		*/
-		return []string{"-target", "pal-dvd"}
-	case "audio":
-		if s["codec_name"] == "dca" {
-			return []string{"-acodec", "ac3", "-ab", "224k", "-ac", "2"}
-		} else {
-			return []string{"-acodec", "copy"}
-		}
-	case "subtitle":
-		return []string{"-scodec", "copy"}
-	}
-	return
-}
-
-// Streams the desired file in the MPEG_PS_PAL DLNA profile.
-func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
-		"-threads", strconv.FormatInt(int64(runtime.NumCPU()), 10),
-		"-async", "1",
-		"-ss", FormatDurationSexagesimal(start),
-	}
-	if length >= 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
-	}
-	args = append(args, []string{
-		"-i", path,
-	}...)
-	info, err := ffprobe.Run(path)
-	if err != nil {
-		return
-	}
-	for _, s := range info.Streams {
-		args = append(args, streamArgs(s)...)
-	}
-	args = append(args, []string{"-f", "mpegts", "pipe:"}...)
-	return transcodePipe(args, stderr)
-}
-
-// Returns a stream of Chromecast supported VP8.
-func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"avconv",
-		"-threads", strconv.FormatInt(int64(runtime.NumCPU()), 10),
-		"-async", "1",
-		"-ss", FormatDurationSexagesimal(start),
-	}
-	if length > 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
-	}
-	args = append(args, []string{
-		"-i", path,
-		// "-deadline", "good",
-		// "-c:v", "libvpx", "-crf", "10",
-		"-f", "webm",
-		"pipe:",
-	}...)
-	return transcodePipe(args, stderr)
-}
-
-// Returns a stream of Chromecast supported matroska.
-func ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
-		"-ss", FormatDurationSexagesimal(start),
-		"-i", path,
-		"-c:v", "libx264", "-preset", "ultrafast", "-profile:v", "high", "-level", "5.0",
-		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
-	if length > 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
-	}
-	args = append(args, []string{
-		"-f", "mp4",
-		"pipe:",
-	}...)
-	return transcodePipe(args, stderr)
+// The output of a running command.
+type cmdOutput struct {
+	*os.File
+	cmd *exec.Cmd
 }
 
-// Returns a stream of h264 video and mp3 audio
-func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
-		"-ss", FormatDurationSexagesimal(start),
-		"-i", path,
-		"-pix_fmt", "yuv420p",
-		"-c:v", "libx264", "-crf", "25",
-		"-c:a", "mp3", "-ab", "128k", "-ar", "44100",
-		"-preset", "ultrafast",
-		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
-	if length > 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
-	}
-	args = append(args, []string{
-		"-f", "mp4",
-		"pipe:",
-	}...)
-	return transcodePipe(args, stderr)
+func (me cmdOutput) Close() error {
+	me.cmd.Process.Kill()
+	return me.File.Close()
 }
 
 // credit laurent @ https://stackoverflow.com/questions/34118732/parse-a-command-line-string-into-flags-and-arguments-in-golang
@@ -241,3 +127,46 @@ func Exec(cmds string, start, length time.Duration, stderr io.Writer) (r io.Read
 	}
 	return transcodePipe(cmda, stderr)
 }
+
+// Runs the named built-in profile with the ffmpeg on PATH, for the functions
+// that preceded profiles.
+func defaultProfileTranscode(name, path string, start, length time.Duration, stderr io.Writer) (io.ReadCloser, error) {
+	for i := range DefaultProfiles {
+		if DefaultProfiles[i].Name == name {
+			return (&Transcoder{FFmpeg: "ffmpeg"}).Transcode(&DefaultProfiles[i], path, start, length, stderr)
+		}
+	}
+	return nil, fmt.Errorf("no built-in profile named %q", name)
+}
+
+// Transcode streams the file in the MPEG_PS_PAL DLNA profile.
+//
+// Deprecated: Use Transcoder.Transcode with the "t" profile in
+// DefaultProfiles.
+func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	return defaultProfileTranscode("t", path, start, length, stderr)
+}
+
+// VP8Transcode returns a stream of Chromecast supported VP8.
+//
+// Deprecated: Use Transcoder.Transcode with the "vp8" profile in
+// DefaultProfiles.
+func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	return defaultProfileTranscode("vp8", path, start, length, stderr)
+}
+
+// ChromecastTranscode returns a stream of Chromecast supported MP4.
+//
+// Deprecated: Use Transcoder.Transcode with the "chromecast" profile in
+// DefaultProfiles.
+func ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	return defaultProfileTranscode("chromecast", path, start, length, stderr)
+}
+
+// WebTranscode returns a stream of H.264 video and MP3 audio.
+//
+// Deprecated: Use Transcoder.Transcode with the "web" profile in
+// DefaultProfiles.
+func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	return defaultProfileTranscode("web", path, start, length, stderr)
+}
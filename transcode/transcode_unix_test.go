@@ -0,0 +1,80 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package transcode
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTranscodePipe(t *testing.T) {
+	// All output is read, even once the command has exited.
+	r, err := transcodePipe([]string{"sh", "-c", "seq 1 100000"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || len(b) != 588895 {
+		t.Fatal(len(b), err)
+	}
+
+	// Closing the output kills the command.
+	r, err = transcodePipe([]string{"sh", "-c", "echo started; exec sleep 60"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(r).ReadString('\n'); line != "started\n" {
+		t.Fatal(line)
+	}
+	cmd := r.(cmdOutput).cmd
+	r.Close()
+	done := make(chan struct{})
+	go func() {
+		for cmd.Process.Signal(syscall.Signal(0)) == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command still running")
+	}
+}
+
+func TestDeprecatedTranscodes(t *testing.T) {
+	// An ffmpeg that writes its arguments.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\necho \"$@\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	for _, tc := range []struct {
+		transcode func(string, time.Duration, time.Duration, io.Writer) (io.ReadCloser, error)
+		format    string
+	}{
+		{Transcode, "-f mpegts"},
+		{VP8Transcode, "-f webm"},
+		{ChromecastTranscode, "-f mp4"},
+		{WebTranscode, "-f mp4"},
+	} {
+		r, err := tc.transcode("in.mkv", time.Second, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !strings.Contains(string(b), "-i in.mkv") || !strings.Contains(string(b), tc.format) {
+			t.Fatal(string(b), err)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package upnp
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -38,22 +44,70 @@ type Variable struct {
 }
 
 type subscriber struct {
-	sid     string
-	nextSeq uint32 // 0 for initial event, wraps from Uint32Max to 1.
+	sid string
+	// 0 is reserved for the initial event. Wraps from Uint32Max to 1.
+	nextSeq uint32
 	urls    []*url.URL
 	expiry  time.Time
+	// Held while delivering an event, so that events arrive in SEQ order.
+	sending sync.Mutex
+	// Closed once the initial event has been sent. Other events wait for it.
+	initialSent     chan struct{}
+	initialSentOnce sync.Once
 }
 
-// Intended to eventually be an embeddable implementation for managing
-// eventing for a service. Not complete.
+const (
+	// Used when a subscriber doesn't request a timeout, or requests an
+	// infinite one.
+	DefaultSubscriptionTimeout = 1800
+	// The most events delivered at once by Notify, if not overridden.
+	DefaultMaxConcurrentNotifies = 8
+	// How long an event callback may take, if not overridden.
+	DefaultNotifyTimeout = 10 * time.Second
+)
+
+var ErrNoSuchSubscription = errors.New("no such subscription")
+
+// Eventing is an embeddable implementation of GENA eventing for a service. It
+// manages subscriptions, renewals and expiry, and delivers events with
+// sequence numbers to subscribers.
 type Eventing struct {
 	mutex       sync.Mutex
 	subscribers map[string]*subscriber
+	// The HTTP client used to deliver events. http.DefaultClient if nil.
+	Client *http.Client
+	// The most event callbacks Notify makes at once. If zero,
+	// DefaultMaxConcurrentNotifies is used.
+	MaxConcurrentNotifies int
+	// The time allowed for each event callback. If zero,
+	// DefaultNotifyTimeout is used.
+	NotifyTimeout time.Duration
+}
+
+// Returns the actual timeout for a requested subscription timeout.
+func subscriptionTimeout(requested int) int {
+	if requested <= 0 {
+		return DefaultSubscriptionTimeout
+	}
+	return requested
+}
+
+// Removes subscribers that have expired. The mutex must be held.
+func (me *Eventing) reapLocked(now time.Time) {
+	for sid, sub := range me.subscribers {
+		if !now.Before(sub.expiry) {
+			delete(me.subscribers, sid)
+		}
+	}
 }
 
+// Subscribe adds a subscriber with the given callback URLs. A timeoutSeconds
+// of zero or less requests the default timeout.
 func (me *Eventing) Subscribe(callback []*url.URL, timeoutSeconds int) (sid string, actualTimeout int, err error) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
+	now := time.Now()
+	me.reapLocked(now)
 
 	var uuid [16]byte
 	io.ReadFull(rand.Reader, uuid[:])
@@ -62,25 +116,222 @@ func (me *Eventing) Subscribe(callback []*url.URL, timeoutSeconds int) (sid stri
 		err = fmt.Errorf("already subscribed: %s", sid)
 		return
 	}
+	actualTimeout = subscriptionTimeout(timeoutSeconds)
 	ssr := &subscriber{
-		sid:    sid,
-		urls:   callback,
-		expiry: time.Now().Add(time.Duration(timeoutSeconds) * time.Second),
+		sid:         sid,
+		nextSeq:     1,
+		urls:        callback,
+		expiry:      now.Add(time.Duration(actualTimeout) * time.Second),
+		initialSent: make(chan struct{}),
 	}
 	if me.subscribers == nil {
 		me.subscribers = make(map[string]*subscriber)
 	}
 	me.subscribers[sid] = ssr
-	actualTimeout = int(ssr.expiry.Sub(time.Now()) / time.Second)
 	return
 }
 
+// Renew extends an existing subscription. ErrNoSuchSubscription is returned
+// if the subscription doesn't exist or has already expired.
+func (me *Eventing) Renew(sid string, timeoutSeconds int) (actualTimeout int, err error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	now := time.Now()
+	me.reapLocked(now)
+	sub, ok := me.subscribers[sid]
+	if !ok {
+		err = ErrNoSuchSubscription
+		return
+	}
+	actualTimeout = subscriptionTimeout(timeoutSeconds)
+	sub.expiry = now.Add(time.Duration(actualTimeout) * time.Second)
+	return
+}
+
+// Unsubscribe cancels a subscription. ErrNoSuchSubscription is returned if
+// the subscription doesn't exist or has already expired.
 func (me *Eventing) Unsubscribe(sid string) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.reapLocked(time.Now())
+	if _, ok := me.subscribers[sid]; !ok {
+		return ErrNoSuchSubscription
+	}
+	delete(me.subscribers, sid)
+	return nil
+}
+
+// Returns the SEQ for the next event to the subscriber, and advances it.
+func (me *subscriber) takeSeq() (seq uint32) {
+	seq = me.nextSeq
+	me.nextSeq++
+	if me.nextSeq == 0 {
+		me.nextSeq = 1
+	}
+	return
+}
+
+// Notify sends an event containing the variables to every live subscriber,
+// and returns once every delivery has succeeded or failed. At most
+// MaxConcurrentNotifies callbacks are made at once.
+func (me *Eventing) Notify(vars ...Variable) {
+	me.mutex.Lock()
+	me.reapLocked(time.Now())
+	subs := make([]*subscriber, 0, len(me.subscribers))
+	for _, sub := range me.subscribers {
+		subs = append(subs, sub)
+	}
+	me.mutex.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	body, err := eventBody(vars)
+	if err != nil {
+		slog.Info("error marshalling event", "error", err)
+		return
+	}
+	maxConcurrent := me.MaxConcurrentNotifies
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentNotifies
+	}
+	sem := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+	for _, sub := range subs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := me.notify(sub, body); err != nil {
+				slog.Info("error notifying subscriber", "sid", sub.sid, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// NotifySubscriber sends an event containing the variables to a single
+// subscriber.
+func (me *Eventing) NotifySubscriber(sid string, vars ...Variable) error {
+	sub, body, err := me.subscriberEvent(sid, vars)
+	if err != nil {
+		return err
+	}
+	return me.notify(sub, body)
+}
+
+// NotifyInitial sends the initial event that follows a subscription, with
+// the SEQ of 0 reserved for it. Other events to the subscriber are held until
+// it has been sent, or until NotifyTimeout has passed.
+func (me *Eventing) NotifyInitial(sid string, vars ...Variable) error {
+	sub, body, err := me.subscriberEvent(sid, vars)
+	if err != nil {
+		return err
+	}
+	sub.sending.Lock()
+	defer sub.sending.Unlock()
+	defer sub.initialSentOnce.Do(func() { close(sub.initialSent) })
+	return me.sendSeq(sub, 0, body)
+}
+
+func (me *Eventing) subscriberEvent(sid string, vars []Variable) (*subscriber, []byte, error) {
+	me.mutex.Lock()
+	me.reapLocked(time.Now())
+	sub, ok := me.subscribers[sid]
+	me.mutex.Unlock()
+	if !ok {
+		return nil, nil, ErrNoSuchSubscription
+	}
+	body, err := eventBody(vars)
+	return sub, body, err
+}
+
+func (me *Eventing) notifyTimeout() time.Duration {
+	if me.NotifyTimeout <= 0 {
+		return DefaultNotifyTimeout
+	}
+	return me.NotifyTimeout
+}
+
+func (me *Eventing) notify(sub *subscriber, body []byte) (err error) {
+	select {
+	case <-sub.initialSent:
+	case <-time.After(me.notifyTimeout()):
+	}
+	sub.sending.Lock()
+	defer sub.sending.Unlock()
+	me.mutex.Lock()
+	seq := sub.takeSeq()
+	me.mutex.Unlock()
+	return me.sendSeq(sub, seq, body)
+}
+
+// Delivers an event with the given SEQ. The sending mutex must be held.
+func (me *Eventing) sendSeq(sub *subscriber, seq uint32, body []byte) (err error) {
+	timeout := me.notifyTimeout()
+	// The callback URLs are tried in order until one succeeds. See UPnP
+	// Device Architecture 4.2.1.
+	for _, u := range sub.urls {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = me.sendEvent(ctx, u, sub.sid, seq, body)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return
+}
+
+func eventBody(vars []Variable) ([]byte, error) {
+	ps := PropertySet{
+		Space: "urn:schemas-upnp-org:event-1-0",
+	}
+	for _, v := range vars {
+		ps.Properties = append(ps.Properties, Property{Variable: v})
+	}
+	body, err := xml.Marshal(ps)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(`<?xml version="1.0"?>`+"\n"), body...), nil
+}
+
+func (me *Eventing) sendEvent(ctx context.Context, u *url.URL, sid string, seq uint32, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "NOTIFY", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header["CONTENT-TYPE"] = []string{`text/xml; charset="utf-8"`}
+	req.Header["NT"] = []string{"upnp:event"}
+	req.Header["NTS"] = []string{"upnp:propchange"}
+	req.Header["SID"] = []string{sid}
+	req.Header["SEQ"] = []string{strconv.FormatUint(uint64(seq), 10)}
+	client := me.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
 	return nil
 }
 
 var callbackURLRegexp = regexp.MustCompile("<(.*?)>")
 
+// ParseTimeoutHeader parses the TIMEOUT HTTP header of a subscription
+// request, such as "Second-1800". Zero is returned for "Second-infinite" or
+// an unparseable value, which requests the default timeout.
+func ParseTimeoutHeader(s string) (seconds int) {
+	fmt.Sscanf(strings.TrimSpace(s), "Second-%d", &seconds)
+	return
+}
+
 // Parse the CALLBACK HTTP header in an event subscription request. See UPnP
 // Device Architecture 4.1.2.
 func ParseCallbackURLs(callback string) (ret []*url.URL) {
@@ -1,8 +1,14 @@
 package upnp
 
 import (
+	"bytes"
 	"encoding/xml"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 // Visually verify that property sets are marshalled correctly.
@@ -59,3 +65,100 @@ func TestSubscribeRace(t *testing.T) {
 	<-done
 	<-done
 }
+
+func TestNotify(t *testing.T) {
+	type event struct {
+		sid, seq string
+		body     []byte
+	}
+	events := make(chan event, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events <- event{r.Header.Get("SID"), r.Header.Get("SEQ"), body}
+	}))
+	defer srv.Close()
+	var e Eventing
+	sid, _, err := e.Subscribe(ParseCallbackURLs("<"+srv.URL+">"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Variable{XMLName: xml.Name{Local: "SystemUpdateID"}, Value: "42"}
+	// An event that comes before the initial event waits for it.
+	notified := make(chan struct{})
+	go func() {
+		e.Notify(v)
+		close(notified)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := e.NotifyInitial(sid, v); err != nil {
+		t.Fatal(err)
+	}
+	<-notified
+	e.Notify(v)
+	for _, seq := range []string{"0", "1", "2"} {
+		ev := <-events
+		if ev.sid != sid || ev.seq != seq {
+			t.Fatalf("got sid %q seq %q, expected %q %q", ev.sid, ev.seq, sid, seq)
+		}
+		if !bytes.Contains(ev.body, []byte("<SystemUpdateID>42</SystemUpdateID>")) {
+			t.Fatalf("unexpected body: %s", ev.body)
+		}
+	}
+}
+
+func TestRenewUnsubscribe(t *testing.T) {
+	var e Eventing
+	sid, timeout, err := e.Subscribe(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout != DefaultSubscriptionTimeout {
+		t.Fatal(timeout)
+	}
+	if timeout, err = e.Renew(sid, 60); err != nil || timeout != 60 {
+		t.Fatal(timeout, err)
+	}
+	if err := e.Unsubscribe(sid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Renew(sid, 60); err != ErrNoSuchSubscription {
+		t.Fatal(err)
+	}
+	if err := e.Unsubscribe(sid); err != ErrNoSuchSubscription {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriptionExpiry(t *testing.T) {
+	var e Eventing
+	sid, _, _ := e.Subscribe(nil, 10)
+	e.subscribers[sid].expiry = time.Now().Add(-time.Second)
+	if _, err := e.Renew(sid, 10); err != ErrNoSuchSubscription {
+		t.Fatal(err)
+	}
+	if len(e.subscribers) != 0 {
+		t.Fatal(len(e.subscribers))
+	}
+}
+
+func TestSeqWraparound(t *testing.T) {
+	sub := subscriber{nextSeq: math.MaxUint32}
+	if seq := sub.takeSeq(); seq != math.MaxUint32 {
+		t.Fatal(seq)
+	}
+	if seq := sub.takeSeq(); seq != 1 {
+		t.Fatal(seq)
+	}
+}
+
+func TestParseTimeoutHeader(t *testing.T) {
+	for s, expected := range map[string]int{
+		"Second-1800":     1800,
+		"Second-infinite": 0,
+		"":                0,
+	} {
+		if actual := ParseTimeoutHeader(s); actual != expected {
+			t.Errorf("%q: got %d, expected %d", s, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package upnpav
+
+import (
+	"strings"
+)
+
+// Filter is a parsed ContentDirectory Filter argument, naming the optional
+// properties a client wants in results, such as "upnp:artist" or
+// "res@size". "*" includes them all. The required properties, res elements
+// and their protocolInfo, and the childCount and searchable attributes of
+// containers are always included.
+type Filter struct {
+	all   bool
+	names map[string]bool
+}
+
+// ParseFilter parses a comma-separated Filter argument. Unknown properties
+// are ignored.
+func ParseFilter(s string) (ret Filter) {
+	ret.names = make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			ret.all = true
+		}
+		ret.names[name] = true
+	}
+	return
+}
+
+// Includes reports whether the filter includes the named property.
+func (me Filter) Includes(name string) bool {
+	return me.all || me.names[name]
+}
+
+// Optional object properties, keyed by their name in a Filter.
+var objectFilterProperties = map[string]func(o *Object){
+	"upnp:icon":                func(o *Object) { o.Icon = "" },
+	"dc:date":                  func(o *Object) { o.Date = Timestamp{} },
+	"upnp:artist":              func(o *Object) { o.Artist = "" },
+	"upnp:album":               func(o *Object) { o.Album = "" },
+	"upnp:genre":               func(o *Object) { o.Genre = "" },
+	"upnp:originalTrackNumber": func(o *Object) { o.TrackNumber = 0 },
+	"upnp:albumArtURI":         func(o *Object) { o.AlbumArtURI = "" },
+	"dc:creator":               func(o *Object) { o.Creator = "" },
+	"dc:description":           func(o *Object) { o.Description = "" },
+	"upnp:actor":               func(o *Object) { o.Actors = nil },
+	"upnp:director":            func(o *Object) { o.Director = "" },
+}
+
+// Optional resource attributes, keyed by their name in a Filter.
+var resourceFilterProperties = map[string]func(r *Resource){
+	"res@size":            func(r *Resource) { r.Size = 0 },
+	"res@bitrate":         func(r *Resource) { r.Bitrate = 0 },
+	"res@duration":        func(r *Resource) { r.Duration = "" },
+	"res@resolution":      func(r *Resource) { r.Resolution = "" },
+	"res@nrAudioChannels": func(r *Resource) { r.NrAudioChannels = 0 },
+	"res@sampleFrequency": func(r *Resource) { r.SampleFrequency = 0 },
+	"res@bitsPerSample":   func(r *Resource) { r.BitsPerSample = 0 },
+	"res@dlna:profileID":  func(r *Resource) { r.ProfileID = "" },
+}
+
+// Apply returns a copy of obj, which should be an Item or a Container,
+// without the optional properties the filter doesn't include. Other values
+// are returned as they are.
+func (me Filter) Apply(obj interface{}) interface{} {
+	if me.all {
+		return obj
+	}
+	switch v := obj.(type) {
+	case Item:
+		me.applyObject(&v.Object)
+		res := make([]Resource, 0, len(v.Res))
+		for _, r := range v.Res {
+			for name, clear := range resourceFilterProperties {
+				if !me.Includes(name) {
+					clear(&r)
+				}
+			}
+			res = append(res, r)
+		}
+		v.Res = res
+		if !me.Includes("@refID") {
+			v.RefID = ""
+		}
+		if !me.Includes("sec:CaptionInfoEx") {
+			v.CaptionInfoEx = nil
+		}
+		return v
+	case Container:
+		me.applyObject(&v.Object)
+		return v
+	}
+	return obj
+}
+
+func (me Filter) applyObject(o *Object) {
+	for name, clear := range objectFilterProperties {
+		if !me.Includes(name) {
+			clear(o)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package upnpav
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	item := Item{
+		Object: Object{
+			ID:      "1",
+			Title:   "Song",
+			Class:   "object.item.audioItem.musicTrack",
+			Date:    Timestamp{Time: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+			Artist:  "Queen",
+			Creator: "Queen",
+			Actors:  []string{"Freddie"},
+		},
+		RefID: "2",
+		Res:   []Resource{{ProtocolInfo: "http-get:*:audio/flac:*", Size: 1000, NrAudioChannels: 2, SampleFrequency: 44100}},
+	}
+	marshal := func(filter string) string {
+		out, err := xml.Marshal(ParseFilter(filter).Apply(item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	all := marshal("*")
+	for _, s := range []string{"<dc:date>2020-01-02T00:00:00Z</dc:date>", "<upnp:actor>Freddie</upnp:actor>", ` sampleFrequency="44100"`, ` refID="2"`} {
+		if !strings.Contains(all, s) {
+			t.Fatalf("%s missing from %s", s, all)
+		}
+	}
+	// Only required properties, with res and its protocolInfo.
+	if got := marshal(""); got != `<item id="1" parentID="" restricted="0" searchable="0"><dc:title>Song</dc:title>`+
+		`<upnp:class>object.item.audioItem.musicTrack</upnp:class><res protocolInfo="http-get:*:audio/flac:*"></res></item>` {
+		t.Fatal(got)
+	}
+	if got := marshal("@refID"); !strings.Contains(got, ` refID="2"`) {
+		t.Fatal(got)
+	}
+	got := marshal("dc:creator, res@nrAudioChannels")
+	if !strings.Contains(got, "<dc:creator>Queen</dc:creator>") || strings.Contains(got, "upnp:artist") ||
+		!strings.Contains(got, ` nrAudioChannels="2"`) || strings.Contains(got, "size=") {
+		t.Fatal(got)
+	}
+	// The original is left alone.
+	if item.Artist == "" || item.Res[0].Size == 0 {
+		t.Fatal(item)
+	}
+}
@@ -0,0 +1,147 @@
+package upnpav
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the Object and resources for an Item or Container, or pointers to
+// them.
+func objectParts(obj interface{}) (o *Object, res []Resource, isContainer bool) {
+	switch v := obj.(type) {
+	case Item:
+		return &v.Object, v.Res, false
+	case *Item:
+		return &v.Object, v.Res, false
+	case Container:
+		return &v.Object, nil, true
+	case *Container:
+		return &v.Object, nil, true
+	}
+	return nil, nil, false
+}
+
+type propertyGetter func(o *Object, res []Resource, isContainer bool) []string
+
+func nonEmpty(ss ...string) (ret []string) {
+	for _, s := range ss {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return
+}
+
+func resAttr(f func(Resource) string) propertyGetter {
+	return func(_ *Object, res []Resource, _ bool) (ret []string) {
+		for _, r := range res {
+			ret = append(ret, nonEmpty(f(r))...)
+		}
+		return
+	}
+}
+
+// Properties that can be searched and sorted on, keyed by their name in
+// search and sort criteria.
+var properties = map[string]propertyGetter{
+	"@id": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.ID)
+	},
+	"@parentID": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.ParentID)
+	},
+	"dc:title": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Title)
+	},
+	"upnp:class": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Class)
+	},
+	"dc:date": func(o *Object, _ []Resource, _ bool) []string {
+		if o.Date.IsZero() {
+			return nil
+		}
+		// In UTC, so dates with different offsets order correctly.
+		return []string{o.Date.UTC().Format(time.RFC3339)}
+	},
+	"upnp:artist": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Artist)
+	},
+	"upnp:album": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Album)
+	},
+	"upnp:genre": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Genre)
+	},
+	"upnp:originalTrackNumber": func(o *Object, _ []Resource, _ bool) []string {
+		if o.TrackNumber == 0 {
+			return nil
+		}
+		return []string{strconv.Itoa(o.TrackNumber)}
+	},
+	"dc:creator": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Creator)
+	},
+	"dc:description": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Description)
+	},
+	"upnp:actor": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Actors...)
+	},
+	"upnp:director": func(o *Object, _ []Resource, _ bool) []string {
+		return nonEmpty(o.Director)
+	},
+	"res@protocolInfo": resAttr(func(r Resource) string {
+		return r.ProtocolInfo
+	}),
+	"res@size": resAttr(func(r Resource) string {
+		if r.Size == 0 {
+			return ""
+		}
+		return strconv.FormatUint(r.Size, 10)
+	}),
+	"res@duration": resAttr(func(r Resource) string {
+		return r.Duration
+	}),
+	"res@resolution": resAttr(func(r Resource) string {
+		return r.Resolution
+	}),
+}
+
+// Property returns the values of the named property for the given Item or
+// Container. ok is false if the object doesn't have the property, or the
+// property isn't known.
+func Property(obj interface{}, name string) (vals []string, ok bool) {
+	o, res, isContainer := objectParts(obj)
+	if o == nil {
+		return
+	}
+	getter, known := properties[name]
+	if !known {
+		return
+	}
+	vals = getter(o, res, isContainer)
+	ok = len(vals) != 0
+	return
+}
+
+// Returns the comma-separated list of properties that can be used in
+// search criteria, as reported by GetSearchCapabilities.
+func SearchCapabilities() string {
+	return strings.Join(propertyNames(), ",")
+}
+
+// Returns the comma-separated list of properties that can be used in sort
+// criteria, as reported by GetSortCapabilities.
+func SortCapabilities() string {
+	return strings.Join(propertyNames(), ",")
+}
+
+func propertyNames() (ret []string) {
+	for name := range properties {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return
+}
@@ -0,0 +1,334 @@
+package upnpav
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchCriteria is a parsed ContentDirectory search expression. See
+// ContentDirectory:1 section 2.5.5 for the grammar. The zero value matches
+// every object, as does the "*" criteria.
+type SearchCriteria struct {
+	expr searchExpr
+}
+
+type searchExpr interface {
+	match(obj interface{}) bool
+}
+
+type logExpr struct {
+	and         bool
+	left, right searchExpr
+}
+
+func (me logExpr) match(obj interface{}) bool {
+	if me.and {
+		return me.left.match(obj) && me.right.match(obj)
+	}
+	return me.left.match(obj) || me.right.match(obj)
+}
+
+type relExpr struct {
+	property string
+	op       string
+	value    string
+}
+
+func (me relExpr) match(obj interface{}) bool {
+	vals, ok := me.values(obj)
+	if me.op == "exists" {
+		return ok == (me.value == "true")
+	}
+	if me.op == "doesNotContain" {
+		for _, v := range vals {
+			if containsFold(v, me.value) {
+				return false
+			}
+		}
+		return ok
+	}
+	for _, v := range vals {
+		if compareOp(me.op, v, me.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the values of the property to compare with. Dates are compared by
+// day, in their own time zone, with criteria that don't give a time.
+func (me relExpr) values(obj interface{}) ([]string, bool) {
+	if me.property == "dc:date" {
+		if _, err := time.Parse(time.DateOnly, me.value); err == nil {
+			if o, _, _ := objectParts(obj); o != nil && !o.Date.IsZero() {
+				return []string{o.Date.Format(time.DateOnly)}, true
+			}
+		}
+	}
+	return Property(obj, me.property)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func compareOp(op, have, want string) bool {
+	switch op {
+	case "contains":
+		return containsFold(have, want)
+	case "derivedfrom":
+		have, want = strings.ToLower(have), strings.ToLower(want)
+		return have == want || strings.HasPrefix(have, want+".")
+	case "=":
+		return strings.EqualFold(have, want)
+	case "!=":
+		return !strings.EqualFold(have, want)
+	}
+	c := compareValues(have, want)
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// Compares numerically if both values are integers, and in natural order
+// otherwise. ISO 8601 dates and sexagesimal durations of equal precision
+// order correctly that way.
+func compareValues(a, b string) int {
+	ai, aErr := strconv.ParseInt(a, 10, 64)
+	bi, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+	return CompareNatural(a, b)
+}
+
+// Returns true if the object satisfies the criteria. obj should be an Item or
+// a Container.
+func (me SearchCriteria) Match(obj interface{}) bool {
+	if me.expr == nil {
+		return true
+	}
+	return me.expr.match(obj)
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of search criteria")
+
+// ParseSearchCriteria parses a SearchCriteria argument as given to the
+// ContentDirectory Search action.
+func ParseSearchCriteria(s string) (ret SearchCriteria, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return
+	}
+	p := searchParser{}
+	p.toks, err = tokenizeSearchCriteria(s)
+	if err != nil {
+		return
+	}
+	ret.expr, err = p.parseOr()
+	if err != nil {
+		return
+	}
+	if p.pos != len(p.toks) {
+		err = fmt.Errorf("unexpected %q in search criteria", p.toks[p.pos].text)
+	}
+	return
+}
+
+type searchToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeSearchCriteria(s string) (toks []searchToken, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, searchToken{text: s[i : i+1]})
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return nil, errors.New("unterminated quoted value in search criteria")
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					b.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == '"' {
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+				i++
+			}
+			toks = append(toks, searchToken{text: b.String(), quoted: true})
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			if s[i:j] == "!" {
+				return nil, errors.New("expected '!=' in search criteria")
+			}
+			toks = append(toks, searchToken{text: s[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune(`()"=!<>`, rune(s[j])) {
+				j++
+			}
+			toks = append(toks, searchToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return
+}
+
+type searchParser struct {
+	toks []searchToken
+	pos  int
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.toks) {
+		return searchToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *searchParser) next() (tok searchToken, err error) {
+	tok, ok := p.peek()
+	if !ok {
+		err = errUnexpectedEnd
+		return
+	}
+	p.pos++
+	return
+}
+
+// "and" binds tighter than "or".
+func (p *searchParser) parseOr() (searchExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.quoted || !strings.EqualFold(tok.text, "or") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logExpr{and: false, left: left, right: right}
+	}
+}
+
+func (p *searchParser) parseAnd() (searchExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.quoted || !strings.EqualFold(tok.text, "and") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = logExpr{and: true, left: left, right: right}
+	}
+}
+
+var searchOps = map[string]string{
+	"=":              "=",
+	"!=":             "!=",
+	"<":              "<",
+	"<=":             "<=",
+	">":              ">",
+	">=":             ">=",
+	"contains":       "contains",
+	"doesnotcontain": "doesNotContain",
+	"derivedfrom":    "derivedfrom",
+	"exists":         "exists",
+}
+
+func (p *searchParser) parsePrimary() (searchExpr, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !tok.quoted && tok.text == "(" {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		tok, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.quoted || tok.text != ")" {
+			return nil, fmt.Errorf("expected ')' in search criteria, got %q", tok.text)
+		}
+		return expr, nil
+	}
+	if tok.quoted || tok.text == ")" {
+		return nil, fmt.Errorf("expected property in search criteria, got %q", tok.text)
+	}
+	rel := relExpr{property: tok.text}
+	tok, err = p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := searchOps[strings.ToLower(tok.text)]
+	if tok.quoted || !ok {
+		return nil, fmt.Errorf("unknown search operator %q", tok.text)
+	}
+	rel.op = op
+	tok, err = p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op == "exists" {
+		rel.value = strings.ToLower(tok.text)
+		if tok.quoted || (rel.value != "true" && rel.value != "false") {
+			return nil, fmt.Errorf("expected boolean after exists, got %q", tok.text)
+		}
+		return rel, nil
+	}
+	if !tok.quoted {
+		return nil, fmt.Errorf("expected quoted value in search criteria, got %q", tok.text)
+	}
+	rel.value = tok.text
+	return rel, nil
+}
@@ -0,0 +1,142 @@
+package upnpav
+
+import (
+	"testing"
+	"time"
+)
+
+var searchTestObjects = []interface{}{
+	Container{Object: Object{ID: "1", Title: "Movies", Class: "object.container.storageFolder"}},
+	Item{
+		Object: Object{ID: "2", Title: "The Big Lebowski", Class: "object.item.videoItem", Date: Timestamp{Time: time.Date(2019, 5, 5, 12, 0, 0, 0, time.UTC)}},
+		Res:    []Resource{{ProtocolInfo: "http-get:*:video/mp4:*", Size: 1000}},
+	},
+	Item{
+		Object: Object{ID: "3", Title: "Lebowski Fest \"Live\"", Class: "object.item.audioItem.musicTrack", Artist: "Various"},
+		Res:    []Resource{{ProtocolInfo: "http-get:*:audio/mpeg:*", Size: 10}},
+	},
+	Item{
+		Object: Object{ID: "4", Title: "Holiday", Class: "object.item.imageItem.photo", Date: Timestamp{Time: time.Date(2020, 1, 2, 0, 30, 0, 0, time.FixedZone("", 3600))}},
+	},
+}
+
+func searchIDs(t *testing.T, criteria string) (ret []string) {
+	sc, err := ParseSearchCriteria(criteria)
+	if err != nil {
+		t.Fatalf("parsing %q: %s", criteria, err)
+	}
+	for _, obj := range searchTestObjects {
+		if sc.Match(obj) {
+			o, _, _ := objectParts(obj)
+			ret = append(ret, o.ID)
+		}
+	}
+	return
+}
+
+func TestSearchCriteria(t *testing.T) {
+	for _, tc := range []struct {
+		criteria string
+		ids      string
+	}{
+		{`*`, "1234"},
+		{``, "1234"},
+		{`dc:title contains "lebowski"`, "23"},
+		{`dc:title contains "Lebowski" and upnp:class derivedfrom "object.item.videoItem"`, "2"},
+		{`upnp:class derivedfrom "object.item.audioItem" or upnp:class = "object.item.imageItem.photo"`, "34"},
+		{`upnp:class derivedfrom "object.item.audio"`, ""},
+		{`upnp:artist exists true`, "3"},
+		{`upnp:artist exists false`, "124"},
+		{`dc:title doesNotContain "lebowski"`, "14"},
+		{`dc:title contains "\"Live\""`, "3"},
+		{`res@size > "100"`, "2"},
+		{`res@size <= "100"`, "3"},
+		{`(dc:title = "holiday" or dc:title = "movies") and upnp:class derivedfrom "object.container"`, "1"},
+		{`dc:title != "Holiday" and upnp:class derivedfrom "object.item"`, "23"},
+		// Dates without a time match on the day, although 4 is on the 1st in
+		// UTC.
+		{`dc:date = "2020-01-02"`, "4"},
+		{`dc:date < "2020-01-01"`, "2"},
+		{`dc:date >= "2020-01-02"`, "4"},
+		{`dc:date > "2019-05-05T11:00:00Z"`, "24"},
+	} {
+		var ids string
+		for _, id := range searchIDs(t, tc.criteria) {
+			ids += id
+		}
+		if ids != tc.ids {
+			t.Errorf("%q matched %q, expected %q", tc.criteria, ids, tc.ids)
+		}
+	}
+}
+
+func TestSearchCriteriaErrors(t *testing.T) {
+	for _, criteria := range []string{
+		`dc:title`,
+		`dc:title contains`,
+		`dc:title contains lebowski`,
+		`dc:title like "x"`,
+		`(dc:title contains "x"`,
+		`dc:title contains "x" and`,
+		`dc:title contains "x`,
+		`upnp:artist exists "true"`,
+		`dc:title ! "x"`,
+	} {
+		if _, err := ParseSearchCriteria(criteria); err == nil {
+			t.Errorf("expected error parsing %q", criteria)
+		}
+	}
+}
+
+func TestSortCriteria(t *testing.T) {
+	sc, err := ParseSortCriteria("+upnp:class,-dc:title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs := append([]interface{}(nil), searchTestObjects...)
+	sc.Sort(objs)
+	var ids string
+	for _, obj := range objs {
+		o, _, _ := objectParts(obj)
+		ids += o.ID
+	}
+	if ids != "1342" {
+		t.Fatal(ids)
+	}
+	if _, err := ParseSortCriteria("+dc:nonsense"); err == nil {
+		t.Fatal("expected error for unsupported sort property")
+	}
+
+	// Tracks by number, and titles in natural order where the numbers tie.
+	objs = []interface{}{
+		Item{Object: Object{ID: "a", Title: "Episode 10", TrackNumber: 2}},
+		Item{Object: Object{ID: "b", Title: "Episode 9", TrackNumber: 2}},
+		Item{Object: Object{ID: "c", Title: "Episode 11"}},
+		Item{Object: Object{ID: "d", Title: "Intro", TrackNumber: 1}},
+	}
+	sc, err = ParseSortCriteria("+upnp:originalTrackNumber, +dc:title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Sort(objs)
+	ids = ""
+	for _, obj := range objs {
+		o, _, _ := objectParts(obj)
+		ids += o.ID
+	}
+	if ids != "dbac" {
+		t.Fatal(ids)
+	}
+}
+
+func TestCompareNatural(t *testing.T) {
+	ordered := []string{"", "01", "1", "2", "10", "a", "Episode 2", "episode 10", "Episode 10b", "Episode 010c", "x"}
+	for i := range ordered {
+		for j := range ordered {
+			c := CompareNatural(ordered[i], ordered[j])
+			if c != cmpInt(i, j) {
+				t.Errorf("CompareNatural(%q, %q) = %d", ordered[i], ordered[j], c)
+			}
+		}
+	}
+}
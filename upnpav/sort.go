@@ -0,0 +1,134 @@
+package upnpav
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A single key in a SortCriteria argument, such as "-dc:date".
+type SortKey struct {
+	Property   string
+	Descending bool
+}
+
+// SortCriteria is a parsed ContentDirectory SortCriteria argument. An empty
+// SortCriteria leaves objects in their existing order.
+type SortCriteria []SortKey
+
+// ParseSortCriteria parses a comma-separated list of properties, each
+// prefixed with '+' for ascending or '-' for descending order. Properties
+// that can't be sorted on are an error.
+func ParseSortCriteria(s string) (ret SortCriteria, err error) {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		var key SortKey
+		switch field[0] {
+		case '-':
+			key.Descending = true
+			field = field[1:]
+		case '+':
+			field = field[1:]
+		}
+		if _, ok := properties[field]; !ok {
+			err = fmt.Errorf("unsupported sort property %q", field)
+			return
+		}
+		key.Property = field
+		ret = append(ret, key)
+	}
+	return
+}
+
+// Compares two objects by the sort keys. Objects missing a property sort
+// after those that have it.
+func (me SortCriteria) compare(a, b interface{}) int {
+	for _, key := range me {
+		av, aok := Property(a, key.Property)
+		bv, bok := Property(b, key.Property)
+		var c int
+		switch {
+		case !aok && !bok:
+			continue
+		case !aok:
+			return 1
+		case !bok:
+			return -1
+		default:
+			c = compareValues(av[0], bv[0])
+		}
+		if key.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Sort stably orders objs, which should be Items or Containers, by the
+// criteria.
+func (me SortCriteria) Sort(objs []interface{}) {
+	if len(me) == 0 {
+		return
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return me.compare(objs[i], objs[j]) < 0
+	})
+}
+
+// CompareNatural compares strings case-insensitively, with runs of digits
+// compared by their numeric value, so that "Episode 2" orders before
+// "Episode 10". Strings that differ only in case or leading zeros are
+// ordered by their bytes, so the order is total.
+func CompareNatural(a, b string) int {
+	la, lb := strings.ToLower(a), strings.ToLower(b)
+	i, j := 0, 0
+	for i < len(la) && j < len(lb) {
+		if isDigit(la[i]) && isDigit(lb[j]) {
+			si, sj := i, j
+			for i < len(la) && isDigit(la[i]) {
+				i++
+			}
+			for j < len(lb) && isDigit(lb[j]) {
+				j++
+			}
+			na := strings.TrimLeft(la[si:i], "0")
+			nb := strings.TrimLeft(lb[sj:j], "0")
+			if len(na) != len(nb) {
+				return cmpInt(len(na), len(nb))
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+		if la[i] != lb[j] {
+			return cmpInt(int(la[i]), int(lb[j]))
+		}
+		i++
+		j++
+	}
+	if c := cmpInt(len(la)-i, len(lb)-j); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
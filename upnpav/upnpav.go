@@ -8,6 +8,15 @@ import (
 const (
 	// NoSuchObjectErrorCode : The specified ObjectID is invalid.
 	NoSuchObjectErrorCode = 701
+	// InvalidSearchCriteriaErrorCode : The search criteria specified is not
+	// supported or is invalid.
+	InvalidSearchCriteriaErrorCode = 708
+	// InvalidSortCriteriaErrorCode : The sort criteria specified is not
+	// supported or is invalid.
+	InvalidSortCriteriaErrorCode = 709
+	// NoSuchContainerErrorCode : The specified ContainerID is invalid or
+	// identifies an object that is not a container.
+	NoSuchContainerErrorCode = 710
 )
 
 // Resource description
@@ -19,6 +28,12 @@ type Resource struct {
 	Bitrate      uint     `xml:"bitrate,attr,omitempty"`
 	Duration     string   `xml:"duration,attr,omitempty"`
 	Resolution   string   `xml:"resolution,attr,omitempty"`
+	// The format of the audio, if it's known.
+	NrAudioChannels uint `xml:"nrAudioChannels,attr,omitempty"`
+	SampleFrequency uint `xml:"sampleFrequency,attr,omitempty"`
+	BitsPerSample   uint `xml:"bitsPerSample,attr,omitempty"`
+	// The DLNA media format profile, also given in ProtocolInfo.
+	ProfileID string `xml:"dlna:profileID,attr,omitempty"`
 }
 
 // Container description
@@ -31,9 +46,20 @@ type Container struct {
 // Item description
 type Item struct {
 	Object
-	XMLName  xml.Name `xml:"item"`
-	Res      []Resource
-	InnerXML string `xml:",innerxml"`
+	XMLName xml.Name `xml:"item"`
+	// The ID of the item this one is a reference to, if any.
+	RefID string `xml:"refID,attr,omitempty"`
+	Res   []Resource
+	// Samsung's subtitle element.
+	CaptionInfoEx *CaptionInfo `xml:"sec:CaptionInfoEx,omitempty"`
+	InnerXML      string       `xml:",innerxml"`
+}
+
+// CaptionInfo is the URL of a subtitle for Samsung TVs.
+type CaptionInfo struct {
+	// The subtitle format, such as "srt".
+	Type string `xml:"sec:type,attr"`
+	URL  string `xml:",chardata"`
 }
 
 // Object description
@@ -48,6 +74,11 @@ type Object struct {
 	Artist      string    `xml:"upnp:artist,omitempty"`
 	Album       string    `xml:"upnp:album,omitempty"`
 	Genre       string    `xml:"upnp:genre,omitempty"`
+	TrackNumber int       `xml:"upnp:originalTrackNumber,omitempty"`
+	Creator     string    `xml:"dc:creator,omitempty"`
+	Description string    `xml:"dc:description,omitempty"`
+	Actors      []string  `xml:"upnp:actor,omitempty"`
+	Director    string    `xml:"upnp:director,omitempty"`
 	AlbumArtURI string    `xml:"upnp:albumArtURI,omitempty"`
 	Searchable  int       `xml:"searchable,attr"`
 	SearchXML   string    `xml:",innerxml"`
@@ -56,9 +87,18 @@ type Object struct {
 // Timestamp wraps time.Time for formatting purposes
 type Timestamp struct {
 	time.Time
+	// Give only the date, for clients that don't accept a time.
+	DateOnly bool
 }
 
-// MarshalXML formats the Timestamp per DIDL-Lite spec
+// MarshalXML formats the Timestamp per DIDL-Lite spec, as an ISO 8601 date
+// and time, or just the date. A zero Timestamp is omitted.
 func (t Timestamp) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	return e.EncodeElement(t.Format("2006-01-02"), start)
+	if t.IsZero() {
+		return nil
+	}
+	if t.DateOnly {
+		return e.EncodeElement(t.Format(time.DateOnly), start)
+	}
+	return e.EncodeElement(t.Format(time.RFC3339), start)
 }
@@ -0,0 +1,24 @@
+package upnpav
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	ts := Timestamp{Time: time.Date(2020, 1, 2, 15, 4, 5, 0, time.FixedZone("", 3600))}
+	for dateOnly, expected := range map[bool]string{
+		false: "<Timestamp>2020-01-02T15:04:05+01:00</Timestamp>",
+		true:  "<Timestamp>2020-01-02</Timestamp>",
+	} {
+		ts.DateOnly = dateOnly
+		out, err := xml.Marshal(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Fatal(string(out))
+		}
+	}
+}